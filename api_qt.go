@@ -8,26 +8,41 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"sync"
+	"time"
 )
 
 const (
 	filePathQTCredentials = "data/qt_credentials.json"
+	qtLoginUrl            = "https://login.questrade.com/oauth2/token"
+	// Retries of failed GETs, waiting about qtApiRetryBackoff, then twice as
+	// long every time
+	qtApiMaxRetries   = 3
+	qtApiRetryBackoff = 250 * time.Millisecond
 )
 
 type APIRequest struct {
 	Method string
 	Path   string
 	Data   map[string]interface{}
+	// Which requests get refused first when the rate limit budget gets low
+	Priority QTApiPriority
 }
 
 type QTApi struct {
 	Credentials *QTApiCredentials
-	m           sync.Mutex
+	// Where credentials get refreshed, and the file they're saved to once
+	// refreshed (not saved when empty)
+	loginUrl        string
+	credentialsPath string
+	// Keeps requests within the rate limits of the API talked to
+	limiter *QTApiRateLimiter
+	m       sync.Mutex
 }
 
 type QTApiCredentials struct {
@@ -37,13 +52,16 @@ type QTApiCredentials struct {
 }
 
 func NewQTApi() *QTApi {
-	qt := QTApi{}
 	c, err := loadQTApiCreds()
 	if err != nil {
 		panic(err)
 	}
-	qt.Credentials = c
-	return &qt
+	return &QTApi{
+		Credentials:     c,
+		loginUrl:        qtLoginUrl,
+		credentialsPath: filePathQTCredentials,
+		limiter:         qtApiRateLimiter,
+	}
 }
 
 func loadQTApiCreds() (*QTApiCredentials, error) {
@@ -61,8 +79,8 @@ func loadQTApiCreds() (*QTApiCredentials, error) {
 	return &c, nil
 }
 
-func saveQTApiCreds(c *QTApiCredentials) error {
-	f, err := os.OpenFile(filePathQTCredentials, os.O_WRONLY|os.O_TRUNC, 0666)
+func saveQTApiCreds(path string, c *QTApiCredentials) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
@@ -71,7 +89,7 @@ func saveQTApiCreds(c *QTApiCredentials) error {
 }
 
 func (api *QTApi) RefreshCredentials() error {
-	resp, err := http.PostForm("https://login.questrade.com/oauth2/token", url.Values{
+	resp, err := http.PostForm(api.loginUrl, url.Values{
 		"grant_type":    {"refresh_token"},
 		"refresh_token": {api.Credentials.RefreshToken},
 	})
@@ -96,46 +114,70 @@ func (api *QTApi) RefreshCredentials() error {
 		return err
 	}
 
-	return saveQTApiCreds(api.Credentials)
+	if api.credentialsPath == "" {
+		return nil
+	}
+	return saveQTApiCreds(api.credentialsPath, api.Credentials)
 }
 
+// Makes the request, GETs failing because of the network, a Questrade server
+// error or a 429 get retried with a jittered exponential backoff. Errors are
+// QTApiErrors.
 func (api *QTApi) Request(r APIRequest, responseData interface{}) error {
 	api.m.Lock()
 	defer api.m.Unlock()
 
+	if len(r.Method) == 0 {
+		r.Method = http.MethodGet
+	}
+
+	if len(r.Path) == 0 {
+		return &QTApiError{Kind: QTApiErrorValidation, Message: "API Request path is required"}
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := api.request(r, responseData)
+		apiErr, ok := err.(*QTApiError)
+		if err == nil || !ok || !apiErr.Retryable() || r.Method != http.MethodGet || attempt >= qtApiMaxRetries {
+			return err
+		}
+		backoff := qtApiRetryBackoff << uint(attempt)
+		backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		log.Printf("Retrying %s in %s: %s\n", r.Path, backoff, err.Error())
+		time.Sleep(backoff)
+	}
+}
+
+func (api *QTApi) request(r APIRequest, responseData interface{}) error {
 	var bodyReader io.Reader
 	if len(r.Data) > 0 {
 		body, err := json.Marshal(r.Data)
 		if err != nil {
-			return err
+			return &QTApiError{Kind: QTApiErrorValidation, Message: err.Error()}
 		}
-		fmt.Println(string(body))
 		bodyReader = bytes.NewReader(body)
 	}
 
-	if len(r.Method) == 0 {
-		r.Method = http.MethodGet
-	}
-
-	if len(r.Path) == 0 {
-		return errors.New("API Request path is required")
-	}
-
 	req, err := http.NewRequest(r.Method, api.Credentials.ApiServer+r.Path, bodyReader)
 	if err != nil {
-		return err
+		return &QTApiError{Kind: QTApiErrorValidation, Message: err.Error()}
 	}
 
 	req.Header.Set("Authorization", "Bearer "+api.Credentials.AccessToken)
 
+	category := qtApiCategory(r.Path)
+	if err := api.limiter.Acquire(category, r.Priority); err != nil {
+		return err
+	}
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return err
+		return &QTApiError{Kind: QTApiErrorTransient, Message: err.Error()}
 	}
 	defer resp.Body.Close()
+	api.limiter.Update(category, resp)
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return &QTApiError{Kind: QTApiErrorTransient, Message: err.Error()}
 	}
 
 	if resp.StatusCode == http.StatusUnauthorized {
@@ -144,31 +186,37 @@ func (api *QTApi) Request(r APIRequest, responseData interface{}) error {
 		err := api.RefreshCredentials()
 		if err != nil {
 			log.Println("Failed to refresh QT OAuth credentials")
-			return err
+			return &QTApiError{Kind: QTApiErrorAuth, StatusCode: resp.StatusCode, Message: err.Error()}
 		}
 		log.Println("Refreshed QT OAuth credentials")
 
 		// Retry
+		if len(r.Data) > 0 {
+			body, _ := json.Marshal(r.Data)
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
 		req.Header.Set("Authorization", "Bearer "+api.Credentials.AccessToken)
+		if err := api.limiter.Acquire(category, r.Priority); err != nil {
+			return err
+		}
 		resp, err = http.DefaultClient.Do(req)
 		if err != nil {
-			return err
+			return &QTApiError{Kind: QTApiErrorTransient, Message: err.Error()}
 		}
 		defer resp.Body.Close()
+		api.limiter.Update(category, resp)
 		body, err = ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return err
+			return &QTApiError{Kind: QTApiErrorTransient, Message: err.Error()}
 		}
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return errors.New(fmt.Sprintf(
-			"Got non 200 status code from Questrade API: %d\n\n%s\n\n%s",
-			resp.StatusCode, string(body),
-		))
+		return newQTApiStatusError(resp.StatusCode, body)
 	}
 
-	// Debug
-	fmt.Println(r.Path, string(body))
-	return json.NewDecoder(bytes.NewReader(body)).Decode(responseData)
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(responseData); err != nil {
+		return &QTApiError{Kind: QTApiErrorValidation, StatusCode: resp.StatusCode, Message: err.Error()}
+	}
+	return nil
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+type QTApiErrorKind string
+
+const (
+	// Credentials are invalid and couldn't be refreshed
+	QTApiErrorAuth QTApiErrorKind = "auth"
+	// Questrade answered 429, or the rate limit budget left is kept for more
+	// important calls
+	QTApiErrorRateLimited = "rateLimited"
+	// Network errors & Questrade server errors, the same call can work later
+	QTApiErrorTransient = "transient"
+	// Order rejected by Questrade
+	QTApiErrorRejected = "rejected"
+	// Invalid request, or a response that doesn't decode, making it again
+	// won't help
+	QTApiErrorValidation = "validation"
+)
+
+type QTApiError struct {
+	Kind QTApiErrorKind
+	// HTTP status code, 0 when there was no response
+	StatusCode int
+	// Questrade's error code & message, when it sent one
+	Code    int
+	Message string
+}
+
+func (e *QTApiError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("qt_api: %s error: %s", e.Kind, e.Message)
+	}
+	return fmt.Sprintf("qt_api: %s error (%d, code %d): %s", e.Kind, e.StatusCode, e.Code, e.Message)
+}
+
+// Whether making the same request again a bit later can work: network &
+// server errors, and 429s as they're about the per second limit
+func (e *QTApiError) Retryable() bool {
+	return e.Kind == QTApiErrorTransient || (e.Kind == QTApiErrorRateLimited && e.StatusCode == http.StatusTooManyRequests)
+}
+
+// Error of a non 200 response from Questrade
+func newQTApiStatusError(statusCode int, body []byte) *QTApiError {
+	e := &QTApiError{StatusCode: statusCode, Message: string(body)}
+	response := struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}{}
+	if err := json.Unmarshal(body, &response); err == nil && response.Message != "" {
+		e.Code, e.Message = response.Code, response.Message
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(statusCode)
+	}
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		e.Kind = QTApiErrorAuth
+	case statusCode == http.StatusTooManyRequests:
+		e.Kind = QTApiErrorRateLimited
+	case statusCode >= 500:
+		e.Kind = QTApiErrorTransient
+	default:
+		e.Kind = QTApiErrorValidation
+	}
+	return e
+}
+
+// Whether err is a QTApi error of one of kinds
+func isQTApiError(err error, kinds ...QTApiErrorKind) bool {
+	var apiErr *QTApiError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	for _, kind := range kinds {
+		if apiErr.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
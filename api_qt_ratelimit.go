@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Questrade limits account & market data calls separately
+type QTApiCategory string
+
+const (
+	QTApiCategoryAccount    QTApiCategory = "account"
+	QTApiCategoryMarketData               = "marketData"
+)
+
+type QTApiPriority int
+
+const (
+	// Account fetches & quotes
+	QTApiPriorityNormal QTApiPriority = iota
+	// Placing & cancelling orders, goes through until nothing is left
+	QTApiPriorityCritical
+	// Candles & symbol details, refused first when the budget gets low
+	QTApiPriorityLow
+)
+
+// Share of the hourly budget kept for more important requests, requests get
+// refused once it's all that's left
+var qtApiReservePercents = map[QTApiPriority]float64{
+	QTApiPriorityLow:      20,
+	QTApiPriorityNormal:   5,
+	QTApiPriorityCritical: 0,
+}
+
+// Longest critical requests wait for an exhausted budget to reset
+const qtApiMaxWait = 5 * time.Second
+
+// Shared by every QTApi, Questrade's limits are for the whole account
+var qtApiRateLimiter = NewQTApiRateLimiter()
+
+// Budget of a category of calls, as last reported by Questrade's
+// X-RateLimit-Remaining & X-RateLimit-Reset headers
+type QTApiBudget struct {
+	Category  QTApiCategory `json:"category"`
+	PerSecond int           `json:"perSecond"`
+	PerHour   int           `json:"perHour"`
+	Remaining int           `json:"remaining"`
+	// Zero until Questrade reported it
+	Reset time.Time `json:"reset"`
+	// Requests refused to keep the rest of the budget, and delayed to stay
+	// under the per second limit or wait for the budget to reset
+	Refused   int `json:"refused"`
+	Throttled int `json:"throttled"`
+	// Times of the requests of the last second
+	recent []time.Time
+}
+
+type QTApiRateLimiter struct {
+	budgets map[QTApiCategory]*QTApiBudget
+	m       sync.Mutex
+}
+
+func NewQTApiRateLimiter() *QTApiRateLimiter {
+	return &QTApiRateLimiter{
+		budgets: map[QTApiCategory]*QTApiBudget{
+			QTApiCategoryAccount: {
+				Category: QTApiCategoryAccount, PerSecond: 30, PerHour: 30000, Remaining: 30000,
+			},
+			QTApiCategoryMarketData: {
+				Category: QTApiCategoryMarketData, PerSecond: 20, PerHour: 15000, Remaining: 15000,
+			},
+		},
+	}
+}
+
+func qtApiCategory(path string) QTApiCategory {
+	if strings.HasPrefix(path, "v1/accounts") {
+		return QTApiCategoryAccount
+	}
+	return QTApiCategoryMarketData
+}
+
+// Waits until a request of priority can be made without going over the
+// limits of category, or refuses it when its share of the budget is used up
+func (l *QTApiRateLimiter) Acquire(category QTApiCategory, priority QTApiPriority) error {
+	for {
+		l.m.Lock()
+		wait, err := l.reserve(l.budgets[category], priority, time.Now())
+		l.m.Unlock()
+		if err != nil || wait == 0 {
+			return err
+		}
+		time.Sleep(wait)
+	}
+}
+
+// Counts the request against budget when it can be made now, otherwise
+// returns how long to wait before trying again
+func (l *QTApiRateLimiter) reserve(budget *QTApiBudget, priority QTApiPriority, now time.Time) (time.Duration, error) {
+	if !budget.Reset.IsZero() && !now.Before(budget.Reset) {
+		budget.Remaining = budget.PerHour
+		budget.Reset = time.Time{}
+	}
+	// Budgets only get enforced once Questrade said when they reset, as
+	// refused requests don't get the headers that would update them
+	reserve := int(float64(budget.PerHour) * qtApiReservePercents[priority] / 100)
+	if budget.Remaining <= reserve && !budget.Reset.IsZero() {
+		untilReset := budget.Reset.Sub(now)
+		if priority != QTApiPriorityCritical || untilReset > qtApiMaxWait {
+			budget.Refused++
+			return 0, &QTApiError{Kind: QTApiErrorRateLimited, Message: fmt.Sprintf(
+				"%s budget low (%d left until %s), refusing request",
+				budget.Category, budget.Remaining, budget.Reset.Format(dateTimeFormat),
+			)}
+		}
+		budget.Throttled++
+		return untilReset, nil
+	}
+
+	recent := budget.recent[:0]
+	for _, t := range budget.recent {
+		if now.Sub(t) < time.Second {
+			recent = append(recent, t)
+		}
+	}
+	budget.recent = recent
+	if len(recent) >= budget.PerSecond {
+		budget.Throttled++
+		return recent[0].Add(time.Second).Sub(now), nil
+	}
+
+	budget.recent = append(budget.recent, now)
+	budget.Remaining--
+	return 0, nil
+}
+
+// Updates the budget of category with the headers of resp
+func (l *QTApiRateLimiter) Update(category QTApiCategory, resp *http.Response) {
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		remaining = -1
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		reset = 0
+	}
+	// 429s also come from the per second limit, the hourly budget is only
+	// used up when they don't say what's left of it
+	if resp.StatusCode == http.StatusTooManyRequests && remaining < 0 {
+		remaining = 0
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+	budget := l.budgets[category]
+	if remaining >= 0 {
+		budget.Remaining = remaining
+	}
+	if reset > 0 {
+		budget.Reset = time.Unix(reset, 0)
+	}
+}
+
+func (l *QTApiRateLimiter) Budgets() []*QTApiBudget {
+	l.m.Lock()
+	defer l.m.Unlock()
+	budgets := []*QTApiBudget{}
+	for _, category := range []QTApiCategory{QTApiCategoryAccount, QTApiCategoryMarketData} {
+		budget := *l.budgets[category]
+		budget.recent = nil
+		budgets = append(budgets, &budget)
+	}
+	return budgets
+}
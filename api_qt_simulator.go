@@ -0,0 +1,505 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Error codes in the {code, message} bodies the simulator answers errors with
+const (
+	qtSimulatorCodeInternal        = 1000
+	qtSimulatorCodeInvalidArgument = 1002
+	qtSimulatorCodeNotFound        = 1004
+	qtSimulatorCodeRateLimited     = 1006
+	qtSimulatorCodeInvalidToken    = 1017
+)
+
+// In-process fake of the parts of the Questrade API we use, to run QTApi,
+// QTBroker & QTDatasource end to end without credentials or an account.
+// Market data comes from the candle files PaperDatasource reads and the
+// account is a PaperBroker, both at the simulator's clock which only moves
+// with SetNow (the simulator is their TradingManager).
+type QTSimulator struct {
+	AccountId  string
+	server     *httptest.Server
+	now        time.Time
+	datasource *PaperDatasource
+	broker     *PaperBroker
+	// Current OAuth tokens, both change every refresh
+	accessToken  string
+	refreshToken string
+	// Cash when the current day started
+	startOfDayCash float64
+	// Requests made in the current hour, by category
+	perHour  map[QTApiCategory]int
+	used     map[QTApiCategory]int
+	usedHour time.Time
+	// Next failCount requests get answered failStatus
+	failCount  int
+	failStatus int
+	// Rate limiter of the QTApis talking to the simulator, apart from the one
+	// of the real API
+	limiter *QTApiRateLimiter
+	m       sync.Mutex
+}
+
+func NewQTSimulator(now time.Time, cash float64, logger Logger) *QTSimulator {
+	s := &QTSimulator{
+		AccountId:      "10000001",
+		now:            now,
+		accessToken:    newQTSimulatorToken(),
+		refreshToken:   newQTSimulatorToken(),
+		startOfDayCash: cash,
+		perHour:        map[QTApiCategory]int{},
+		used:           map[QTApiCategory]int{},
+		limiter:        NewQTApiRateLimiter(),
+	}
+	for category, budget := range s.limiter.budgets {
+		s.perHour[category] = budget.PerHour
+	}
+	s.datasource = NewPaperDatasource(s, logger)
+	s.broker = NewPaperBroker(s, logger)
+	s.broker.cash = cash
+	s.server = httptest.NewServer(s)
+	return s
+}
+
+func newQTSimulatorToken() string {
+	return fmt.Sprintf("%016x", rand.Int63())
+}
+
+func (s *QTSimulator) Close() {
+	s.server.Close()
+}
+
+// QTApi talking to the simulator, its credentials don't get saved
+func (s *QTSimulator) Api() *QTApi {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return &QTApi{
+		Credentials: &QTApiCredentials{
+			AccessToken:  s.accessToken,
+			RefreshToken: s.refreshToken,
+			ApiServer:    s.server.URL + "/",
+		},
+		loginUrl: s.server.URL + "/oauth2/token",
+		limiter:  s.limiter,
+	}
+}
+
+func (s *QTSimulator) NewBroker(tradingManager TradingManager, logger Logger) *QTBroker {
+	return newQTBroker(tradingManager, logger, s.Api(), s.AccountId)
+}
+
+func (s *QTSimulator) NewDatasource(logger Logger) *QTDatasource {
+	return newQTDatasource(logger, s.Api())
+}
+
+// Moves the clock to now, filling the limit & stop orders hit by the candles
+// closed in between
+func (s *QTSimulator) SetNow(now time.Time) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if now.Format(dateFormat) != s.now.Format(dateFormat) {
+		s.startOfDayCash = s.broker.cash
+	}
+	s.now = now
+	return s.broker.CheckLimitAndStopOrders()
+}
+
+// Makes the access token invalid, the next request has to refresh it
+func (s *QTSimulator) ExpireAccessToken() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.accessToken = newQTSimulatorToken()
+}
+
+// Answers the next count requests (other than token refreshes) with status
+func (s *QTSimulator) FailRequests(count, status int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.failCount, s.failStatus = count, status
+}
+
+// TradingManager of the simulator's PaperBroker & PaperDatasource, they only
+// call it while the simulator is locked
+func (s *QTSimulator) Now() time.Time {
+	return s.now
+}
+
+func (s *QTSimulator) State() TradingManagerState {
+	return TradingManagerStateRunning
+}
+
+func (s *QTSimulator) Environment() TradingManagerEnvironment {
+	return TradingManagerEnvironmentPaper
+}
+
+func (s *QTSimulator) Broker() Broker {
+	return s.broker
+}
+
+func (s *QTSimulator) Datasource() Datasource {
+	return s.datasource
+}
+
+func (s *QTSimulator) WaitForState(states ...TradingManagerState) {}
+
+func (s *QTSimulator) Start() error {
+	return nil
+}
+
+func (s *QTSimulator) Stop() {}
+
+func (s *QTSimulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path == "oauth2/token" {
+		s.refreshTokens(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+s.accessToken {
+		writeQTSimulatorError(w, &QTApiError{
+			StatusCode: http.StatusUnauthorized, Code: qtSimulatorCodeInvalidToken, Message: "Access token is invalid",
+		})
+		return
+	}
+	if err := s.countRequest(w, qtApiCategory(path)); err != nil {
+		writeQTSimulatorError(w, err)
+		return
+	}
+	if s.failCount > 0 {
+		s.failCount--
+		writeQTSimulatorError(w, &QTApiError{
+			StatusCode: s.failStatus, Code: qtSimulatorCodeInternal, Message: http.StatusText(s.failStatus),
+		})
+		return
+	}
+
+	response, err := s.route(r, strings.Split(path, "/"))
+	if err != nil {
+		writeQTSimulatorError(w, err)
+		return
+	}
+	renderJson(w, response)
+}
+
+func writeQTSimulatorError(w http.ResponseWriter, err *QTApiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.StatusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{"code": err.Code, "message": err.Message})
+}
+
+func qtSimulatorInvalid(message string) *QTApiError {
+	return &QTApiError{StatusCode: http.StatusBadRequest, Code: qtSimulatorCodeInvalidArgument, Message: message}
+}
+
+func (s *QTSimulator) refreshTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil ||
+		r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != s.refreshToken {
+		writeQTSimulatorError(w, qtSimulatorInvalid("Invalid refresh token"))
+		return
+	}
+	s.accessToken, s.refreshToken = newQTSimulatorToken(), newQTSimulatorToken()
+	renderJson(w, map[string]interface{}{
+		"access_token":  s.accessToken,
+		"refresh_token": s.refreshToken,
+		"api_server":    s.server.URL + "/",
+		"token_type":    "Bearer",
+		"expires_in":    1800,
+	})
+}
+
+// Counts the request against the hourly limit of its category and reports
+// what's left in the X-RateLimit headers, like Questrade
+func (s *QTSimulator) countRequest(w http.ResponseWriter, category QTApiCategory) *QTApiError {
+	hour := time.Now().Truncate(time.Hour)
+	if !hour.Equal(s.usedHour) {
+		s.used = map[QTApiCategory]int{}
+		s.usedHour = hour
+	}
+	reset := strconv.FormatInt(hour.Add(time.Hour).Unix(), 10)
+	w.Header().Set("X-RateLimit-Reset", reset)
+	if s.used[category] >= s.perHour[category] {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		return &QTApiError{
+			StatusCode: http.StatusTooManyRequests, Code: qtSimulatorCodeRateLimited, Message: "Too many requests",
+		}
+	}
+	s.used[category]++
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(s.perHour[category]-s.used[category]))
+	return nil
+}
+
+func (s *QTSimulator) route(r *http.Request, parts []string) (interface{}, *QTApiError) {
+	notFound := &QTApiError{
+		StatusCode: http.StatusNotFound, Code: qtSimulatorCodeNotFound, Message: "Not found: " + r.URL.Path,
+	}
+	if len(parts) < 2 || parts[0] != "v1" {
+		return nil, notFound
+	}
+	get := r.Method == http.MethodGet
+	switch {
+	case len(parts) == 2 && parts[1] == "symbols" && get:
+		return s.symbols(r)
+	case len(parts) == 3 && parts[1] == "markets" && parts[2] == "quotes" && get:
+		return s.quotes(r)
+	case len(parts) == 4 && parts[1] == "markets" && parts[2] == "candles" && get:
+		return s.candles(r, parts[3])
+	case len(parts) < 4 || parts[1] != "accounts":
+		return nil, notFound
+	case parts[2] != s.AccountId:
+		return nil, &QTApiError{
+			StatusCode: http.StatusNotFound, Code: qtSimulatorCodeNotFound, Message: "Unknown account: " + parts[2],
+		}
+	case len(parts) == 4 && parts[3] == "balances" && get:
+		return s.balances()
+	case len(parts) == 4 && parts[3] == "positions" && get:
+		positions, _ := s.broker.Positions()
+		return QTApiPositionsResponse{Positions: positions}, nil
+	case len(parts) == 4 && parts[3] == "executions" && get:
+		return QTApiExecutionsResponse{Executions: s.broker.executions}, nil
+	case len(parts) == 4 && parts[3] == "orders" && get:
+		return QTApiOrdersResponse{Orders: s.broker.orders}, nil
+	case len(parts) == 5 && parts[3] == "orders" && get:
+		return s.order(parts[4])
+	case len(parts) == 4 && parts[3] == "orders" && r.Method == http.MethodPost:
+		return s.createOrder(r)
+	case len(parts) == 5 && parts[3] == "orders" && r.Method == http.MethodPost:
+		return s.replaceOrder(r, parts[4])
+	case len(parts) == 5 && parts[3] == "orders" && r.Method == http.MethodDelete:
+		return s.cancelOrder(parts[4])
+	}
+	return nil, notFound
+}
+
+func (s *QTSimulator) symbols(r *http.Request) (interface{}, *QTApiError) {
+	response := QTApiDetailsResponse{Symbols: []*SymbolDetails{}}
+	if names := r.URL.Query().Get("names"); names != "" {
+		for _, name := range strings.Split(names, ",") {
+			if details := findSymbolDetailsByName(name); details != nil {
+				response.Symbols = append(response.Symbols, details)
+			}
+		}
+	}
+	if ids := r.URL.Query().Get("ids"); ids != "" {
+		for _, id := range strings.Split(ids, ",") {
+			symId, err := strconv.Atoi(id)
+			if err != nil {
+				return nil, qtSimulatorInvalid("Invalid symbol id: " + id)
+			}
+			if details := findSymbolDetailsById(symId); details != nil {
+				response.Symbols = append(response.Symbols, details)
+			}
+		}
+	}
+	return response, nil
+}
+
+func (s *QTSimulator) quotes(r *http.Request) (interface{}, *QTApiError) {
+	response := QTApiQuoteResponse{Quotes: []*SymbolQuote{}}
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		symId, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, qtSimulatorInvalid("Invalid symbol id: " + id)
+		}
+		quote, err := s.datasource.Quote(symId)
+		if err != nil {
+			return nil, qtSimulatorInvalid(err.Error())
+		}
+		response.Quotes = append(response.Quotes, quote)
+	}
+	return response, nil
+}
+
+// Candles up to the simulator's clock, there's no peeking at the next ones
+func (s *QTSimulator) candles(r *http.Request, id string) (interface{}, *QTApiError) {
+	symId, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, qtSimulatorInvalid("Invalid symbol id: " + id)
+	}
+	query := r.URL.Query()
+	start, err := time.Parse(qtDateTimeFormat, query.Get("startTime"))
+	if err != nil {
+		return nil, qtSimulatorInvalid("Invalid startTime: " + query.Get("startTime"))
+	}
+	end, err := time.Parse(qtDateTimeFormat, query.Get("endTime"))
+	if err != nil {
+		return nil, qtSimulatorInvalid("Invalid endTime: " + query.Get("endTime"))
+	}
+	if end.After(s.now) {
+		end = s.now
+	}
+	candles, err := s.datasource.Candles(symId, start, end, CandleInterval(query.Get("interval")))
+	if err != nil {
+		return nil, qtSimulatorInvalid(err.Error())
+	}
+	return QTApiCandlesResponse{Candles: candles}, nil
+}
+
+func (s *QTSimulator) balances() (interface{}, *QTApiError) {
+	balance, err := s.broker.Balance()
+	if err != nil {
+		return nil, &QTApiError{StatusCode: http.StatusInternalServerError, Code: qtSimulatorCodeInternal, Message: err.Error()}
+	}
+	sod := &BrokerBalance{Currency: "USD", Cash: s.startOfDayCash}
+	return QTApiBalancesResponse{
+		PerCurrencyBalances:    []*BrokerBalance{balance},
+		CombinedBalances:       []*BrokerBalance{balance},
+		SodPerCurrencyBalances: []*BrokerBalance{sod},
+		SodCombinedBalances:    []*BrokerBalance{sod},
+	}, nil
+}
+
+// Body of order creations & replacements
+type qtSimulatorOrderRequest struct {
+	SymbolId   int         `json:"symbolId"`
+	Quantity   int64       `json:"quantity"`
+	Action     OrderAction `json:"action"`
+	OrderType  OrderType   `json:"orderType"`
+	LimitPrice float64     `json:"limitPrice"`
+	StopPrice  float64     `json:"stopPrice"`
+}
+
+func readQTSimulatorOrderRequest(r *http.Request) (*qtSimulatorOrderRequest, float64, *QTApiError) {
+	request := &qtSimulatorOrderRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		return nil, 0, qtSimulatorInvalid("Invalid order: " + err.Error())
+	}
+	if request.Quantity <= 0 {
+		return nil, 0, qtSimulatorInvalid("Order quantity must be positive")
+	}
+	if request.Action != OrderActionBuy && request.Action != OrderActionSell {
+		return nil, 0, qtSimulatorInvalid("Unknown order action: " + string(request.Action))
+	}
+	switch request.OrderType {
+	case OrderTypeMarket:
+		return request, 0, nil
+	case OrderTypeLimit:
+		return request, request.LimitPrice, nil
+	case OrderTypeStop:
+		return request, request.StopPrice, nil
+	}
+	return nil, 0, qtSimulatorInvalid("Unsupported order type: " + string(request.OrderType))
+}
+
+// Orders the PaperBroker rejects are answered like Questrade does, with the
+// order in the Rejected state
+func (s *QTSimulator) createOrder(r *http.Request) (interface{}, *QTApiError) {
+	request, price, apiErr := readQTSimulatorOrderRequest(r)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	count := len(s.broker.orders)
+	order, err := s.broker.CreateOrder(request.SymbolId, request.Action, request.OrderType, price, request.Quantity)
+	if err != nil {
+		if len(s.broker.orders) > count {
+			if last := s.broker.orders[len(s.broker.orders)-1]; last.State == OrderStateRejected {
+				return QTApiOrdersResponse{Orders: []*BrokerOrder{last}}, nil
+			}
+		}
+		return nil, qtSimulatorInvalid(err.Error())
+	}
+	return QTApiOrdersResponse{Orders: []*BrokerOrder{order}}, nil
+}
+
+func (s *QTSimulator) order(id string) (interface{}, *QTApiError) {
+	orderId, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, qtSimulatorInvalid("Invalid order id: " + id)
+	}
+	for _, o := range s.broker.orders {
+		if o.Id == orderId {
+			return QTApiOrdersResponse{Orders: []*BrokerOrder{o}}, nil
+		}
+	}
+	return nil, &QTApiError{
+		StatusCode: http.StatusNotFound, Code: qtSimulatorCodeNotFound, Message: "Unknown order: " + id,
+	}
+}
+
+// Answers with the order replaced and the one replacing it, like Questrade
+func (s *QTSimulator) replaceOrder(r *http.Request, id string) (interface{}, *QTApiError) {
+	orderId, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, qtSimulatorInvalid("Invalid order id: " + id)
+	}
+	request, price, apiErr := readQTSimulatorOrderRequest(r)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	replacement, err := s.broker.ReplaceOrder(orderId, price, request.Quantity)
+	if err != nil {
+		return nil, qtSimulatorInvalid(err.Error())
+	}
+	orders := []*BrokerOrder{}
+	for _, o := range s.broker.orders {
+		if o.Id == orderId {
+			orders = append(orders, o)
+		}
+	}
+	return QTApiOrdersResponse{Orders: append(orders, replacement)}, nil
+}
+
+func (s *QTSimulator) cancelOrder(id string) (interface{}, *QTApiError) {
+	orderId, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, qtSimulatorInvalid("Invalid order id: " + id)
+	}
+	if err := s.broker.CancelOrder(orderId); err != nil {
+		return nil, qtSimulatorInvalid(err.Error())
+	}
+	return map[string]int{"orderId": orderId}, nil
+}
+
+// Runs strategy over day in production, against a QTSimulator
+func runQTSimulation(strategy, config string, day time.Time, cash float64) (*TradingManagerV1, error) {
+	y, m, d := day.Date()
+	start := time.Date(y, m, d, 9, 0, 0, 0, timeLocation)
+	end := time.Date(y, m, d, 16, 30, 0, 0, timeLocation)
+	simulator := NewQTSimulator(start, cash, NewNullLogger())
+	defer simulator.Close()
+
+	tm, err := NewQTSimulationTradingManager(simulator, strategy, config, start, end, NewConsoleLogger())
+	if err != nil {
+		return nil, err
+	}
+	if err := tm.Start(); err != nil {
+		return nil, err
+	}
+	tm.WaitForState(TradingManagerStateDone, TradingManagerStateFailed, TradingManagerStateStopped)
+	if tm.State() != TradingManagerStateDone {
+		return tm, errors.New("simulation ended in state " + string(tm.State()))
+	}
+	return tm, nil
+}
+
+func printQTSimulation(w io.Writer, tm *TradingManagerV1) {
+	metrics := tm.Metrics()
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "state\t%s\n", tm.State())
+	fmt.Fprintf(tw, "return\t%.2f (%.2f%%)\n", metrics.TotalReturn, metrics.TotalReturnPercent*100)
+	fmt.Fprintf(tw, "trades\t%d\n", metrics.TradeCount)
+	fmt.Fprintf(tw, "orders\t%d\n", len(tm.broker.LastOrders()))
+	fmt.Fprintf(tw, "equity\t%s\n", filepath.Join(runFolder(TradingManagerEnvironmentSimulation, tm.runId), "equity.jsonl"))
+	for _, budget := range tm.simulator.limiter.Budgets() {
+		fmt.Fprintf(
+			tw, "%s calls\t%d (%d throttled, %d refused)\n",
+			budget.Category, budget.PerHour-budget.Remaining, budget.Throttled, budget.Refused,
+		)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Writes a day of 1m & 5m candles of TEST, a slow sine around $100, to the
+// data folder of a temporary working directory and returns the day
+func writeTestCandleFiles(t *testing.T) time.Time {
+	t.Helper()
+	setupTestSymbols(t, &SymbolDetails{Symbol: "TEST", SymbolId: testSymbolId})
+	// Days loaded from other working directories aren't these
+	resetPaperCandleDays(t)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	day := time.Date(2017, 7, 20, 0, 0, 0, 0, timeLocation)
+	candles := []*SymbolCandle{}
+	price := 100.0
+	for i := 0; i < 390; i++ {
+		start := day.Add(9*time.Hour + 30*time.Minute + time.Duration(i)*time.Minute)
+		next := price + math.Sin(float64(i)/15)*0.3
+		candles = append(candles, &SymbolCandle{
+			Start:  start,
+			End:    start.Add(time.Minute),
+			Open:   price,
+			High:   math.Max(price, next) + 0.05,
+			Low:    math.Min(price, next) - 0.05,
+			Close:  next,
+			Volume: 10000,
+		})
+		price = next
+	}
+	fiveMinutes := []*SymbolCandle{}
+	for i := 0; i < len(candles); i += 5 {
+		c := *candles[i]
+		for _, next := range candles[i : i+5] {
+			c.High, c.Low, c.Close = math.Max(c.High, next.High), math.Min(c.Low, next.Low), next.Close
+		}
+		c.End = c.Start.Add(5 * time.Minute)
+		fiveMinutes = append(fiveMinutes, &c)
+	}
+	for folder, candles := range map[string][]*SymbolCandle{"1m-1d": candles, "5m-1d": fiveMinutes} {
+		path := filepath.Join("data", folder, "TEST", day.Format(dateFormat)+".json")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeJsonFile(path, candles); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return day
+}
+
+// Simulator with $25000 at 10:00 on the day of the test candles, without the
+// per second limits which would only slow tests down
+func newTestQTSimulator(t *testing.T) (*QTSimulator, time.Time) {
+	day := writeTestCandleFiles(t)
+	simulator := NewQTSimulator(day.Add(10*time.Hour), 25000, NewNullLogger())
+	t.Cleanup(simulator.Close)
+	for _, budget := range simulator.limiter.budgets {
+		budget.PerSecond = math.MaxInt32
+	}
+	return simulator, day
+}
+
+func runTestQTSimulation(t *testing.T, simulator *QTSimulator, start, end time.Time) *TradingManagerV1 {
+	t.Helper()
+	tm, err := NewQTSimulationTradingManager(
+		simulator, "long_ma", `{"symbolIds":[1]}`, start, end, NewNullLogger(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	tm.WaitForState(TradingManagerStateDone, TradingManagerStateFailed, TradingManagerStateStopped)
+	return tm
+}
+
+func TestQTSimulationRunsStrategy(t *testing.T) {
+	simulator, day := newTestQTSimulator(t)
+	tm := runTestQTSimulation(t, simulator, day.Add(9*time.Hour), day.Add(16*time.Hour+30*time.Minute))
+
+	if tm.State() != TradingManagerStateDone {
+		t.Fatalf("simulation ended %s, want done", tm.State())
+	}
+	if trades := tm.Metrics().TradeCount; trades == 0 {
+		t.Error("strategy didn't trade")
+	}
+	if got, want := len(tm.broker.LastOrders()), len(simulator.broker.LastOrders()); got != want {
+		t.Errorf("QTBroker saw %d orders, the simulator's account has %d", got, want)
+	}
+	positions, err := tm.broker.Positions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range positions {
+		if p.OpenQuantity != 0 {
+			t.Errorf("%d shares of %d left at the end of the day", p.OpenQuantity, p.SymbolId)
+		}
+	}
+
+	equity := filepath.Join(runFolder(TradingManagerEnvironmentSimulation, tm.runId), "equity.jsonl")
+	if _, err := os.Stat(equity); err != nil {
+		t.Errorf("no equity file: %s", err)
+	}
+	if _, err := os.Stat(runFolder(TradingManagerEnvironmentProduction, "")); !os.IsNotExist(err) {
+		t.Error("simulation wrote to the production folder")
+	}
+}
+
+// Failing to fetch positions fails the run, and failing to cancel & liquidate
+// while aborting ends it failed rather than exiting the process
+func TestQTSimulationFailureEndsFailed(t *testing.T) {
+	for _, length := range []time.Duration{time.Hour, time.Minute} {
+		simulator, day := newTestQTSimulator(t)
+		simulator.FailRequests(3, http.StatusBadRequest)
+		start := day.Add(9 * time.Hour)
+		tm := runTestQTSimulation(t, simulator, start, start.Add(length))
+		if tm.State() != TradingManagerStateFailed {
+			t.Errorf("%s simulation ended %s, want failed", length, tm.State())
+		}
+	}
+}
+
+func TestQTApiRefreshesExpiredToken(t *testing.T) {
+	simulator, _ := newTestQTSimulator(t)
+	api := simulator.Api()
+	broker := newQTBroker(nil, NewNullLogger(), api, simulator.AccountId)
+
+	for i := 0; i < 2; i++ {
+		token := api.Credentials.AccessToken
+		simulator.ExpireAccessToken()
+		if _, err := broker.Positions(); err != nil {
+			t.Fatalf("fetching after expiry %d: %s", i+1, err)
+		}
+		if api.Credentials.AccessToken == token {
+			t.Errorf("access token wasn't refreshed after expiry %d", i+1)
+		}
+	}
+
+	// Orders get sent again with the new token
+	simulator.ExpireAccessToken()
+	if _, err := broker.CreateOrder(testSymbolId, OrderActionBuy, OrderTypeMarket, 0, 10); err != nil {
+		t.Fatal(err)
+	}
+	if orders := simulator.broker.LastOrders(); len(orders) != 1 || orders[0].FilledQuantity != 10 {
+		t.Errorf("got %d orders, want the 10 shares bought", len(orders))
+	}
+}
+
+func TestQTApiRetries(t *testing.T) {
+	simulator, _ := newTestQTSimulator(t)
+	broker := simulator.NewBroker(nil, NewNullLogger())
+
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable} {
+		simulator.FailRequests(1, status)
+		if _, err := broker.Positions(); err != nil {
+			t.Errorf("GET failing once with %d wasn't retried: %s", status, err)
+		}
+	}
+
+	simulator.FailRequests(qtApiMaxRetries+1, http.StatusServiceUnavailable)
+	if _, err := broker.Positions(); !isQTApiError(err, QTApiErrorTransient) {
+		t.Errorf("GET failing every retry returned %v, want a transient error", err)
+	}
+
+	simulator.FailRequests(1, http.StatusServiceUnavailable)
+	if _, err := broker.CreateOrder(testSymbolId, OrderActionBuy, OrderTypeMarket, 0, 10); !isQTApiError(err, QTApiErrorTransient) {
+		t.Errorf("failed order returned %v, want a transient error", err)
+	}
+	if orders := simulator.broker.LastOrders(); len(orders) != 0 {
+		t.Errorf("order was retried, the account has %d orders", len(orders))
+	}
+}
+
+// Orders created since orders were last fetched can be replaced too
+func TestQTBrokerReplacesOrderNotFetchedYet(t *testing.T) {
+	simulator, _ := newTestQTSimulator(t)
+	broker := simulator.NewBroker(nil, NewNullLogger())
+
+	stop, err := broker.CreateOrder(testSymbolId, OrderActionSell, OrderTypeStop, 90, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacement, err := broker.ReplaceOrder(stop.Id, 95, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replacement.Id == stop.Id || replacement.StopPrice != 95 {
+		t.Errorf("got order #%d at %.2f, want a new order at 95.00", replacement.Id, replacement.StopPrice)
+	}
+	if _, err := broker.ReplaceOrder(1000, 95, 10); err == nil {
+		t.Error("replacing an unknown order worked")
+	}
+}
@@ -3,41 +3,159 @@ package main
 import (
 	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"strconv"
 	"time"
 )
 
+// Order in which prices are assumed to have been traded inside a candle when
+// checking limit & stop orders
+type FillPath string
+
+const (
+	// OHLC when short or flat, OLHC when long, stops get hit before targets
+	FillPathPessimistic FillPath = "pessimistic"
+	FillPathOHLC                 = "ohlc"
+	FillPathOLHC                 = "olhc"
+	// Only the close of every candle, ignores wicks & gaps
+	FillPathClose = "close"
+)
+
+// Simulation settings of a paper run
+type PaperBrokerConfig struct {
+	FillPath   FillPath         `json:"fillPath"`
+	Slippage   PaperModelConfig `json:"slippage"`
+	Commission PaperModelConfig `json:"commission"`
+	// Share of a candle's volume orders can fill in it, 0 doesn't cap fills
+	MaxVolumePercent float64 `json:"maxVolumePercent"`
+	// Yearly fee on the value of shares borrowed to sell short, charged for
+	// every day a short is held overnight, 0 doesn't charge any
+	BorrowRatePercent float64           `json:"borrowRatePercent"`
+	Margin            PaperMarginConfig `json:"margin"`
+}
+
+func (c *PaperBrokerConfig) validate() error {
+	switch c.FillPath {
+	case "":
+		c.FillPath = FillPathPessimistic
+	case FillPathPessimistic, FillPathOHLC, FillPathOLHC, FillPathClose:
+	default:
+		return errors.New("paper broker: unknown fill path: " + string(c.FillPath))
+	}
+	if c.Slippage.Name == "" {
+		c.Slippage.Name = "fixed_bps"
+	}
+	if c.Commission.Name == "" {
+		c.Commission.Name = "per_share"
+	}
+	if c.MaxVolumePercent < 0 || c.MaxVolumePercent > 100 {
+		return errors.New("paper broker: maxVolumePercent must be between 0 and 100")
+	}
+	if c.BorrowRatePercent < 0 {
+		return errors.New("paper broker: borrowRatePercent can't be negative")
+	}
+	return c.Margin.validate()
+}
+
 type PaperBroker struct {
 	tm         TradingManager
 	logger     Logger
+	config     PaperBrokerConfig
+	slippage   SlippageModel
+	commission CommissionModel
 	cash       float64
 	positions  []*BrokerPosition
 	executions []*BrokerExecution
 	orders     []*BrokerOrder
+	// Start of the last candle limit & stop orders were checked against
+	checkedUntil time.Time
+	// Stop orders that got hit but couldn't fill entirely yet
+	triggeredStops map[int]bool
+	// Day borrow fees were last charged on
+	borrowChargedOn time.Time
+	borrowFees      float64
+	marginCalls     int
+	// Every lot opened, FIFO
+	lots []*PaperLot
+	// Day the positions' ClosedPnL is for
+	pnlDay time.Time
+	// OCO groups by order id
+	ocoGroups map[int]*paperOCOGroup
+	// Trailing stops by order id
+	trailingStops map[int]*paperTrailingStop
+	// Orders being replaced by id
+	replacements map[int]*paperReplacement
+	// Records every change of state of orders when set
+	tracker *OrderTracker
+}
+
+type paperTrailingStop struct {
+	trail Trail
+	best  float64
+}
+
+// Order replacing another one, from the first candle starting after at
+type paperReplacement struct {
+	orderId  int
+	quantity int64
+	at       time.Time
+	// Shares the order being replaced filled since
+	filled int64
+}
+
+type paperOCOGroup struct {
+	remaining int64
+	orderIds  []int
 }
 
 func NewPaperBroker(tradingManager TradingManager, logger Logger) *PaperBroker {
-	return &PaperBroker{
+	b := &PaperBroker{
 		tm:         tradingManager,
 		logger:     logger,
 		cash:       25000,
 		positions:  []*BrokerPosition{},
 		executions: []*BrokerExecution{},
 		orders:     []*BrokerOrder{},
+		lots:       []*PaperLot{},
+
+		triggeredStops: map[int]bool{},
+		ocoGroups:      map[int]*paperOCOGroup{},
+		trailingStops:  map[int]*paperTrailingStop{},
+		replacements:   map[int]*paperReplacement{},
+	}
+	if err := b.Configure(PaperBrokerConfig{}); err != nil {
+		panic(err)
 	}
+	return b
+}
+
+func (b *PaperBroker) Configure(config PaperBrokerConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	slippage, err := newSlippageModel(config.Slippage)
+	if err != nil {
+		return err
+	}
+	commission, err := newCommissionModel(config.Commission)
+	if err != nil {
+		return err
+	}
+	b.config = config
+	b.slippage = slippage
+	b.commission = commission
+	return nil
 }
 
 func (b *PaperBroker) CreateOrder(
 	symId int, action OrderAction, typ OrderType, limitOrStopPrice float64, quantity int64,
 ) (*BrokerOrder, error) {
 	var err error
-	var execution *BrokerExecution = &BrokerExecution{}
 	symbolDetails := findSymbolDetailsById(symId)
 	if symbolDetails == nil {
 		return nil, errors.New(fmt.Sprintf("Can't find symbol details for id: %d", symId))
 	}
-
 	order := &BrokerOrder{
 		Id:               rand.Int(),
 		Symbol:           symbolDetails.Symbol,
@@ -45,18 +163,29 @@ func (b *PaperBroker) CreateOrder(
 		CreationTime:     b.tm.Now(),
 		UpdateTime:       b.tm.Now(),
 		TotalQuantity:    quantity,
-		OpenQuantity:     0,
-		FilledQuantity:   quantity,
+		OpenQuantity:     quantity,
+		FilledQuantity:   0,
 		CanceledQuantity: 0,
 		Side:             string(action),
 		Type:             typ,
 	}
+	if err := b.checkBuyingPower(symbolDetails, action, typ, limitOrStopPrice, quantity); err != nil {
+		rejected, ok := err.(*OrderRejectedError)
+		if !ok {
+			return nil, err
+		}
+		// Kept like Questrade keeps them, strategies see it in the orders
+		order.OpenQuantity = 0
+		b.setOrderState(order, OrderStateRejected)
+		b.orders = append(b.orders, order)
+		b.logger.LogWarn("broker", "reject_order,%d,%s", order.Id, err.Error())
+		rejected.Order = order
+		return nil, rejected
+	}
+	b.setOrderState(order, OrderStateAccepted)
 
 	// If this is not a market order, delay execution
 	if typ == OrderTypeLimit || typ == OrderTypeStop {
-		order.State = "Accepted"
-		order.OpenQuantity = order.TotalQuantity
-		order.FilledQuantity = 0
 		if typ == OrderTypeLimit {
 			order.LimitPrice = limitOrStopPrice
 		} else if typ == OrderTypeStop {
@@ -71,58 +200,194 @@ func (b *PaperBroker) CreateOrder(
 		return order, nil
 	}
 
-	order.AvgExecPrice, err = b.currentPrice(symId)
+	candle, err := b.lastCandle(symId)
 	if err != nil {
-		return nil, errors.New("CreateOrder: currentPrice returned an error: " + err.Error())
+		return nil, errors.New("CreateOrder: lastCandle returned an error: " + err.Error())
 	}
-	order.AvgExecPrice = order.AvgExecPrice * 1.00025 // add slippage
-
-	execution, err = b.CreateExecution(symbolDetails, order, order.AvgExecPrice)
+	// What the last candle's volume can't absorb fills over the next ones
+	filled := min64(order.OpenQuantity, b.volumeBudget(candle))
+	price, err := b.slip(order, candle.Close, filled, candle)
 	if err != nil {
 		return nil, err
 	}
 
+	var totalCost float64
+	if filled > 0 {
+		execution, err := b.CreateExecution(symbolDetails, order, price, filled)
+		if err != nil {
+			return nil, err
+		}
+		totalCost = execution.TotalCost
+	}
+
 	b.orders = append(b.orders, order)
 
 	b.logger.LogInfo(
 		"broker", "create_order,%d,%s,%s,%s,%d,%.2f,%.2f",
 		order.Id, order.Side, order.Type, order.Symbol,
-		order.TotalQuantity, order.AvgExecPrice, execution.TotalCost,
+		order.FilledQuantity, order.AvgExecPrice, totalCost,
 	)
 	return order, nil
 }
 
-func (b *PaperBroker) CreateExecution(symbolDetails *SymbolDetails, order *BrokerOrder, price float64) (*BrokerExecution, error) {
-	if order.State == "Executed" {
+// Stop order moved along the prices of the candles checked, as they get better
+// than best
+func (b *PaperBroker) CreateTrailingStop(
+	symId int, action OrderAction, trail Trail, best float64, quantity int64,
+) (*BrokerOrder, error) {
+	if err := trail.validate(); err != nil {
+		return nil, err
+	}
+	price, err := b.currentPrice(symId)
+	if err != nil {
+		return nil, errors.New("CreateTrailingStop: currentPrice returned an error: " + err.Error())
+	}
+	if best == 0 || trailImproves(action, best, price) {
+		best = price
+	}
+	order, err := b.CreateOrder(symId, action, OrderTypeStop, trail.stopPrice(action, best), quantity)
+	if err != nil {
+		return nil, err
+	}
+	b.trailingStops[order.Id] = &paperTrailingStop{trail: trail, best: best}
+	return order, nil
+}
+
+// Replaces orders like Questrade: the order goes to ReplacePending and a new
+// one gets created. The order keeps working on the candles up to now and the
+// new one takes over on the next ones, so that there's no candle where
+// neither works, then the order goes to Replaced. What the order fills in
+// between comes out of the new one.
+func (b *PaperBroker) ReplaceOrder(orderId int, limitOrStopPrice float64, quantity int64) (*BrokerOrder, error) {
+	var order *BrokerOrder
+	for _, o := range b.orders {
+		if o.Id == orderId {
+			order = o
+		}
+	}
+	if order == nil {
+		return nil, errors.New("ReplaceOrder: Can't find order #" + strconv.Itoa(orderId))
+	}
+	if order.Type != OrderTypeLimit && order.Type != OrderTypeStop {
+		return nil, errors.New("ReplaceOrder: Only limit & stop orders can be replaced")
+	}
+	if !order.IsPending() || order.State == OrderStateReplacePending {
+		return nil, errors.New("ReplaceOrder: Can't replace an order that executed or is already being replaced")
+	}
+	if b.triggeredStops[orderId] {
+		return nil, errors.New("ReplaceOrder: Can't replace a stop that got hit")
+	}
+	if quantity <= 0 {
+		return nil, errors.New("ReplaceOrder: quantity must be positive")
+	}
+
+	replacement, err := b.CreateOrder(order.SymbolId, OrderAction(order.Side), order.Type, limitOrStopPrice, quantity)
+	if err != nil {
+		return nil, err
+	}
+	b.replacements[orderId] = &paperReplacement{orderId: replacement.Id, quantity: quantity, at: b.tm.Now()}
+	if group, ok := b.ocoGroups[orderId]; ok {
+		group.orderIds = append(group.orderIds, replacement.Id)
+		b.ocoGroups[replacement.Id] = group
+	}
+	if ts, ok := b.trailingStops[orderId]; ok {
+		b.trailingStops[replacement.Id] = &paperTrailingStop{trail: ts.trail, best: ts.best}
+	}
+	order.UpdateTime = b.tm.Now()
+	b.setOrderState(order, OrderStateReplacePending)
+	b.logger.LogInfo("broker", "replace_order,%d,%d", orderId, replacement.Id)
+	return replacement, nil
+}
+
+// Takes the quantity an order being replaced filled out of the order
+// replacing it, cancelling it once nothing is left
+func (b *PaperBroker) fillReplaced(order *BrokerOrder, quantity int64) {
+	r, ok := b.replacements[order.Id]
+	if !ok {
+		return
+	}
+	r.filled += quantity
+	for _, o := range b.orders {
+		if o.Id != r.orderId || !o.IsPending() {
+			continue
+		}
+		open := r.quantity - r.filled - o.FilledQuantity
+		if open <= 0 {
+			b.CancelOrder(o.Id)
+		} else if o.OpenQuantity > open {
+			o.CanceledQuantity += o.OpenQuantity - open
+			o.OpenQuantity = open
+			o.UpdateTime = b.tm.Now()
+		}
+	}
+}
+
+// Orders being replaced go to Replaced once the candles they still worked on
+// are checked
+func (b *PaperBroker) finishReplacements(lastClosed time.Time) {
+	for _, o := range b.orders {
+		r, ok := b.replacements[o.Id]
+		if !ok || lastClosed.Before(r.at.Truncate(time.Minute)) {
+			continue
+		}
+		delete(b.replacements, o.Id)
+		if !o.IsPending() {
+			continue
+		}
+		o.OpenQuantity = 0
+		o.UpdateTime = b.tm.Now()
+		delete(b.triggeredStops, o.Id)
+		delete(b.trailingStops, o.Id)
+		b.setOrderState(o, OrderStateReplaced)
+	}
+}
+
+// Shares orders can fill in candle
+func (b *PaperBroker) volumeBudget(c *SymbolCandle) int64 {
+	if b.config.MaxVolumePercent == 0 {
+		return math.MaxInt64
+	}
+	return int64(float64(c.Volume) * b.config.MaxVolumePercent / 100)
+}
+
+// Fills quantity shares of order at price, the order stays Partial until all
+// of its shares are filled
+func (b *PaperBroker) CreateExecution(
+	symbolDetails *SymbolDetails, order *BrokerOrder, price float64, quantity int64,
+) (*BrokerExecution, error) {
+	if order.State == OrderStateExecuted {
 		return nil, errors.New("CreateExecution: Trying execute and already executed order. Order " + strconv.Itoa(order.Id))
 	}
+	if quantity <= 0 || quantity > order.OpenQuantity {
+		return nil, errors.New(fmt.Sprintf(
+			"CreateExecution: Can't fill %d shares of order %d, %d are open", quantity, order.Id, order.OpenQuantity,
+		))
+	}
 
 	action := OrderAction(order.Side)
-	order.State = "Executed"
-	order.OpenQuantity = 0
-	order.FilledQuantity = order.TotalQuantity
-	order.AvgExecPrice = price
+	order.AvgExecPrice = (order.AvgExecPrice*float64(order.FilledQuantity) + price*float64(quantity)) /
+		float64(order.FilledQuantity+quantity)
+	order.FilledQuantity += quantity
+	order.OpenQuantity -= quantity
+	order.UpdateTime = b.tm.Now()
+	if order.OpenQuantity == 0 {
+		b.setOrderState(order, OrderStateExecuted)
+	} else if order.State != OrderStateReplacePending {
+		b.setOrderState(order, OrderStatePartial)
+	}
 
 	execution := &BrokerExecution{
-		Id:         rand.Int(),
-		OrderId:    order.Id,
-		Timestamp:  b.tm.Now(),
-		Symbol:     symbolDetails.Symbol,
-		SymbolId:   symbolDetails.SymbolId,
-		Quantity:   order.TotalQuantity,
-		Side:       order.Side,
-		Price:      order.AvgExecPrice,
-		TotalCost:  order.AvgExecPrice * float64(order.TotalQuantity),
-		Commission: fmin(float64(order.TotalQuantity)*0.01, 6.95),
-	}
-	// TODO remove if not trading ETFs
-	if action == OrderActionBuy {
-		execution.Commission = 0
-	}
-	// Add SEC fees when creating market order
-	if order.Type == OrderTypeMarket {
-		execution.SecFee = execution.TotalCost * 0.0000231
+		Id:        rand.Int(),
+		OrderId:   order.Id,
+		Timestamp: b.tm.Now(),
+		Symbol:    symbolDetails.Symbol,
+		SymbolId:  symbolDetails.SymbolId,
+		Quantity:  quantity,
+		Side:      order.Side,
+		Price:     price,
+		TotalCost: price * float64(quantity),
 	}
+	b.commission.Charge(order, execution)
 	// Adjust cash
 	if action == OrderActionBuy {
 		b.cash -= execution.TotalCost
@@ -131,7 +396,7 @@ func (b *PaperBroker) CreateExecution(symbolDetails *SymbolDetails, order *Broke
 	} else {
 		return nil, errors.New(fmt.Sprintf("Can't process unknown order action: %s", action))
 	}
-	b.cash -= execution.Commission + execution.SecFee
+	b.cash -= execution.Commission + execution.SecFee + execution.ExecutionFee
 
 	// Update position
 	var position *BrokerPosition
@@ -148,22 +413,69 @@ func (b *PaperBroker) CreateExecution(symbolDetails *SymbolDetails, order *Broke
 		b.positions = append(b.positions, position)
 	}
 
-	position.AverageEntryPrice = order.AvgExecPrice
+	// Selling more than owned goes short, buying covers it
 	if action == OrderActionBuy {
-		position.OpenQuantity += order.TotalQuantity
-	} else if action == OrderActionSell {
-		if position.OpenQuantity-order.TotalQuantity < 0 {
-			return nil, errors.New("CreateExecution: Trying to sell more shares than owned. Order " + strconv.Itoa(order.Id))
-		}
-		position.OpenQuantity -= order.TotalQuantity
+		b.fillPosition(position, execution, quantity)
+	} else {
+		b.fillPosition(position, execution, -quantity)
 	}
 
 	b.executions = append(b.executions, execution)
+	b.fillOCO(order, quantity)
+	b.fillReplaced(order, quantity)
 
 	return execution, nil
 }
 
+func (b *PaperBroker) TrackOrders(tracker *OrderTracker) {
+	b.tracker = tracker
+}
+
+func (b *PaperBroker) setOrderState(order *BrokerOrder, state OrderState) {
+	order.State = state
+	if b.tracker != nil {
+		b.tracker.Track(order)
+	}
+}
+
+func (b *PaperBroker) LinkOrders(quantity int64, orderIds ...int) {
+	group := &paperOCOGroup{remaining: quantity, orderIds: orderIds}
+	for _, id := range orderIds {
+		b.ocoGroups[id] = group
+	}
+}
+
+// Takes the quantity order filled out of its OCO siblings, cancelling them
+// once nothing is left
+func (b *PaperBroker) fillOCO(order *BrokerOrder, quantity int64) {
+	group, ok := b.ocoGroups[order.Id]
+	if !ok {
+		return
+	}
+	group.remaining -= quantity
+	for _, o := range b.orders {
+		if o.Id == order.Id || b.ocoGroups[o.Id] != group || !o.IsPending() {
+			continue
+		}
+		if group.remaining <= 0 {
+			b.CancelOrder(o.Id)
+		} else if o.OpenQuantity > group.remaining {
+			o.CanceledQuantity += o.OpenQuantity - group.remaining
+			o.OpenQuantity = group.remaining
+			o.UpdateTime = b.tm.Now()
+		}
+	}
+}
+
 func (b *PaperBroker) currentPrice(symId int) (float64, error) {
+	candle, err := b.lastCandle(symId)
+	if err != nil {
+		return 0, err
+	}
+	return candle.Close, nil
+}
+
+func (b *PaperBroker) lastCandle(symId int) (*SymbolCandle, error) {
 	var err error
 	var candles []*SymbolCandle
 	var daysToGoBack = 3
@@ -173,69 +485,242 @@ func (b *PaperBroker) currentPrice(symId int) (float64, error) {
 		startDiff := time.Duration(-1*(7+(day*24))) * time.Hour
 		candles, err = b.tm.Datasource().Candles(symId, b.tm.Now().Add(startDiff), b.tm.Now(), CandleIntervalOneMinute)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 		day++
 	}
 
 	if len(candles) == 0 {
-		return 0, errors.New(fmt.Sprintf("currentPrice: 0 candles found for %d at %s", symId, b.tm.Now().Format("2006-01-02 15:04")))
+		return nil, errors.New(fmt.Sprintf("lastCandle: 0 candles found for %d at %s", symId, b.tm.Now().Format("2006-01-02 15:04")))
 	}
-	return candles[len(candles)-1].Close, nil
+	return candles[len(candles)-1], nil
 }
 
+// Moves price against the order filling quantity shares by the slippage
+// model's amount, limit orders fill at their price
+func (b *PaperBroker) slip(order *BrokerOrder, price float64, quantity int64, candle *SymbolCandle) (float64, error) {
+	if order.Type == OrderTypeLimit {
+		return price, nil
+	}
+	slippage, err := b.slippage.Slippage(&PaperFill{
+		Order:      order,
+		Price:      price,
+		Quantity:   quantity,
+		Candle:     candle,
+		Datasource: b.tm.Datasource(),
+	})
+	if err != nil {
+		return 0, errors.New("slippage: " + err.Error())
+	}
+	if OrderAction(order.Side) == OrderActionBuy {
+		return price + slippage, nil
+	}
+	return price - slippage, nil
+}
+
+// Walks every candle closed since the last check, in the configured fill
+// path order, and executes the limit & stop orders whose price got reached.
+// Market orders & hit stops that couldn't fill entirely fill what they can at
+// the open of the following candles. Positions then get liquidated if the
+// account is under its maintenance requirement.
 func (b *PaperBroker) CheckLimitAndStopOrders() error {
-	var execution *BrokerExecution
+	now := b.tm.Now()
+	if err := b.chargeBorrowFees(now); err != nil {
+		return err
+	}
+	lastClosed := now.Add(time.Second).Truncate(time.Minute).Add(-time.Minute)
+	y, m, d := now.Date()
+	from := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	if b.checkedUntil.After(from) {
+		from = b.checkedUntil
+	}
+	defer func() { b.checkedUntil = lastClosed }()
 
+	ordersBySymbol := map[int][]*BrokerOrder{}
+	symbolIds := []int{}
 	for _, o := range b.orders {
-		if o.State == "Accepted" {
-			symbolDetails := findSymbolDetailsById(o.SymbolId)
-			if symbolDetails == nil {
-				return errors.New(fmt.Sprintf("Can't find symbol details for id: %d", o.SymbolId))
-			}
-			currentPrice, err := b.currentPrice(o.SymbolId)
-			if err != nil {
-				return err
+		if !o.IsPending() {
+			continue
+		}
+		if _, ok := ordersBySymbol[o.SymbolId]; !ok {
+			symbolIds = append(symbolIds, o.SymbolId)
+		}
+		ordersBySymbol[o.SymbolId] = append(ordersBySymbol[o.SymbolId], o)
+	}
+
+	for _, symId := range symbolIds {
+		symbolDetails := findSymbolDetailsById(symId)
+		if symbolDetails == nil {
+			return errors.New(fmt.Sprintf("Can't find symbol details for id: %d", symId))
+		}
+		candles, err := b.tm.Datasource().Candles(symId, from, now, CandleIntervalOneMinute)
+		if err != nil {
+			return err
+		}
+		for _, c := range candles {
+			if c.Start.After(lastClosed) {
+				break
 			}
-			if o.Type == OrderTypeStop &&
-				OrderAction(o.Side) == OrderActionSell &&
-				currentPrice < o.StopPrice {
-				slippage := 0.01 + (o.StopPrice * 0.000025)
-				if execution, err = b.CreateExecution(symbolDetails, o, o.StopPrice-slippage); err != nil {
-					return err
+			budget := b.volumeBudget(c)
+			for i, price := range b.candlePath(symId, c) {
+				for _, o := range ordersBySymbol[symId] {
+					// Orders only see candles that started after they were placed,
+					// and before they got replaced
+					if !o.IsPending() || !c.Start.After(o.CreationTime.Truncate(time.Minute)) {
+						continue
+					}
+					if r, ok := b.replacements[o.Id]; ok && c.Start.After(r.at.Truncate(time.Minute)) {
+						continue
+					}
+					var fillPrice float64
+					if o.Type == OrderTypeMarket || b.triggeredStops[o.Id] {
+						if i != 0 {
+							continue
+						}
+						fillPrice = price
+					} else {
+						if ts, ok := b.trailingStops[o.Id]; ok && trailImproves(OrderAction(o.Side), ts.best, price) {
+							ts.best = price
+							o.StopPrice = ts.trail.stopPrice(OrderAction(o.Side), price)
+						}
+						var ok bool
+						if fillPrice, ok = paperFillPrice(o, price, i == 0 && b.config.FillPath != FillPathClose); !ok {
+							continue
+						}
+						if o.Type == OrderTypeStop {
+							b.triggeredStops[o.Id] = true
+						}
+					}
+					quantity := min64(o.OpenQuantity, budget)
+					if quantity == 0 {
+						continue
+					}
+					budget -= quantity
+					if fillPrice, err = b.slip(o, fillPrice, quantity, c); err != nil {
+						return err
+					}
+					execution, err := b.CreateExecution(symbolDetails, o, fillPrice, quantity)
+					if err != nil {
+						return err
+					}
+					if o.State == OrderStateExecuted {
+						delete(b.triggeredStops, o.Id)
+					}
+					b.logger.LogInfo(
+						"broker", "execution,%d,%s,%s,%s,%d,%.2f,%.2f",
+						o.Id, o.Side, o.Type, o.Symbol, quantity,
+						execution.Price, execution.TotalCost,
+					)
 				}
-				b.logger.LogInfo(
-					"broker", "execution,%d,%s,%s,%s,%d,%.2f,%.2f",
-					o.Id, o.Side, o.Type, o.Symbol, o.TotalQuantity,
-					o.AvgExecPrice, execution.TotalCost,
-				)
-			} else if o.Type == OrderTypeLimit &&
-				OrderAction(o.Side) == OrderActionSell &&
-				currentPrice > o.LimitPrice {
-				slippage := 0.01 + (o.StopPrice * 0.000025)
-				if execution, err = b.CreateExecution(symbolDetails, o, o.LimitPrice+slippage); err != nil {
-					return err
-				}
-				b.logger.LogInfo(
-					"broker", "execution,%d,%s,%s,%s,%d,%.2f,%.2f",
-					o.Id, o.Side, o.Type, o.Symbol, o.TotalQuantity,
-					o.AvgExecPrice, execution.TotalCost,
-				)
-			} else if OrderAction(o.Side) == OrderActionBuy {
-				panic("Buy|Limit and Buy|Stop orders are not yet supported.")
 			}
 		}
 	}
+	b.finishReplacements(lastClosed)
+	return b.checkMarginCall()
+}
+
+// Charges the borrow fees of the shorts held overnight on the first check of a
+// day, for every calendar day since the last charge (weekends included)
+func (b *PaperBroker) chargeBorrowFees(now time.Time) error {
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	if b.borrowChargedOn.IsZero() {
+		b.borrowChargedOn = today
+	}
+	days := int(fround(today.Sub(b.borrowChargedOn).Hours() / 24))
+	if days <= 0 {
+		return nil
+	}
+	b.borrowChargedOn = today
+	if b.config.BorrowRatePercent == 0 {
+		return nil
+	}
+
+	for _, p := range b.positions {
+		if p.OpenQuantity >= 0 {
+			continue
+		}
+		price, err := b.currentPrice(p.SymbolId)
+		if err != nil {
+			return errors.New("chargeBorrowFees: currentPrice returned an error: " + err.Error())
+		}
+		fee := float64(-p.OpenQuantity) * price * b.config.BorrowRatePercent / 100 / 360 * float64(days)
+		b.cash -= fee
+		b.borrowFees += fee
+		b.logger.LogInfo("broker", "borrow_fee,%s,%d,%d,%.2f", p.Symbol, p.OpenQuantity, days, fee)
+	}
 	return nil
 }
 
+func (b *PaperBroker) candlePath(symId int, c *SymbolCandle) []float64 {
+	path := b.config.FillPath
+	if path == FillPathPessimistic {
+		path = FillPathOHLC
+		for _, p := range b.positions {
+			if p.SymbolId == symId && p.OpenQuantity > 0 {
+				path = FillPathOLHC
+			}
+		}
+	}
+	switch path {
+	case FillPathOLHC:
+		return []float64{c.Open, c.Low, c.High, c.Close}
+	case FillPathClose:
+		return []float64{c.Close}
+	default:
+		return []float64{c.Open, c.High, c.Low, c.Close}
+	}
+}
+
+// Price at which o fills when the market trades at price, before slippage.
+// Stops trigger when touched, limits when traded through. Past the open
+// prices move continuously so fills happen at the order's price, but a gap
+// through it at the open fills at the open: worse for stops, better for
+// limits.
+func paperFillPrice(o *BrokerOrder, price float64, isOpen bool) (float64, bool) {
+	action := OrderAction(o.Side)
+	var orderPrice float64
+	switch {
+	case o.Type == OrderTypeStop && action == OrderActionSell && price <= o.StopPrice:
+		orderPrice = o.StopPrice
+	case o.Type == OrderTypeStop && action == OrderActionBuy && price >= o.StopPrice:
+		orderPrice = o.StopPrice
+	case o.Type == OrderTypeLimit && action == OrderActionSell && price > o.LimitPrice:
+		orderPrice = o.LimitPrice
+	case o.Type == OrderTypeLimit && action == OrderActionBuy && price < o.LimitPrice:
+		orderPrice = o.LimitPrice
+	default:
+		return 0, false
+	}
+	if isOpen {
+		return price, true
+	}
+	return orderPrice, true
+}
+
 func (b *PaperBroker) CancelOrder(orderId int) error {
 	for _, o := range b.orders {
 		if o.Id == orderId {
-			if o.State != "Accepted" {
+			if !o.IsPending() {
 				return errors.New("CancelOrder: Can't cancel an order that already executed")
 			}
-			o.State = "Canceled"
+			o.CanceledQuantity += o.OpenQuantity
+			o.OpenQuantity = 0
+			o.UpdateTime = b.tm.Now()
+			b.setOrderState(o, OrderStateCanceled)
+			delete(b.triggeredStops, o.Id)
+			delete(b.trailingStops, o.Id)
+			// Cancelling an order being replaced cancels what replaces it
+			if r, ok := b.replacements[o.Id]; ok {
+				delete(b.replacements, o.Id)
+				for _, replacement := range b.orders {
+					if replacement.Id == r.orderId && replacement.IsPending() {
+						if err := b.CancelOrder(replacement.Id); err != nil {
+							return err
+						}
+					}
+				}
+			}
 			b.logger.LogInfo(
 				"broker", "cancel,%d,%s,%s",
 				o.Id, o.Side, o.Type,
@@ -252,23 +737,26 @@ func (b *PaperBroker) Balance() (*BrokerBalance, error) {
 		marketValue += p.CurrentMarketValue
 	}
 
+	equity, _, maintenance := b.margin()
 	balance := &BrokerBalance{
-		Currency:    "USD",
-		Cash:        b.cash,
-		MarketValue: marketValue,
+		Currency:          "USD",
+		Cash:              b.cash,
+		MarketValue:       marketValue,
+		BuyingPower:       b.buyingPower(),
+		MaintenanceExcess: equity - maintenance,
 	}
 	return balance, nil
 }
 
 func (b *PaperBroker) Positions() ([]*BrokerPosition, error) {
 	var err error
+	b.rollPnLDay()
 	for _, p := range b.positions {
 		p.CurrentPrice, err = b.currentPrice(p.SymbolId)
 		if err != nil {
 			continue
 		}
 		p.CurrentMarketValue = float64(p.OpenQuantity) * p.CurrentPrice
-		p.ClosedPnL = 0
 		p.OpenPnL = p.CurrentMarketValue - (float64(p.OpenQuantity) * p.AverageEntryPrice)
 	}
 	return b.positions, nil
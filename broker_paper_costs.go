@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+)
+
+// A slippage or commission model picked by name, params not given keep the
+// model's defaults
+type PaperModelConfig struct {
+	Name   string             `json:"name"`
+	Params map[string]float64 `json:"params"`
+}
+
+// An order about to be filled by the PaperBroker
+type PaperFill struct {
+	Order *BrokerOrder
+	Price float64
+	// Shares filled, market & stop orders can fill over several candles
+	Quantity   int64
+	Candle     *SymbolCandle
+	Datasource Datasource
+}
+
+// Only market & stop orders slip, limit orders never fill past their limit
+type SlippageModel interface {
+	// Per share amount the fill price moves against the order, added to buys
+	// and subtracted from sells
+	Slippage(fill *PaperFill) (float64, error)
+}
+
+type CommissionModel interface {
+	// Sets the commission & fees of an execution of order, order's filled
+	// quantity already includes the execution's
+	Charge(order *BrokerOrder, execution *BrokerExecution)
+}
+
+// {name: {param: default}}
+var (
+	slippageModelParams = map[string]map[string]float64{
+		"fixed_bps": {"bps": 2.5},
+		"spread":    {"minSpread": 0.01},
+		"volume":    {"bps": 1, "impactBps": 50},
+	}
+	commissionModelParams = map[string]map[string]float64{
+		"per_share": {"perShare": 0.01, "min": 0, "max": 6.95, "freeBuys": 1},
+		"questrade": {"freeBuys": 1},
+	}
+)
+
+func newSlippageModel(config PaperModelConfig) (SlippageModel, error) {
+	params, err := modelParams("slippage", slippageModelParams, config)
+	if err != nil {
+		return nil, err
+	}
+	switch config.Name {
+	case "fixed_bps":
+		return &FixedBpsSlippage{Bps: params["bps"]}, nil
+	case "spread":
+		return &SpreadSlippage{MinSpread: params["minSpread"]}, nil
+	case "volume":
+		return &VolumeSlippage{Bps: params["bps"], ImpactBps: params["impactBps"]}, nil
+	}
+	panic("unreachable")
+}
+
+func newCommissionModel(config PaperModelConfig) (CommissionModel, error) {
+	params, err := modelParams("commission", commissionModelParams, config)
+	if err != nil {
+		return nil, err
+	}
+	switch config.Name {
+	case "per_share":
+		return &PerShareCommission{
+			PerShare: params["perShare"],
+			Min:      params["min"],
+			Max:      params["max"],
+			FreeBuys: params["freeBuys"] != 0,
+		}, nil
+	case "questrade":
+		return &QuestradeCommission{FreeBuys: params["freeBuys"] != 0}, nil
+	}
+	panic("unreachable")
+}
+
+// The model's default params overridden by the ones in config
+func modelParams(kind string, models map[string]map[string]float64, config PaperModelConfig) (map[string]float64, error) {
+	defaults, ok := models[config.Name]
+	if !ok {
+		names := []string{}
+		for name := range models {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, errors.New(
+			"paper broker: unknown " + kind + " model: " + config.Name + " (expected " + strings.Join(names, ", ") + ")",
+		)
+	}
+	params := map[string]float64{}
+	for name, value := range defaults {
+		params[name] = value
+	}
+	for name, value := range config.Params {
+		if _, ok := defaults[name]; !ok {
+			return nil, errors.New("paper broker: unknown " + kind + " model param: " + config.Name + "." + name)
+		}
+		params[name] = value
+	}
+	return params, nil
+}
+
+// A fixed percentage of the price, in basis points
+type FixedBpsSlippage struct {
+	Bps float64
+}
+
+func (m *FixedBpsSlippage) Slippage(fill *PaperFill) (float64, error) {
+	return fill.Price * m.Bps / 10000, nil
+}
+
+// Crossing half the quoted spread, buys fill at the ask and sells at the bid
+type SpreadSlippage struct {
+	MinSpread float64
+}
+
+func (m *SpreadSlippage) Slippage(fill *PaperFill) (float64, error) {
+	quote, err := fill.Datasource.Quote(fill.Order.SymbolId)
+	if err != nil {
+		return 0, err
+	}
+	return fmax(quote.AskPrice-quote.BidPrice, m.MinSpread) / 2, nil
+}
+
+// Grows with the square root of the share of the candle's volume the order
+// takes: Bps when tiny, Bps+ImpactBps when it's the whole candle
+type VolumeSlippage struct {
+	Bps       float64
+	ImpactBps float64
+}
+
+func (m *VolumeSlippage) Slippage(fill *PaperFill) (float64, error) {
+	participation := 1.0
+	if fill.Candle != nil && fill.Candle.Volume > 0 {
+		participation = fmin(float64(fill.Quantity)/float64(fill.Candle.Volume), 1)
+	}
+	return fill.Price * (m.Bps + m.ImpactBps*math.Sqrt(participation)) / 10000, nil
+}
+
+// Flat per share commission, capped
+type PerShareCommission struct {
+	PerShare float64
+	Min      float64
+	Max      float64
+	// Questrade doesn't charge commissions when buying ETFs
+	FreeBuys bool
+}
+
+func (m *PerShareCommission) Charge(order *BrokerOrder, execution *BrokerExecution) {
+	execution.Commission = orderCommissionDelta(order, execution, m.PerShare, m.Min, m.Max)
+	if m.FreeBuys && OrderAction(order.Side) == OrderActionBuy {
+		execution.Commission = 0
+	}
+	if OrderAction(order.Side) == OrderActionSell {
+		execution.SecFee = execution.TotalCost * 0.0000231
+	}
+}
+
+// Questrade's self-directed stock & ETF fee schedule:
+//   - 1 cent per share, min $4.95, max $9.95 (ETF buys are free)
+//   - ECN fee of $0.0035 per share on orders removing liquidity (market &
+//     stop orders), limit orders adding liquidity aren't charged
+//   - SEC fee of 0.00231% of the value of sells
+type QuestradeCommission struct {
+	FreeBuys bool
+}
+
+func (m *QuestradeCommission) Charge(order *BrokerOrder, execution *BrokerExecution) {
+	action := OrderAction(order.Side)
+	execution.Commission = orderCommissionDelta(order, execution, 0.01, 4.95, 9.95)
+	if m.FreeBuys && action == OrderActionBuy {
+		execution.Commission = 0
+	}
+	if order.Type != OrderTypeLimit {
+		execution.ExecutionFee = float64(execution.Quantity) * 0.0035
+	}
+	if action == OrderActionSell {
+		execution.SecFee = execution.TotalCost * 0.0000231
+	}
+}
+
+// Commissions are per order, partial fills of an order only pay what the
+// order's commission grew by
+func orderCommissionDelta(order *BrokerOrder, execution *BrokerExecution, perShare, min, max float64) float64 {
+	commission := func(quantity int64) float64 {
+		if quantity <= 0 {
+			return 0
+		}
+		return fmin(fmax(float64(quantity)*perShare, min), max)
+	}
+	return commission(order.FilledQuantity) - commission(order.FilledQuantity-execution.Quantity)
+}
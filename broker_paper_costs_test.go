@@ -0,0 +1,30 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Slippage of each part of an order filling over several candles goes by the
+// shares of that part
+func TestVolumeSlippageUsesFillQuantity(t *testing.T) {
+	m := &VolumeSlippage{Bps: 1, ImpactBps: 10}
+	order := &BrokerOrder{TotalQuantity: 100000}
+	candle := &SymbolCandle{Volume: 10000}
+
+	for _, tt := range []struct {
+		quantity int64
+		want     float64
+	}{
+		{100, 100 * (1 + 10*0.1) / 10000.0},
+		{10000, 100 * (1 + 10) / 10000.0},
+	} {
+		got, err := m.Slippage(&PaperFill{Order: order, Price: 100, Quantity: tt.quantity, Candle: candle})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%d shares slipped %.4f, want %.4f", tt.quantity, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import "time"
+
+// Shares opened by one execution, closed first-in first-out by the executions
+// reducing the position. Positions are valued at their average cost like
+// Questrade does, the P&L of a lot only adds up to the position's once the
+// position is flat.
+type PaperLot struct {
+	Symbol          string    `json:"symbol"`
+	SymbolId        int       `json:"symbolId"`
+	OpenExecutionId int       `json:"openExecutionId"`
+	OpenedAt        time.Time `json:"openedAt"`
+	OpenPrice       float64   `json:"openPrice"`
+	// Negative for shorts
+	Quantity     int64            `json:"quantity"`
+	OpenQuantity int64            `json:"openQuantity"`
+	Closes       []*PaperLotClose `json:"closes"`
+}
+
+type PaperLotClose struct {
+	ExecutionId int       `json:"executionId"`
+	ClosedAt    time.Time `json:"closedAt"`
+	Quantity    int64     `json:"quantity"`
+	Price       float64   `json:"price"`
+	PnL         float64   `json:"pnl"`
+}
+
+// Applies an execution of qty shares (negative for sells) to position: the
+// part reducing it realizes P&L against the average entry price & closes
+// lots, the rest moves the average entry price & opens a lot
+func (b *PaperBroker) fillPosition(position *BrokerPosition, execution *BrokerExecution, qty int64) {
+	b.rollPnLDay()
+
+	var closing int64
+	if position.OpenQuantity != 0 && sign(qty) != sign(position.OpenQuantity) {
+		closing = sign(qty) * min64(abs64(qty), abs64(position.OpenQuantity))
+	}
+	if closing != 0 {
+		position.ClosedPnL += float64(-closing) * (execution.Price - position.AverageEntryPrice)
+		position.OpenQuantity += closing
+		b.closeLots(position.SymbolId, execution, closing)
+	}
+	if position.OpenQuantity == 0 {
+		position.AverageEntryPrice = 0
+	}
+
+	opening := qty - closing
+	if opening == 0 {
+		return
+	}
+	position.AverageEntryPrice = (position.AverageEntryPrice*float64(abs64(position.OpenQuantity)) +
+		execution.Price*float64(abs64(opening))) / float64(abs64(position.OpenQuantity+opening))
+	position.OpenQuantity += opening
+	b.lots = append(b.lots, &PaperLot{
+		Symbol:          position.Symbol,
+		SymbolId:        position.SymbolId,
+		OpenExecutionId: execution.Id,
+		OpenedAt:        execution.Timestamp,
+		OpenPrice:       execution.Price,
+		Quantity:        opening,
+		OpenQuantity:    opening,
+	})
+}
+
+// Closes qty shares (signed like the execution) of the oldest open lots
+func (b *PaperBroker) closeLots(symId int, execution *BrokerExecution, qty int64) {
+	for _, lot := range b.lots {
+		if qty == 0 {
+			return
+		}
+		if lot.SymbolId != symId || lot.OpenQuantity == 0 {
+			continue
+		}
+		closing := sign(qty) * min64(abs64(qty), abs64(lot.OpenQuantity))
+		lot.OpenQuantity += closing
+		lot.Closes = append(lot.Closes, &PaperLotClose{
+			ExecutionId: execution.Id,
+			ClosedAt:    execution.Timestamp,
+			Quantity:    abs64(closing),
+			Price:       execution.Price,
+			PnL:         float64(-closing) * (execution.Price - lot.OpenPrice),
+		})
+		qty -= closing
+	}
+}
+
+// Positions' ClosedPnL is what got realized on the current day, like
+// Questrade's, it goes back to 0 when the day changes
+func (b *PaperBroker) rollPnLDay() {
+	now := b.tm.Now()
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	if today.Equal(b.pnlDay) {
+		return
+	}
+	b.pnlDay = today
+	for _, p := range b.positions {
+		p.ClosedPnL = 0
+	}
+}
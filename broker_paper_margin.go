@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+type PaperAccountType string
+
+const (
+	PaperAccountTypeMargin PaperAccountType = "margin"
+	// Buys are paid in full with cash and short sales are rejected
+	PaperAccountTypeCash = "cash"
+)
+
+// Margin requirements of a paper account, as percentages of the value of
+// positions
+type PaperMarginConfig struct {
+	Account PaperAccountType `json:"account"`
+	// Needed to open a position, Reg T's 50% by default
+	InitialPercent float64 `json:"initialPercent"`
+	// Needed to keep positions open, FINRA's 25% of longs & 30% of shorts by
+	// default. Leveraged ETFs need these times their leverage, up to 100%.
+	MaintenancePercent      float64 `json:"maintenancePercent"`
+	ShortMaintenancePercent float64 `json:"shortMaintenancePercent"`
+	// Leverage of symbols by name, on top of leveragedETFs
+	Leverage map[string]float64 `json:"leverage"`
+}
+
+// Leverage of the commonly traded leveraged & inverse ETFs
+var leveragedETFs = map[string]float64{
+	"TQQQ": 3, "SQQQ": 3, "QLD": 2, "QID": 2,
+	"UPRO": 3, "SPXU": 3, "SPXL": 3, "SPXS": 3, "SSO": 2, "SDS": 2,
+	"UDOW": 3, "SDOW": 3, "TNA": 3, "TZA": 3,
+	"SOXL": 3, "SOXS": 3, "FAS": 3, "FAZ": 3, "LABU": 3, "LABD": 3,
+	"UVXY": 1.5,
+}
+
+func (c *PaperMarginConfig) validate() error {
+	switch c.Account {
+	case "":
+		c.Account = PaperAccountTypeMargin
+	case PaperAccountTypeMargin, PaperAccountTypeCash:
+	default:
+		return errors.New("paper broker: unknown account type: " + string(c.Account))
+	}
+	if c.InitialPercent == 0 {
+		c.InitialPercent = 50
+	}
+	if c.MaintenancePercent == 0 {
+		c.MaintenancePercent = 25
+	}
+	if c.ShortMaintenancePercent == 0 {
+		c.ShortMaintenancePercent = 30
+	}
+	for _, percent := range []float64{c.InitialPercent, c.MaintenancePercent, c.ShortMaintenancePercent} {
+		if percent < 0 || percent > 100 {
+			return errors.New("paper broker: margin percents must be between 0 and 100")
+		}
+	}
+	for symbol, leverage := range c.Leverage {
+		if leverage < 1 {
+			return errors.New("paper broker: leverage of " + symbol + " must be at least 1")
+		}
+	}
+	return nil
+}
+
+func (c *PaperMarginConfig) leverage(symbol string) float64 {
+	if leverage, ok := c.Leverage[symbol]; ok {
+		return leverage
+	}
+	if leverage, ok := leveragedETFs[symbol]; ok {
+		return leverage
+	}
+	return 1
+}
+
+// Initial or maintenance requirement of holding qty shares of symbol at price
+func (c *PaperMarginConfig) requirement(symbol string, qty int64, price float64, initial bool) float64 {
+	value := float64(abs64(qty)) * price
+	if c.Account == PaperAccountTypeCash {
+		return value
+	}
+	percent := c.MaintenancePercent
+	if qty < 0 {
+		percent = c.ShortMaintenancePercent
+	}
+	percent = math.Min(percent*c.leverage(symbol), 100)
+	if initial {
+		percent = math.Max(percent, c.InitialPercent)
+	}
+	return value * percent / 100
+}
+
+// Equity and the initial & maintenance requirements of the positions, valued
+// at their last known price
+func (b *PaperBroker) margin() (equity, initial, maintenance float64) {
+	equity = b.cash
+	for _, p := range b.positions {
+		equity += p.CurrentMarketValue
+		initial += b.config.Margin.requirement(p.Symbol, p.OpenQuantity, p.CurrentPrice, true)
+		maintenance += b.config.Margin.requirement(p.Symbol, p.OpenQuantity, p.CurrentPrice, false)
+	}
+	return equity, initial, maintenance
+}
+
+// What can be bought on top of the current positions without going under the
+// initial requirement
+func (b *PaperBroker) buyingPower() float64 {
+	equity, initial, _ := b.margin()
+	excess := math.Max(equity-initial, 0)
+	if b.config.Margin.Account == PaperAccountTypeCash {
+		return excess
+	}
+	return excess * 100 / b.config.Margin.InitialPercent
+}
+
+// Rejects orders that would raise the initial requirement past the account's
+// equity if filled entirely, priced at their limit or stop when they have one.
+// Orders reducing positions are always accepted.
+func (b *PaperBroker) checkBuyingPower(
+	symbolDetails *SymbolDetails, action OrderAction, typ OrderType, limitOrStopPrice float64, quantity int64,
+) error {
+	var position *BrokerPosition
+	for _, p := range b.positions {
+		if p.SymbolId == symbolDetails.SymbolId {
+			position = p
+		}
+	}
+	var positionQty int64
+	var positionPrice float64
+	if position != nil {
+		positionQty, positionPrice = position.OpenQuantity, position.CurrentPrice
+	}
+	qty := positionQty + quantity
+	if action == OrderActionSell {
+		qty = positionQty - quantity
+	}
+	if abs64(qty) <= abs64(positionQty) && sign(qty) != -sign(positionQty) {
+		return nil
+	}
+	if qty < 0 && b.config.Margin.Account == PaperAccountTypeCash {
+		return &OrderRejectedError{Message: "paper broker: order rejected: can't sell short in a cash account"}
+	}
+
+	price := limitOrStopPrice
+	if typ == OrderTypeMarket {
+		var err error
+		if price, err = b.currentPrice(symbolDetails.SymbolId); err != nil {
+			return errors.New("checkBuyingPower: currentPrice returned an error: " + err.Error())
+		}
+	}
+	margin := &b.config.Margin
+	equity, initial, _ := b.margin()
+	required := initial -
+		margin.requirement(symbolDetails.Symbol, positionQty, positionPrice, true) +
+		margin.requirement(symbolDetails.Symbol, qty, price, true)
+	if required > equity {
+		return &OrderRejectedError{Message: fmt.Sprintf(
+			"paper broker: order rejected: %s %d %s needs $%.2f of equity, $%.2f available",
+			action, quantity, symbolDetails.Symbol, required, equity,
+		)}
+	}
+	return nil
+}
+
+// Liquidates positions, the biggest requirements first, while the account's
+// equity is under their maintenance requirement
+func (b *PaperBroker) checkMarginCall() error {
+	if _, err := b.Positions(); err != nil {
+		return err
+	}
+	equity, _, maintenance := b.margin()
+	if equity >= maintenance {
+		return nil
+	}
+	b.marginCalls++
+	b.logger.LogWarn("broker", "margin_call,%.2f,%.2f", equity, maintenance)
+
+	positions := append([]*BrokerPosition{}, b.positions...)
+	sort.Slice(positions, func(i, j int) bool {
+		return b.config.Margin.requirement(positions[i].Symbol, positions[i].OpenQuantity, positions[i].CurrentPrice, false) >
+			b.config.Margin.requirement(positions[j].Symbol, positions[j].OpenQuantity, positions[j].CurrentPrice, false)
+	})
+	for _, p := range positions {
+		if equity >= maintenance {
+			break
+		}
+		if p.OpenQuantity == 0 {
+			continue
+		}
+		for _, o := range b.orders {
+			if o.SymbolId == p.SymbolId && o.IsPending() {
+				if err := b.CancelOrder(o.Id); err != nil {
+					return err
+				}
+			}
+		}
+		action := OrderActionBuy
+		if p.OpenQuantity > 0 {
+			action = OrderActionSell
+		}
+		if _, err := b.CreateOrder(p.SymbolId, action, OrderTypeMarket, 0, abs64(p.OpenQuantity)); err != nil {
+			return errors.New("margin call: " + err.Error())
+		}
+		if _, err := b.Positions(); err != nil {
+			return err
+		}
+		equity, _, maintenance = b.margin()
+	}
+	return nil
+}
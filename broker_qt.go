@@ -18,10 +18,14 @@ type QTBroker struct {
 }
 
 func NewQTBroker(tradingManager TradingManager, logger Logger, accountId string) *QTBroker {
+	return newQTBroker(tradingManager, logger, NewQTApi(), accountId)
+}
+
+func newQTBroker(tradingManager TradingManager, logger Logger, api *QTApi, accountId string) *QTBroker {
 	return &QTBroker{
 		tm:             tradingManager,
 		logger:         logger,
-		api:            NewQTApi(),
+		api:            api,
 		accountId:      accountId,
 		lastBalance:    &BrokerBalance{},
 		lastPositions:  []*BrokerPosition{},
@@ -35,6 +39,12 @@ func (b *QTBroker) CreateOrder(
 ) (*BrokerOrder, error) {
 	b.logger.LogInfo("broker", "create_order,%d,%d,%s,%s,%.2f", symId, quantity, action, typ, limitOrStopPrice)
 	path := "v1/accounts/" + b.accountId + "/orders"
+	return b.postOrder(path, orderRequestData(symId, action, typ, limitOrStopPrice, quantity), 0)
+}
+
+func orderRequestData(
+	symId int, action OrderAction, typ OrderType, limitOrStopPrice float64, quantity int64,
+) map[string]interface{} {
 	data := map[string]interface{}{
 		"symbolId":       symId,
 		"quantity":       quantity,
@@ -50,29 +60,83 @@ func (b *QTBroker) CreateOrder(
 	if typ == OrderTypeLimit {
 		data["limitPrice"] = froundn(limitOrStopPrice, 4)
 	}
+	return data
+}
+
+// Creates an order, or replaces replacedId, returning the order created
+func (b *QTBroker) postOrder(path string, data map[string]interface{}, replacedId int) (*BrokerOrder, error) {
 	response := QTApiOrdersResponse{}
-	err := b.api.Request(APIRequest{Method: "POST", Path: path, Data: data}, &response)
+	err := b.api.Request(APIRequest{Method: "POST", Path: path, Data: data, Priority: QTApiPriorityCritical}, &response)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(response.Orders) <= 0 {
+	var order *BrokerOrder
+	for _, o := range response.Orders {
+		if order == nil && o.Id != replacedId {
+			order = o
+		}
+	}
+	if order == nil {
 		return nil, nil
 	}
 
-	order := response.Orders[0]
-	if order.State == "Rejected" || order.State == "Failed" {
-		return nil, errors.New("order rejected")
+	order.Side = normalizeOrderSide(order.Side)
+	order.State = normalizeOrderState(order.State)
+	if order.State == OrderStateRejected || order.State == OrderStateFailed {
+		return nil, &QTApiError{Kind: QTApiErrorRejected, Message: "order " + string(order.State)}
 	}
 
 	return order, nil
 }
 
+// Questrade cancels the order (its state goes to Replaced) and creates a new
+// one in the same request, the order is looked up in the last orders fetched
+// or fetched on its own when it was created since
+func (b *QTBroker) ReplaceOrder(orderId int, limitOrStopPrice float64, quantity int64) (*BrokerOrder, error) {
+	b.logger.LogInfo("broker", "replace_order,%d,%d,%.2f", orderId, quantity, limitOrStopPrice)
+	order, err := b.order(orderId)
+	if err != nil {
+		return nil, err
+	}
+	if order.Type != OrderTypeLimit && order.Type != OrderTypeStop {
+		return nil, errors.New("qt_broker: only limit & stop orders can be replaced")
+	}
+	path := "v1/accounts/" + b.accountId + "/orders/" + strconv.Itoa(orderId)
+	data := orderRequestData(order.SymbolId, OrderAction(order.Side), order.Type, limitOrStopPrice, quantity)
+	data["accountNumber"] = b.accountId
+	data["orderId"] = orderId
+	return b.postOrder(path, data, orderId)
+}
+
+func (b *QTBroker) order(orderId int) (*BrokerOrder, error) {
+	for _, o := range b.lastOrders {
+		if o.Id == orderId {
+			return o, nil
+		}
+	}
+
+	response := QTApiOrdersResponse{}
+	path := "v1/accounts/" + b.accountId + "/orders/" + strconv.Itoa(orderId)
+	err := b.api.Request(APIRequest{Path: path, Priority: QTApiPriorityCritical}, &response)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range response.Orders {
+		if o.Id == orderId {
+			o.Side = normalizeOrderSide(o.Side)
+			o.State = normalizeOrderState(o.State)
+			return o, nil
+		}
+	}
+	return nil, errors.New("qt_broker: can't replace unknown order #" + strconv.Itoa(orderId))
+}
+
 func (b *QTBroker) CancelOrder(orderId int) error {
 	b.logger.LogInfo("broker", "cancel_order,%d", orderId)
 	response := struct{ orderId int }{}
 	path := "v1/accounts/" + b.accountId + "/orders/" + strconv.Itoa(orderId)
-	return b.api.Request(APIRequest{Method: "DELETE", Path: path}, &response)
+	return b.api.Request(APIRequest{Method: "DELETE", Path: path, Priority: QTApiPriorityCritical}, &response)
 }
 
 type QTApiBalancesResponse struct {
@@ -148,6 +212,9 @@ func (b *QTBroker) Executions() ([]*BrokerExecution, error) {
 	if err != nil {
 		return nil, err
 	}
+	for _, e := range response.Executions {
+		e.Side = normalizeOrderSide(e.Side)
+	}
 	if b.tm != nil {
 		env, date := b.tm.Environment(), b.tm.Now().Format(dateFormat)
 		filePath := fmt.Sprintf("data/run/%s/%s/executions.json", env, date)
@@ -169,6 +236,10 @@ func (b *QTBroker) Orders() ([]*BrokerOrder, error) {
 	if err != nil {
 		return nil, err
 	}
+	for _, o := range response.Orders {
+		o.Side = normalizeOrderSide(o.Side)
+		o.State = normalizeOrderState(o.State)
+	}
 	if b.tm != nil {
 		env, date := b.tm.Environment(), b.tm.Now().Format(dateFormat)
 		filePath := fmt.Sprintf("data/run/%s/%s/orders.json", env, date)
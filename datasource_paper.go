@@ -4,20 +4,84 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 )
 
+// Days of candles kept loaded, the least recently used ones are dropped past it
+const paperCandleDaysKept = 1000
+
+// Day files are read-only once loaded so they're shared by every paper
+// datasource, sweeps run many backtests over the same days at once
+var (
+	paperCandleDays   = map[string]*paperCandleDay{}
+	paperCandleUses   int
+	paperCandleDaysRW sync.Mutex
+)
+
+type paperCandleDay struct {
+	// Closed once candles or err are set
+	loaded  chan bool
+	candles []*SymbolCandle
+	err     error
+	// paperCandleUses when last asked for
+	used int
+}
+
+// Candles of the day called name, loaded by the first caller while the others
+// wait for it. Days failing to load are forgotten so they get tried again.
+func loadPaperCandleDay(name string, load func() ([]*SymbolCandle, error)) ([]*SymbolCandle, error) {
+	paperCandleDaysRW.Lock()
+	paperCandleUses++
+	day, ok := paperCandleDays[name]
+	if !ok {
+		day = &paperCandleDay{loaded: make(chan bool)}
+		paperCandleDays[name] = day
+	}
+	day.used = paperCandleUses
+	if !ok {
+		evictPaperCandleDays()
+	}
+	paperCandleDaysRW.Unlock()
+
+	if !ok {
+		day.candles, day.err = load()
+		if day.err != nil {
+			paperCandleDaysRW.Lock()
+			if paperCandleDays[name] == day {
+				delete(paperCandleDays, name)
+			}
+			paperCandleDaysRW.Unlock()
+		}
+		close(day.loaded)
+	}
+	<-day.loaded
+	return day.candles, day.err
+}
+
+// Drops the least recently used days past paperCandleDaysKept, callers still
+// holding them keep their candles. paperCandleDaysRW must be held.
+func evictPaperCandleDays() {
+	for len(paperCandleDays) > paperCandleDaysKept {
+		oldest := ""
+		for name, day := range paperCandleDays {
+			if oldest == "" || day.used < paperCandleDays[oldest].used {
+				oldest = name
+			}
+		}
+		delete(paperCandleDays, oldest)
+	}
+}
+
 type PaperDatasource struct {
-	logger     Logger
-	tm         TradingManager
-	candleData map[string][]*SymbolCandle
+	logger Logger
+	tm     TradingManager
 }
 
 func NewPaperDatasource(tm TradingManager, logger Logger) *PaperDatasource {
 	return &PaperDatasource{
-		logger:     logger,
-		tm:         tm,
-		candleData: map[string][]*SymbolCandle{},
+		logger: logger,
+		tm:     tm,
 	}
 }
 
@@ -85,12 +149,12 @@ func (ds *PaperDatasource) Candles(
 	}
 
 	dataSliceName := intervalFolder + "/" + symbolDetails.Symbol + "/" + start.Format("2006-01-02")
-	if candles, ok := ds.candleData[dataSliceName]; ok {
-		return ds.filterCandles(candles, start, end), nil
-	}
-	var candles []*SymbolCandle
-	err := readJsonFile("data/"+dataSliceName+".json", &candles)
-	if err != nil {
+	candles, err := loadPaperCandleDay(dataSliceName, func() ([]*SymbolCandle, error) {
+		var candles []*SymbolCandle
+		err := readJsonFile("data/"+dataSliceName+".json", &candles)
+		if err == nil {
+			return candles, nil
+		}
 		// Try fetching from kibot
 		candles, err = callKibotHistory(symbolDetails.Symbol, interval, start, end)
 		if err != nil {
@@ -99,12 +163,11 @@ func (ds *PaperDatasource) Candles(
 		if err := os.MkdirAll("data/"+intervalFolder+"/"+symbolDetails.Symbol, 0755); err != nil {
 			return nil, err
 		}
-		err = writeJsonFile("data/"+dataSliceName+".json", candles)
-		if err != nil {
-			return nil, err
-		}
+		return candles, writeJsonFile("data/"+dataSliceName+".json", candles)
+	})
+	if err != nil {
+		return nil, err
 	}
-	ds.candleData[dataSliceName] = candles
 	return ds.filterCandles(candles, start, end), nil
 }
 
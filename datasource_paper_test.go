@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Forgets the days loaded by a test once it's over
+func resetPaperCandleDays(t *testing.T) {
+	paperCandleDaysRW.Lock()
+	days := paperCandleDays
+	paperCandleDays = map[string]*paperCandleDay{}
+	paperCandleDaysRW.Unlock()
+	t.Cleanup(func() {
+		paperCandleDaysRW.Lock()
+		paperCandleDays = days
+		paperCandleDaysRW.Unlock()
+	})
+}
+
+func TestLoadPaperCandleDayLoadsOnce(t *testing.T) {
+	resetPaperCandleDays(t)
+
+	var loads int32
+	release := make(chan bool)
+	load := func() ([]*SymbolCandle, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return []*SymbolCandle{{Close: 100}}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			candles, err := loadPaperCandleDay("1m-1d/TEST/2017-07-20", load)
+			if err != nil || len(candles) != 1 {
+				t.Errorf("got %v, %v, want the loaded candle", candles, err)
+			}
+		}()
+	}
+	close(release)
+	wg.Wait()
+	if loads != 1 {
+		t.Errorf("loaded %d times, want once", loads)
+	}
+}
+
+func TestLoadPaperCandleDayRetriesFailures(t *testing.T) {
+	resetPaperCandleDays(t)
+
+	failing := func() ([]*SymbolCandle, error) { return nil, errors.New("no data") }
+	if _, err := loadPaperCandleDay("1m-1d/TEST/2017-07-20", failing); err == nil {
+		t.Fatal("want the load error")
+	}
+	candles, err := loadPaperCandleDay("1m-1d/TEST/2017-07-20", func() ([]*SymbolCandle, error) {
+		return []*SymbolCandle{{Close: 100}}, nil
+	})
+	if err != nil || len(candles) != 1 {
+		t.Errorf("got %v, %v, want the day loaded again", candles, err)
+	}
+}
+
+func TestLoadPaperCandleDayEvictsLeastRecentlyUsed(t *testing.T) {
+	resetPaperCandleDays(t)
+
+	var loads int
+	load := func() ([]*SymbolCandle, error) {
+		loads++
+		return []*SymbolCandle{}, nil
+	}
+	loadPaperCandleDay("first", load)
+	for i := 0; i < paperCandleDaysKept; i++ {
+		loadPaperCandleDay(fmt.Sprintf("day-%d", i), load)
+		// Kept in use
+		loadPaperCandleDay("first", load)
+	}
+	if len(paperCandleDays) != paperCandleDaysKept {
+		t.Errorf("%d days kept, want %d", len(paperCandleDays), paperCandleDaysKept)
+	}
+	if _, ok := paperCandleDays["first"]; !ok {
+		t.Error("the day used all along got evicted")
+	}
+	if _, ok := paperCandleDays["day-0"]; ok {
+		t.Error("the least recently used day is still kept")
+	}
+	if loads != paperCandleDaysKept+1 {
+		t.Errorf("loaded %d times, want %d", loads, paperCandleDaysKept+1)
+	}
+}
@@ -16,9 +16,13 @@ type QTDatasource struct {
 }
 
 func NewQTDatasource(logger Logger) *QTDatasource {
+	return newQTDatasource(logger, NewQTApi())
+}
+
+func newQTDatasource(logger Logger, api *QTApi) *QTDatasource {
 	return &QTDatasource{
 		logger: logger,
-		api:    NewQTApi(),
+		api:    api,
 	}
 }
 
@@ -37,7 +41,8 @@ type QTApiCandlesResponse struct {
 func (ds *QTDatasource) Details(symbolName string) (*SymbolDetails, error) {
 	response := QTApiDetailsResponse{}
 	err := ds.api.Request(APIRequest{
-		Path: "v1/symbols?names=" + symbolName,
+		Path:     "v1/symbols?names=" + symbolName,
+		Priority: QTApiPriorityLow,
 	}, &response)
 	if err != nil {
 		return nil, err
@@ -51,7 +56,8 @@ func (ds *QTDatasource) Details(symbolName string) (*SymbolDetails, error) {
 func (ds *QTDatasource) BatchDetails(symbols []string) ([]*SymbolDetails, error) {
 	response := QTApiDetailsResponse{}
 	err := ds.api.Request(APIRequest{
-		Path: "v1/symbols?names=" + strings.Join(symbols, ","),
+		Path:     "v1/symbols?names=" + strings.Join(symbols, ","),
+		Priority: QTApiPriorityLow,
 	}, &response)
 	return response.Symbols, err
 }
@@ -61,8 +67,13 @@ func (ds *QTDatasource) Quote(id int) (*SymbolQuote, error) {
 	err := ds.api.Request(APIRequest{
 		Path: "v1/markets/quotes?ids=" + strconv.Itoa(id),
 	}, &response)
-	// TODO check length
-	return response.Quotes[0], err
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Quotes) == 0 {
+		return nil, errors.New(fmt.Sprintf("No quote for symbol id: %d", id))
+	}
+	return response.Quotes[0], nil
 }
 
 func (ds *QTDatasource) BatchQuote(ids []int) ([]*SymbolQuote, error) {
@@ -88,6 +99,6 @@ func (ds *QTDatasource) Candles(id int, start, end time.Time, interval CandleInt
 		"datasource", "fetching_candles,qt,%s,%s,%s,%s",
 		symbolDetails.Symbol, start.Format(dateTimeFormat), end.Format(dateTimeFormat), interval,
 	)
-	err := ds.api.Request(APIRequest{Path: path}, &response)
+	err := ds.api.Request(APIRequest{Path: path, Priority: QTApiPriorityLow}, &response)
 	return response.Candles, err
 }
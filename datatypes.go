@@ -1,6 +1,9 @@
 package main
 
-import "time"
+import (
+	"errors"
+	"time"
+)
 
 type CandleInterval string
 
@@ -15,6 +18,28 @@ const (
 	CandleIntervalOneWeek                       = "OneWeek"
 )
 
+func (i CandleInterval) Duration() time.Duration {
+	switch i {
+	case CandleIntervalOneMinute:
+		return time.Minute
+	case CandleIntervalTwoMinute:
+		return 2 * time.Minute
+	case CandleIntervalFiveMinute:
+		return 5 * time.Minute
+	case CandleIntervalFifteenMinutes:
+		return 15 * time.Minute
+	case CandleIntervalHalfHour:
+		return 30 * time.Minute
+	case CandleIntervalOneHour:
+		return time.Hour
+	case CandleIntervalOneDay:
+		return 24 * time.Hour
+	case CandleIntervalOneWeek:
+		return 7 * 24 * time.Hour
+	}
+	return 0
+}
+
 type OrderAction string
 
 const (
@@ -22,6 +47,19 @@ const (
 	OrderActionSell             = "Sell"
 )
 
+// Questrade reports orders & executions opening or covering shorts with the
+// Short & Cov sides (and BTO/STC/STO/BTC for options), brings them back to
+// the Buy or Sell they were placed with
+func normalizeOrderSide(side string) string {
+	switch side {
+	case "Cov", "BTO", "BTC":
+		return string(OrderActionBuy)
+	case "Short", "STO", "STC":
+		return string(OrderActionSell)
+	}
+	return side
+}
+
 type OrderType string
 
 const (
@@ -103,6 +141,10 @@ type BrokerBalance struct {
 	Cash           float64 `json:"cash"`
 	MarketValue    float64 `json:"marketValue"`
 	StartOfDayCash float64 `json:"startOfDayCash"`
+	// What can be bought on margin, and how far equity is above the positions'
+	// maintenance requirement (under 0 is a margin call)
+	BuyingPower       float64 `json:"buyingPower"`
+	MaintenanceExcess float64 `json:"maintenanceExcess"`
 }
 
 type BrokerPosition struct {
@@ -133,31 +175,43 @@ type BrokerExecution struct {
 }
 
 type BrokerOrder struct {
-	Id               int       `json:"id"`
-	Symbol           string    `json:"symbol"`
-	SymbolId         int       `json:"symbolId"`
-	CreationTime     time.Time `json:"creationTime"`
-	UpdateTime       time.Time `json:"updateTime"`
-	TotalQuantity    int64     `json:"totalQuantity"`
-	OpenQuantity     int64     `json:"openQuantity"`
-	FilledQuantity   int64     `json:"filledQuantity"`
-	CanceledQuantity int64     `json:"canceledQuantity"`
-	Side             string    `json:"side"`
-	Type             OrderType `json:"orderType"`
-	LimitPrice       float64   `json:"limitPrice"`
-	StopPrice        float64   `json:"stopPrice"`
-	AvgExecPrice     float64   `json:"avgExecPrice"`
-	State            string    `json:"state"`
+	Id               int        `json:"id"`
+	Symbol           string     `json:"symbol"`
+	SymbolId         int        `json:"symbolId"`
+	CreationTime     time.Time  `json:"creationTime"`
+	UpdateTime       time.Time  `json:"updateTime"`
+	TotalQuantity    int64      `json:"totalQuantity"`
+	OpenQuantity     int64      `json:"openQuantity"`
+	FilledQuantity   int64      `json:"filledQuantity"`
+	CanceledQuantity int64      `json:"canceledQuantity"`
+	Side             string     `json:"side"`
+	Type             OrderType  `json:"orderType"`
+	LimitPrice       float64    `json:"limitPrice"`
+	StopPrice        float64    `json:"stopPrice"`
+	AvgExecPrice     float64    `json:"avgExecPrice"`
+	State            OrderState `json:"state"`
 }
 
 func (o *BrokerOrder) IsPending() bool {
-	return o.State == "Queued" ||
-		o.State == "Pending" ||
-		o.State == "Accepted" ||
-		o.State == "Partial" ||
-		o.State == "Replaced" ||
-		o.State == "ReplacePending" ||
-		o.State == "CancelPending"
+	return o.State.IsPending()
+}
+
+// Returned by brokers that reject an order, which then stays in their orders
+// in the Rejected state. A rejection only skips the rest of the tick.
+type OrderRejectedError struct {
+	// Nil when the broker didn't say which order it was
+	Order   *BrokerOrder
+	Message string
+}
+
+func (e *OrderRejectedError) Error() string {
+	return e.Message
+}
+
+// Whether err is a rejection, by the paper broker or Questrade
+func isOrderRejected(err error) bool {
+	var rejected *OrderRejectedError
+	return errors.As(err, &rejected) || isQTApiError(err, QTApiErrorRejected)
 }
 
 type Datasource interface {
@@ -167,9 +221,11 @@ type Datasource interface {
 }
 
 type Broker interface {
-	// Watch for X-RateLimit-Remaining and X-RateLimit-Reset, stopping at 50 calls left
 	CreateOrder(symId int, action OrderAction, typ OrderType, limitOrStopPrice float64, qty int64) (*BrokerOrder, error)
 	CancelOrder(orderId int) error
+	// Replaces a pending limit or stop order with one for qty shares at
+	// limitOrStopPrice, without leaving a moment where neither is working
+	ReplaceOrder(orderId int, limitOrStopPrice float64, qty int64) (*BrokerOrder, error)
 	Balance() (*BrokerBalance, error)
 	Positions() ([]*BrokerPosition, error)
 	Executions() ([]*BrokerExecution, error)
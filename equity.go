@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type EquityPoint struct {
+	Time        time.Time `json:"time"`
+	Equity      float64   `json:"equity"`
+	Cash        float64   `json:"cash"`
+	MarketValue float64   `json:"marketValue"`
+	OpenPnL     float64   `json:"openPnL"`
+}
+
+func newEquityPoint(now time.Time, balance *BrokerBalance, positions []*BrokerPosition) *EquityPoint {
+	point := &EquityPoint{
+		Time:        now,
+		Equity:      balance.Cash + balance.MarketValue,
+		Cash:        balance.Cash,
+		MarketValue: balance.MarketValue,
+	}
+	for _, p := range positions {
+		point.OpenPnL += p.OpenPnL
+	}
+	return point
+}
+
+// Appends equity points, one JSON object per line, next to the log file of
+// the environment (a file per day in production)
+type EquityRecorder struct {
+	timeSource  TimeSource
+	folder      string
+	environment string
+	truncate    bool
+	// File of the last point recorded, closed once points go to another one
+	path string
+	file *os.File
+}
+
+func NewEquityRecorder(timeSource TimeSource, folder, environment string, truncate bool) *EquityRecorder {
+	return &EquityRecorder{
+		timeSource:  timeSource,
+		folder:      folder,
+		environment: environment,
+		truncate:    truncate,
+	}
+}
+
+func (r *EquityRecorder) Record(point *EquityPoint) error {
+	path := runFilePath(r.folder, r.environment, r.timeSource.Now(), "equity.jsonl")
+	if path != r.path {
+		if err := r.Close(); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return errors.New("error creating directory " + path)
+		}
+		openMode := os.O_WRONLY | os.O_CREATE
+		if r.truncate {
+			openMode = openMode | os.O_TRUNC
+		} else {
+			openMode = openMode | os.O_APPEND
+		}
+		file, err := os.OpenFile(path, openMode, 0666)
+		if err != nil {
+			return errors.New("error opening equity file " + path + " (" + err.Error() + ")")
+		}
+		r.path, r.file = path, file
+	}
+	return json.NewEncoder(r.file).Encode(point)
+}
+
+func (r *EquityRecorder) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.path, r.file = "", nil
+	return err
+}
+
+// Keeps at most maxPoints evenly spaced points, always keeping the last one
+func downsampleEquity(points []*EquityPoint, maxPoints int) []*EquityPoint {
+	if maxPoints <= 0 || len(points) <= maxPoints {
+		return points
+	}
+	if maxPoints == 1 {
+		return points[len(points)-1:]
+	}
+	step := float64(len(points)-1) / float64(maxPoints-1)
+	sampled := make([]*EquityPoint, 0, maxPoints)
+	for i := 0; i < maxPoints; i++ {
+		sampled = append(sampled, points[int(fround(float64(i)*step))])
+	}
+	return sampled
+}
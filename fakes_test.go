@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const (
+	testSymbolId      = 1
+	testShortSymbolId = 2
+)
+
+// Clock of brokers & strategies under test, moved by the test
+type testTradingManager struct {
+	now        time.Time
+	datasource *testDatasource
+	broker     Broker
+}
+
+func (tm *testTradingManager) Now() time.Time {
+	return tm.now
+}
+
+func (tm *testTradingManager) State() TradingManagerState {
+	return TradingManagerStateRunning
+}
+
+func (tm *testTradingManager) Environment() TradingManagerEnvironment {
+	return TradingManagerEnvironmentPaper
+}
+
+func (tm *testTradingManager) Broker() Broker {
+	return tm.broker
+}
+
+func (tm *testTradingManager) Datasource() Datasource {
+	return tm.datasource
+}
+
+func (tm *testTradingManager) WaitForState(states ...TradingManagerState) {}
+
+func (tm *testTradingManager) Start() error {
+	return nil
+}
+
+func (tm *testTradingManager) Stop() {}
+
+// Flat 1m candles at the price of each symbol set by the test
+type testDatasource struct {
+	prices map[int]float64
+}
+
+func (ds *testDatasource) Details(symbolName string) (*SymbolDetails, error) {
+	if details := findSymbolDetailsByName(symbolName); details != nil {
+		return details, nil
+	}
+	return nil, errors.New("no symbol named " + symbolName)
+}
+
+func (ds *testDatasource) Quote(id int) (*SymbolQuote, error) {
+	price := ds.prices[id]
+	return &SymbolQuote{SymbolId: id, BidPrice: price, AskPrice: price, LastTradePrice: price}, nil
+}
+
+func (ds *testDatasource) Candles(id int, start, end time.Time, interval CandleInterval) ([]*SymbolCandle, error) {
+	price := ds.prices[id]
+	candles := []*SymbolCandle{}
+	for t := start.Truncate(time.Minute); !t.After(end); t = t.Add(time.Minute) {
+		candles = append(candles, &SymbolCandle{
+			Start: t, End: t.Add(time.Minute), Open: price, High: price, Low: price, Close: price, Volume: 1000000,
+		})
+	}
+	return candles, nil
+}
+
+// Sets the time location & symbols to symbols, both are put back once t is over
+func setupTestSymbols(t *testing.T, symbols ...*SymbolDetails) {
+	location, previousSymbols := timeLocation, allSymbols
+	t.Cleanup(func() {
+		timeLocation, allSymbols = location, previousSymbols
+	})
+	timeLocation, _ = time.LoadLocation("America/New_York")
+	if len(symbols) == 0 {
+		symbols = []*SymbolDetails{
+			{Symbol: "QQQ", SymbolId: testSymbolId},
+			{Symbol: "SQQQ", SymbolId: testShortSymbolId},
+		}
+	}
+	allSymbols = symbols
+}
+
+// Paper broker with $100000 at 10:00:59 on a Friday, trading QQQ & SQQQ at
+// $100 without slippage
+func newTestPaperBroker(t *testing.T) (*testTradingManager, *PaperBroker) {
+	setupTestSymbols(t)
+	tm := &testTradingManager{
+		now:        time.Date(2020, 1, 3, 10, 0, 59, 0, timeLocation),
+		datasource: &testDatasource{prices: map[int]float64{testSymbolId: 100, testShortSymbolId: 100}},
+	}
+	b := NewPaperBroker(tm, NewNullLogger())
+	if err := b.Configure(PaperBrokerConfig{
+		Slippage: PaperModelConfig{Name: "fixed_bps", Params: map[string]float64{"bps": 0}},
+	}); err != nil {
+		panic(err)
+	}
+	b.cash = 100000
+	tm.broker = b
+	return tm, b
+}
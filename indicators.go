@@ -0,0 +1,527 @@
+package main
+
+import "math"
+
+// Indicators are fed one closed candle at a time and keep just enough state
+// to produce their next value, so strategies can either update them as new
+// candles come in or run them over a batch with indicatorValues.
+type Indicator interface {
+	Update(candle *SymbolCandle)
+	Ready() bool
+	Value() float64
+}
+
+// Returns the indicator value after each candle, NaN while it's not ready
+func indicatorValues(indicator Indicator, candles []*SymbolCandle) []float64 {
+	values := make([]float64, len(candles))
+	for i, c := range candles {
+		indicator.Update(c)
+		if indicator.Ready() {
+			values[i] = indicator.Value()
+		} else {
+			values[i] = math.NaN()
+		}
+	}
+	return values
+}
+
+// Returns the indicator value after the last candle, NaN if it's not ready
+func indicatorValue(indicator Indicator, candles []*SymbolCandle) float64 {
+	for _, c := range candles {
+		indicator.Update(c)
+	}
+	if !indicator.Ready() {
+		return math.NaN()
+	}
+	return indicator.Value()
+}
+
+type SMA struct {
+	size   int
+	values []float64
+	next   int
+	count  int
+	sum    float64
+}
+
+func NewSMA(size int) *SMA {
+	return &SMA{size: size, values: make([]float64, size)}
+}
+
+func (i *SMA) Add(value float64) {
+	if i.count == i.size {
+		i.sum -= i.values[i.next]
+	} else {
+		i.count++
+	}
+	i.values[i.next] = value
+	i.sum += value
+	i.next = (i.next + 1) % i.size
+}
+
+func (i *SMA) Update(candle *SymbolCandle) {
+	i.Add(candle.Close)
+}
+
+func (i *SMA) Ready() bool {
+	return i.count == i.size
+}
+
+func (i *SMA) Value() float64 {
+	return i.sum / float64(i.count)
+}
+
+// Seeded with the SMA of the first size values
+type EMA struct {
+	size  int
+	alpha float64
+	count int
+	value float64
+}
+
+func NewEMA(size int) *EMA {
+	return &EMA{size: size, alpha: 2 / float64(size+1)}
+}
+
+func (i *EMA) Add(value float64) {
+	i.count++
+	if i.count <= i.size {
+		i.value += (value - i.value) / float64(i.count)
+		return
+	}
+	i.value += i.alpha * (value - i.value)
+}
+
+func (i *EMA) Update(candle *SymbolCandle) {
+	i.Add(candle.Close)
+}
+
+func (i *EMA) Ready() bool {
+	return i.count >= i.size
+}
+
+func (i *EMA) Value() float64 {
+	return i.value
+}
+
+// Linearly weighted, the most recent value has a weight of size
+type WMA struct {
+	size      int
+	values    []float64
+	next      int
+	count     int
+	sum       float64
+	numerator float64
+}
+
+func NewWMA(size int) *WMA {
+	return &WMA{size: size, values: make([]float64, size)}
+}
+
+func (i *WMA) Add(value float64) {
+	if i.count == i.size {
+		// Every value loses one weight, the oldest one drops out entirely
+		i.numerator += float64(i.size)*value - i.sum
+		i.sum += value - i.values[i.next]
+	} else {
+		i.count++
+		i.numerator += float64(i.count) * value
+		i.sum += value
+	}
+	i.values[i.next] = value
+	i.next = (i.next + 1) % i.size
+}
+
+func (i *WMA) Update(candle *SymbolCandle) {
+	i.Add(candle.Close)
+}
+
+func (i *WMA) Ready() bool {
+	return i.count == i.size
+}
+
+func (i *WMA) Value() float64 {
+	return i.numerator / float64((i.count*(i.count+1))/2)
+}
+
+// Wilder's RSI, averages are seeded with the simple mean of the first size
+// changes then smoothed
+type RSI struct {
+	size      int
+	count     int
+	lastClose float64
+	avgGain   float64
+	avgLoss   float64
+}
+
+func NewRSI(size int) *RSI {
+	return &RSI{size: size}
+}
+
+func (i *RSI) Update(candle *SymbolCandle) {
+	i.count++
+	if i.count == 1 {
+		i.lastClose = candle.Close
+		return
+	}
+	change := candle.Close - i.lastClose
+	i.lastClose = candle.Close
+	gain, loss := fmax(change, 0), fmax(-change, 0)
+	if i.count <= i.size+1 {
+		n := float64(i.count - 1)
+		i.avgGain += (gain - i.avgGain) / n
+		i.avgLoss += (loss - i.avgLoss) / n
+		return
+	}
+	i.avgGain = (i.avgGain*float64(i.size-1) + gain) / float64(i.size)
+	i.avgLoss = (i.avgLoss*float64(i.size-1) + loss) / float64(i.size)
+}
+
+func (i *RSI) Ready() bool {
+	return i.count > i.size
+}
+
+func (i *RSI) Value() float64 {
+	if i.avgLoss == 0 {
+		if i.avgGain == 0 {
+			// Flat prices, neither overbought nor oversold
+			return 50
+		}
+		return 100
+	}
+	return 100 - (100 / (1 + (i.avgGain / i.avgLoss)))
+}
+
+// Value is the MACD line (fast EMA - slow EMA), Signal is an EMA of it
+type MACD struct {
+	fast   *EMA
+	slow   *EMA
+	signal *EMA
+}
+
+func NewMACD(fastSize, slowSize, signalSize int) *MACD {
+	return &MACD{
+		fast:   NewEMA(fastSize),
+		slow:   NewEMA(slowSize),
+		signal: NewEMA(signalSize),
+	}
+}
+
+func (i *MACD) Update(candle *SymbolCandle) {
+	i.fast.Update(candle)
+	i.slow.Update(candle)
+	if i.fast.Ready() && i.slow.Ready() {
+		i.signal.Add(i.Value())
+	}
+}
+
+func (i *MACD) Ready() bool {
+	return i.signal.Ready()
+}
+
+func (i *MACD) Value() float64 {
+	return i.fast.Value() - i.slow.Value()
+}
+
+func (i *MACD) Signal() float64 {
+	return i.signal.Value()
+}
+
+func (i *MACD) Histogram() float64 {
+	return i.Value() - i.Signal()
+}
+
+// Value is the middle band (SMA), bands are width population standard
+// deviations away from it
+type BollingerBands struct {
+	sma   *SMA
+	width float64
+}
+
+func NewBollingerBands(size int, width float64) *BollingerBands {
+	return &BollingerBands{sma: NewSMA(size), width: width}
+}
+
+func (i *BollingerBands) Update(candle *SymbolCandle) {
+	i.sma.Update(candle)
+}
+
+func (i *BollingerBands) Ready() bool {
+	return i.sma.Ready()
+}
+
+func (i *BollingerBands) Value() float64 {
+	return i.sma.Value()
+}
+
+func (i *BollingerBands) StdDev() float64 {
+	mean := i.sma.Value()
+	var sum float64
+	for _, v := range i.sma.values[:i.sma.count] {
+		sum += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(sum / float64(i.sma.count))
+}
+
+func (i *BollingerBands) Upper() float64 {
+	return i.Value() + i.width*i.StdDev()
+}
+
+func (i *BollingerBands) Lower() float64 {
+	return i.Value() - i.width*i.StdDev()
+}
+
+// Wilder's Average True Range, seeded with the mean of the first size ranges
+type ATR struct {
+	size      int
+	count     int
+	lastClose float64
+	value     float64
+}
+
+func NewATR(size int) *ATR {
+	return &ATR{size: size}
+}
+
+func trueRange(candle *SymbolCandle, lastClose float64, first bool) float64 {
+	if first {
+		return candle.High - candle.Low
+	}
+	return fmax(
+		candle.High-candle.Low,
+		fmax(math.Abs(candle.High-lastClose), math.Abs(candle.Low-lastClose)),
+	)
+}
+
+func (i *ATR) Update(candle *SymbolCandle) {
+	tr := trueRange(candle, i.lastClose, i.count == 0)
+	i.lastClose = candle.Close
+	i.count++
+	if i.count <= i.size {
+		i.value += (tr - i.value) / float64(i.count)
+		return
+	}
+	i.value = (i.value*float64(i.size-1) + tr) / float64(i.size)
+}
+
+func (i *ATR) Ready() bool {
+	return i.count >= i.size
+}
+
+func (i *ATR) Value() float64 {
+	return i.value
+}
+
+// Volume weighted average of the typical price, resets every trading day
+type VWAP struct {
+	day         string
+	priceVolume float64
+	volume      float64
+	lastPrice   float64
+}
+
+func NewVWAP() *VWAP {
+	return &VWAP{}
+}
+
+func (i *VWAP) Update(candle *SymbolCandle) {
+	day := candle.Start.Format(dateFormat)
+	if day != i.day {
+		i.day = day
+		i.priceVolume = 0
+		i.volume = 0
+	}
+	typicalPrice := (candle.High + candle.Low + candle.Close) / 3
+	i.priceVolume += typicalPrice * float64(candle.Volume)
+	i.volume += float64(candle.Volume)
+	i.lastPrice = typicalPrice
+}
+
+func (i *VWAP) Ready() bool {
+	return i.day != ""
+}
+
+func (i *VWAP) Value() float64 {
+	if i.volume == 0 {
+		return i.lastPrice
+	}
+	return i.priceVolume / i.volume
+}
+
+// Value is %K over the last kSize candles, D is the dSize SMA of %K
+type Stochastic struct {
+	kSize int
+	highs []float64
+	lows  []float64
+	count int
+	k     float64
+	d     *SMA
+}
+
+func NewStochastic(kSize, dSize int) *Stochastic {
+	return &Stochastic{
+		kSize: kSize,
+		highs: make([]float64, kSize),
+		lows:  make([]float64, kSize),
+		d:     NewSMA(dSize),
+	}
+}
+
+func (i *Stochastic) Update(candle *SymbolCandle) {
+	i.highs[i.count%i.kSize] = candle.High
+	i.lows[i.count%i.kSize] = candle.Low
+	i.count++
+	if i.count < i.kSize {
+		return
+	}
+
+	high, low := i.highs[0], i.lows[0]
+	for j := 1; j < i.kSize; j++ {
+		high = fmax(high, i.highs[j])
+		low = fmin(low, i.lows[j])
+	}
+	if high == low {
+		i.k = 50
+	} else {
+		i.k = 100 * (candle.Close - low) / (high - low)
+	}
+	i.d.Add(i.k)
+}
+
+func (i *Stochastic) Ready() bool {
+	return i.count >= i.kSize
+}
+
+func (i *Stochastic) Value() float64 {
+	return i.k
+}
+
+// Whether %D has dSize %K values to average, it needs kSize+dSize-1 candles
+func (i *Stochastic) DReady() bool {
+	return i.d.Ready()
+}
+
+// SMA of %K, NaN until DReady
+func (i *Stochastic) D() float64 {
+	if !i.DReady() {
+		return math.NaN()
+	}
+	return i.d.Value()
+}
+
+// Wilder's Average Directional Index, needs 2*size candles to be ready
+type ADX struct {
+	size       int
+	count      int
+	last       *SymbolCandle
+	trSum      float64
+	plusDMSum  float64
+	minusDMSum float64
+	dxCount    int
+	value      float64
+}
+
+func NewADX(size int) *ADX {
+	return &ADX{size: size}
+}
+
+func (i *ADX) Update(candle *SymbolCandle) {
+	if i.last == nil {
+		i.last = candle
+		return
+	}
+	upMove := candle.High - i.last.High
+	downMove := i.last.Low - candle.Low
+	var plusDM, minusDM float64
+	if upMove > downMove && upMove > 0 {
+		plusDM = upMove
+	}
+	if downMove > upMove && downMove > 0 {
+		minusDM = downMove
+	}
+	tr := trueRange(candle, i.last.Close, false)
+	i.last = candle
+	i.count++
+
+	size := float64(i.size)
+	if i.count <= i.size {
+		i.trSum += tr
+		i.plusDMSum += plusDM
+		i.minusDMSum += minusDM
+	} else {
+		i.trSum = i.trSum - i.trSum/size + tr
+		i.plusDMSum = i.plusDMSum - i.plusDMSum/size + plusDM
+		i.minusDMSum = i.minusDMSum - i.minusDMSum/size + minusDM
+	}
+	if i.count < i.size {
+		return
+	}
+
+	dx := i.dx()
+	i.dxCount++
+	if i.dxCount <= i.size {
+		i.value += (dx - i.value) / float64(i.dxCount)
+		return
+	}
+	i.value = (i.value*(size-1) + dx) / size
+}
+
+func (i *ADX) dx() float64 {
+	diSum := i.PlusDI() + i.MinusDI()
+	if diSum == 0 {
+		return 0
+	}
+	return 100 * math.Abs(i.PlusDI()-i.MinusDI()) / diSum
+}
+
+func (i *ADX) Ready() bool {
+	return i.dxCount >= i.size
+}
+
+func (i *ADX) Value() float64 {
+	return i.value
+}
+
+func (i *ADX) PlusDI() float64 {
+	if i.trSum == 0 {
+		return 0
+	}
+	return 100 * i.plusDMSum / i.trSum
+}
+
+func (i *ADX) MinusDI() float64 {
+	if i.trSum == 0 {
+		return 0
+	}
+	return 100 * i.minusDMSum / i.trSum
+}
+
+type OBV struct {
+	count     int
+	lastClose float64
+	value     float64
+}
+
+func NewOBV() *OBV {
+	return &OBV{}
+}
+
+func (i *OBV) Update(candle *SymbolCandle) {
+	if i.count > 0 {
+		if candle.Close > i.lastClose {
+			i.value += float64(candle.Volume)
+		} else if candle.Close < i.lastClose {
+			i.value -= float64(candle.Volume)
+		}
+	}
+	i.lastClose = candle.Close
+	i.count++
+}
+
+func (i *OBV) Ready() bool {
+	return i.count > 0
+}
+
+func (i *OBV) Value() float64 {
+	return i.value
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var (
+	testCloses = []float64{
+		10.0, 10.5, 10.2, 10.8, 11.3, 11.0, 11.6, 12.1, 11.8, 11.4,
+		11.9, 12.4, 12.9, 12.6, 13.2, 13.0, 12.7, 13.4, 13.9, 13.5,
+	}
+	nan = math.NaN()
+)
+
+// 20 candles over 2 days, highs & lows a few cents around the closes
+func testCandles() []*SymbolCandle {
+	candles := []*SymbolCandle{}
+	for i, c := range testCloses {
+		start := time.Date(2017, 7, 20+i/10, 9, 30+i%10, 0, 0, time.UTC)
+		candles = append(candles, &SymbolCandle{
+			Start:  start,
+			End:    start.Add(time.Minute),
+			Open:   c,
+			High:   c + 0.3 + 0.1*float64(i%3),
+			Low:    c - 0.4 + 0.1*float64(i%2),
+			Close:  c,
+			Volume: int64(1000 + 100*(i%5)),
+		})
+	}
+	return candles
+}
+
+func closeCandles(closes ...float64) []*SymbolCandle {
+	candles := []*SymbolCandle{}
+	for _, c := range closes {
+		candles = append(candles, &SymbolCandle{Open: c, High: c, Low: c, Close: c})
+	}
+	return candles
+}
+
+func assertValues(t *testing.T, name string, got, want []float64, tolerance float64) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d values, want %d", name, len(got), len(want))
+	}
+	for i := range want {
+		if math.IsNaN(want[i]) != math.IsNaN(got[i]) ||
+			!math.IsNaN(want[i]) && math.Abs(got[i]-want[i]) > tolerance {
+			t.Errorf("%s: value %d is %.4f, want %.4f", name, i, got[i], want[i])
+		}
+	}
+}
+
+// StockCharts' example: 11 to 17, the first 5 day SMA is 13
+func TestSMAReference(t *testing.T) {
+	got := indicatorValues(NewSMA(5), closeCandles(11, 12, 13, 14, 15, 16, 17))
+	assertValues(t, "sma", got, []float64{nan, nan, nan, nan, 13, 14, 15}, 1e-9)
+}
+
+// StockCharts' 14 day RSI example (from Wilder's), its spreadsheet rounds the
+// averages to 2 decimals which moves the RSI by up to ~0.07
+func TestRSIReference(t *testing.T) {
+	candles := closeCandles(
+		44.34, 44.09, 44.15, 43.61, 44.33, 44.83, 45.10, 45.42, 45.84, 46.08, 45.89, 46.03, 45.61, 46.28,
+		46.28, 46.00, 46.03, 46.41, 46.22, 45.64, 46.21, 46.25, 45.71, 46.45, 45.78, 45.35, 44.03, 44.18,
+		44.22, 44.57, 43.42, 42.66, 43.13,
+	)
+	want := []float64{
+		nan, nan, nan, nan, nan, nan, nan, nan, nan, nan, nan, nan, nan, nan,
+		70.53, 66.32, 66.55, 69.41, 66.36, 57.97, 62.93, 63.26, 56.06, 62.38, 54.71, 50.42, 39.99, 41.46,
+		41.87, 45.46, 37.30, 33.08, 37.77,
+	}
+	assertValues(t, "rsi", indicatorValues(NewRSI(14), candles), want, 0.1)
+}
+
+// Reference values over testCandles, worked out separately from the
+// definitions of each indicator
+var indicatorTests = []struct {
+	name      string
+	indicator func() Indicator
+	// Value() when nil, otherwise another output of the indicator, NaN
+	// where it isn't defined yet
+	value func(Indicator) float64
+	want  []float64
+}{
+	{"sma", func() Indicator { return NewSMA(5) }, nil, []float64{
+		nan, nan, nan, nan, 10.5600, 10.7600, 10.9800, 11.3600, 11.5600, 11.5800,
+		11.7600, 11.9200, 12.0800, 12.2400, 12.6000, 12.8200, 12.8800, 12.9800, 13.2400, 13.3000,
+	}},
+	{"ema", func() Indicator { return NewEMA(5) }, nil, []float64{
+		nan, nan, nan, nan, 10.5600, 10.7067, 11.0044, 11.3696, 11.5131, 11.4754,
+		11.6169, 11.8780, 12.2186, 12.3458, 12.6305, 12.7537, 12.7358, 12.9572, 13.2715, 13.3476,
+	}},
+	{"wma", func() Indicator { return NewWMA(5) }, nil, []float64{
+		nan, nan, nan, nan, 10.7533, 10.9000, 11.1800, 11.5533, 11.7000, 11.6467,
+		11.7533, 11.9667, 12.2933, 12.4667, 12.7867, 12.9200, 12.8800, 13.0533, 13.3600, 13.4467,
+	}},
+	{"rsi", func() Indicator { return NewRSI(5) }, nil, []float64{
+		nan, nan, nan, nan, nan, 72.7273, 79.6610, 83.9196, 72.5299, 59.1499,
+		68.2901, 75.2205, 80.5376, 69.3732, 77.2555, 69.7733, 59.0502, 71.7246, 77.8467, 63.9915,
+	}},
+	{"macd", func() Indicator { return NewMACD(3, 6, 4) }, nil, []float64{
+		nan, nan, nan, nan, nan, nan, nan, nan, 0.3374, 0.1672,
+		0.1897, 0.2778, 0.3767, 0.2939, 0.3509, 0.2783, 0.1483, 0.2307, 0.3343, 0.2379,
+	}},
+	{"macd signal", func() Indicator { return NewMACD(3, 6, 4) }, func(i Indicator) float64 {
+		return i.(*MACD).Signal()
+	}, []float64{
+		nan, nan, nan, nan, nan, nan, nan, nan, 0.3662, 0.2866,
+		0.2478, 0.2598, 0.3066, 0.3015, 0.3213, 0.3041, 0.2418, 0.2374, 0.2761, 0.2608,
+	}},
+	{"bollinger upper", func() Indicator { return NewBollingerBands(5, 2) }, func(i Indicator) float64 {
+		return i.(*BollingerBands).Upper()
+	}, []float64{
+		nan, nan, nan, nan, 11.4774, 11.5252, 11.9299, 12.2774, 12.3252, 12.3219,
+		12.2433, 12.5821, 13.1185, 13.3028, 13.4854, 13.3913, 13.3071, 13.5787, 14.0460, 14.1295,
+	}},
+	{"bollinger lower", func() Indicator { return NewBollingerBands(5, 2) }, func(i Indicator) float64 {
+		return i.(*BollingerBands).Lower()
+	}, []float64{
+		nan, nan, nan, nan, 9.6426, 9.9948, 10.0301, 10.4426, 10.7948, 10.8381,
+		11.2767, 11.2579, 11.0415, 11.1772, 11.7146, 12.2487, 12.4529, 12.3813, 12.4340, 12.4705,
+	}},
+	{"atr", func() Indicator { return NewATR(3) }, nil, []float64{
+		nan, nan, 0.8333, 0.8556, 0.8704, 0.8469, 0.8646, 0.8764, 0.8843, 0.8228,
+		0.8486, 0.8990, 0.8660, 0.8107, 0.9071, 0.8047, 0.8032, 0.9354, 0.8903, 0.8269,
+	}},
+	{"vwap", func() Indicator { return NewVWAP() }, nil, []float64{
+		9.9667, 10.2635, 10.2525, 10.4072, 10.6156, 10.6800, 10.8004, 10.9724, 11.0780, 11.1156,
+		11.9000, 12.1968, 12.4404, 12.4949, 12.6672, 12.7148, 12.7128, 12.8100, 12.9396, 13.0089,
+	}},
+	{"stochastic", func() Indicator { return NewStochastic(5, 3) }, nil, []float64{
+		nan, nan, nan, nan, 80.9524, 63.1579, 85.7143, 80.0000, 61.1111, 38.8889,
+		57.1429, 72.2222, 85.7143, 71.4286, 77.2727, 56.2500, 28.5714, 68.7500, 84.2105, 63.1579,
+	}},
+	{"adx", func() Indicator { return NewADX(3) }, nil, []float64{
+		nan, nan, nan, nan, nan, 48.7521, 52.0136, 60.0698, 47.9089, 34.4338,
+		35.8655, 44.8274, 53.6234, 48.9200, 55.7229, 54.8658, 37.4606, 41.9595, 48.6705, 39.4176,
+	}},
+	{"adx +di", func() Indicator { return NewADX(3) }, func(i Indicator) float64 {
+		return i.(*ADX).PlusDI()
+	}, []float64{
+		nan, nan, nan, 37.0370, 46.9136, 32.4786, 36.5682, 46.7689, 31.0063, 22.2554,
+		37.9085, 46.0835, 43.4440, 30.9517, 44.1556, 33.1865, 22.1711, 41.1945, 40.0880, 28.7765,
+	}},
+	{"adx -di", func() Indicator { return NewADX(3) }, func(i Indicator) float64 {
+		return i.(*ADX).MinusDI()
+	}, []float64{
+		nan, nan, nan, 14.8148, 9.8765, 14.5299, 9.5640, 6.3226, 19.1709, 25.8559,
+		16.7428, 10.5471, 7.3038, 13.4193, 7.9982, 10.1516, 23.3783, 13.3832, 9.3751, 18.8226,
+	}},
+	{"obv", func() Indicator { return NewOBV() }, nil, []float64{
+		0, 1100, -100, 1200, 2600, 1600, 2700, 3900, 2600, 1200,
+		2200, 3300, 4500, 3200, 4600, 3600, 2500, 3700, 5000, 3600,
+	}},
+}
+
+func TestIndicatorReferences(t *testing.T) {
+	candles := testCandles()
+	for _, test := range indicatorTests {
+		indicator := test.indicator()
+		got := make([]float64, len(candles))
+		for i, c := range candles {
+			indicator.Update(c)
+			switch {
+			case test.value == nil && indicator.Ready():
+				got[i] = indicator.Value()
+			case test.value != nil && !math.IsNaN(test.want[i]):
+				got[i] = test.value(indicator)
+			default:
+				got[i] = nan
+			}
+		}
+		assertValues(t, test.name, got, test.want, 1e-4)
+	}
+}
+
+// %D is the 3 candle SMA of the %K values above, undefined until 3 of them
+// are, on the 7th candle
+func TestStochasticDReference(t *testing.T) {
+	want := []float64{
+		nan, nan, nan, nan, nan, nan, 76.6082, 76.2907, 75.6085, 60.0000,
+		52.3810, 56.0847, 71.6931, 76.4550, 78.1385, 68.3171, 54.0314, 51.1905, 60.5107, 72.0395,
+	}
+	stochastic := NewStochastic(5, 3)
+	got := []float64{}
+	for i, c := range testCandles() {
+		stochastic.Update(c)
+		if ready := stochastic.DReady(); ready == math.IsNaN(want[i]) {
+			t.Errorf("candle %d: DReady is %v", i+1, ready)
+		}
+		got = append(got, stochastic.D())
+	}
+	assertValues(t, "stochastic d", got, want, 1e-4)
+}
+
+// indicatorValues & indicatorValue over the same candles give what updating
+// the indicator one candle at a time does
+func TestIndicatorBatchMatchesIncremental(t *testing.T) {
+	candles := testCandles()
+	for _, test := range indicatorTests {
+		if test.value != nil {
+			continue
+		}
+		incremental := make([]float64, len(candles))
+		indicator := test.indicator()
+		for i, c := range candles {
+			indicator.Update(c)
+			incremental[i] = nan
+			if indicator.Ready() {
+				incremental[i] = indicator.Value()
+			}
+		}
+		assertValues(t, test.name+" batch", indicatorValues(test.indicator(), candles), incremental, 0)
+		for n := 1; n <= len(candles); n++ {
+			if got := indicatorValue(test.indicator(), candles[:n]); math.IsNaN(got) != math.IsNaN(incremental[n-1]) ||
+				!math.IsNaN(got) && got != incremental[n-1] {
+				t.Errorf("%s: indicatorValue over %d candles is %.4f, want %.4f", test.name, n, got, incremental[n-1])
+			}
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+type BacktestJobState string
+
+const (
+	BacktestJobStateQueued    BacktestJobState = "queued"
+	BacktestJobStateRunning                    = "running"
+	BacktestJobStateDone                       = "done"
+	BacktestJobStateFailed                     = "failed"
+	BacktestJobStateCancelled                  = "cancelled"
+)
+
+// How many finished jobs are kept around, their runs stay on disk
+const backtestJobsKept = 50
+
+// A paper run submitted to a BacktestJobQueue, the job id is the run id
+type BacktestJob struct {
+	Id         string
+	Strategy   string
+	Start      time.Time
+	End        time.Time
+	Cash       float64
+	CreatedAt  time.Time
+	FinishedAt time.Time
+	state      BacktestJobState
+	tm         *TradingManagerV1
+}
+
+type BacktestJobStatus struct {
+	Id         string           `json:"id"`
+	Strategy   string           `json:"strategy"`
+	Params     StrategyParams   `json:"params"`
+	Start      time.Time        `json:"start"`
+	End        time.Time        `json:"end"`
+	Cash       float64          `json:"cash"`
+	CreatedAt  time.Time        `json:"createdAt"`
+	FinishedAt time.Time        `json:"finishedAt"`
+	State      BacktestJobState `json:"state"`
+	Now        time.Time        `json:"now"`
+	Progress   float64          `json:"progress"`
+}
+
+// Runs paper trading managers in the background, at most concurrency at once
+type BacktestJobQueue struct {
+	jobs  map[string]*BacktestJob
+	slots chan bool
+	rw    sync.Mutex
+}
+
+func NewBacktestJobQueue(concurrency int) *BacktestJobQueue {
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	return &BacktestJobQueue{
+		jobs:  map[string]*BacktestJob{},
+		slots: make(chan bool, concurrency),
+	}
+}
+
+func (q *BacktestJobQueue) Submit(
+	strategyName, strategyConfig string, start, end time.Time, cash float64, brokerConfig PaperBrokerConfig,
+) (*BacktestJob, error) {
+	if !end.After(start) {
+		return nil, errors.New("backtest job: end must be after start")
+	}
+	tm, err := NewTradingManagerV1(TradingManagerEnvironmentPaper, strategyName, strategyConfig)
+	if err != nil {
+		return nil, err
+	}
+	tm.broker.(*PaperBroker).cash = cash
+	if err := tm.broker.(*PaperBroker).Configure(brokerConfig); err != nil {
+		return nil, err
+	}
+	tm.start = start
+	tm.end = end
+
+	job := &BacktestJob{
+		Id:        tm.runId,
+		Strategy:  strategyName,
+		Start:     start,
+		End:       end,
+		Cash:      cash,
+		CreatedAt: time.Now().In(timeLocation),
+		state:     BacktestJobStateQueued,
+		tm:        tm,
+	}
+	q.rw.Lock()
+	q.jobs[job.Id] = job
+	q.prune()
+	q.rw.Unlock()
+
+	go q.run(job)
+	return job, nil
+}
+
+func (q *BacktestJobQueue) run(job *BacktestJob) {
+	q.slots <- true
+	defer func() { <-q.slots }()
+
+	q.rw.Lock()
+	if job.state != BacktestJobStateQueued {
+		// Cancelled while waiting for a slot
+		q.rw.Unlock()
+		return
+	}
+	if err := job.tm.Start(); err != nil {
+		job.state = BacktestJobStateFailed
+		job.FinishedAt = time.Now().In(timeLocation)
+		q.rw.Unlock()
+		return
+	}
+	job.state = BacktestJobStateRunning
+	q.rw.Unlock()
+
+	job.tm.WaitForState(TradingManagerStateDone, TradingManagerStateFailed, TradingManagerStateStopped)
+
+	q.rw.Lock()
+	defer q.rw.Unlock()
+	switch job.tm.State() {
+	case TradingManagerStateDone:
+		job.state = BacktestJobStateDone
+	case TradingManagerStateStopped:
+		job.state = BacktestJobStateCancelled
+	default:
+		job.state = BacktestJobStateFailed
+	}
+	job.FinishedAt = time.Now().In(timeLocation)
+}
+
+func (q *BacktestJobQueue) Cancel(id string) error {
+	q.rw.Lock()
+	job, ok := q.jobs[id]
+	if !ok {
+		q.rw.Unlock()
+		return errors.New("backtest job: not found: " + id)
+	}
+	state := job.state
+	if state == BacktestJobStateQueued {
+		job.state = BacktestJobStateCancelled
+		job.FinishedAt = time.Now().In(timeLocation)
+	}
+	q.rw.Unlock()
+
+	if state == BacktestJobStateRunning {
+		// run() marks it cancelled once the run is stopped & saved, or done when
+		// it was finishing anyway
+		job.tm.requestStop()
+	}
+	return nil
+}
+
+func (q *BacktestJobQueue) Get(id string) *BacktestJob {
+	q.rw.Lock()
+	defer q.rw.Unlock()
+	return q.jobs[id]
+}
+
+// Most recent first
+func (q *BacktestJobQueue) List() []*BacktestJob {
+	q.rw.Lock()
+	defer q.rw.Unlock()
+	jobs := []*BacktestJob{}
+	for _, job := range q.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+	})
+	return jobs
+}
+
+func (q *BacktestJobQueue) Latest() *BacktestJob {
+	if jobs := q.List(); len(jobs) > 0 {
+		return jobs[0]
+	}
+	return nil
+}
+
+func (q *BacktestJobQueue) Status(job *BacktestJob) *BacktestJobStatus {
+	q.rw.Lock()
+	state := job.state
+	finishedAt := job.FinishedAt
+	q.rw.Unlock()
+
+	status := &BacktestJobStatus{
+		Id:         job.Id,
+		Strategy:   job.Strategy,
+		Params:     job.tm.strategyParams,
+		Start:      job.Start,
+		End:        job.End,
+		Cash:       job.Cash,
+		CreatedAt:  job.CreatedAt,
+		FinishedAt: finishedAt,
+		State:      state,
+	}
+	switch state {
+	case BacktestJobStateRunning:
+		status.Now = job.tm.Now()
+		progress := float64(status.Now.Sub(job.Start)) / float64(job.End.Sub(job.Start))
+		status.Progress = froundn(math.Max(0, math.Min(1, progress)), 4)
+	case BacktestJobStateDone:
+		status.Now = job.End
+		status.Progress = 1
+	case BacktestJobStateCancelled, BacktestJobStateFailed:
+		status.Now = job.tm.Now()
+	}
+	return status
+}
+
+// Forgets the oldest finished jobs, expects q.rw to be held
+func (q *BacktestJobQueue) prune() {
+	finished := []*BacktestJob{}
+	for _, job := range q.jobs {
+		if !job.FinishedAt.IsZero() {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= backtestJobsKept {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].FinishedAt.Before(finished[j].FinishedAt)
+	})
+	for _, job := range finished[:len(finished)-backtestJobsKept] {
+		delete(q.jobs, job.Id)
+	}
+}
+
+// A sweep or walk-forward running in the background
+type OptimizationJob struct {
+	Id         string
+	Kind       string
+	CreatedAt  time.Time
+	FinishedAt time.Time
+	state      BacktestJobState
+	done       int
+	total      int
+	err        string
+	result     interface{}
+	cancel     context.CancelFunc
+}
+
+type OptimizationJobStatus struct {
+	Id         string           `json:"id"`
+	Kind       string           `json:"kind"`
+	CreatedAt  time.Time        `json:"createdAt"`
+	FinishedAt time.Time        `json:"finishedAt"`
+	State      BacktestJobState `json:"state"`
+	Done       int              `json:"done"`
+	Total      int              `json:"total"`
+	Progress   float64          `json:"progress"`
+	Error      string           `json:"error,omitempty"`
+	// The sweep or walk-forward once done
+	Result interface{} `json:"result,omitempty"`
+}
+
+// What an optimization job runs, it reports its runs to onProgress and gives
+// up when ctx is cancelled
+type OptimizationFunc func(ctx context.Context, onProgress func(done, total int)) (interface{}, error)
+
+// Runs sweeps & walk-forwards in the background one at a time, as each one
+// already runs its backtests on every CPU
+type OptimizationJobQueue struct {
+	jobs  map[string]*OptimizationJob
+	slots chan bool
+	rw    sync.Mutex
+}
+
+func NewOptimizationJobQueue() *OptimizationJobQueue {
+	return &OptimizationJobQueue{
+		jobs:  map[string]*OptimizationJob{},
+		slots: make(chan bool, 1),
+	}
+}
+
+func (q *OptimizationJobQueue) Submit(kind string, optimize OptimizationFunc) *OptimizationJob {
+	now := time.Now().In(timeLocation)
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &OptimizationJob{
+		Id:        newPaperRunId(now),
+		Kind:      kind,
+		CreatedAt: now,
+		state:     BacktestJobStateQueued,
+		cancel:    cancel,
+	}
+	q.rw.Lock()
+	q.jobs[job.Id] = job
+	q.prune()
+	q.rw.Unlock()
+
+	go q.run(ctx, job, optimize)
+	return job
+}
+
+func (q *OptimizationJobQueue) run(ctx context.Context, job *OptimizationJob, optimize OptimizationFunc) {
+	q.slots <- true
+	defer func() { <-q.slots }()
+	defer job.cancel()
+
+	q.rw.Lock()
+	if job.state != BacktestJobStateQueued {
+		// Cancelled while waiting for its turn
+		q.rw.Unlock()
+		return
+	}
+	job.state = BacktestJobStateRunning
+	q.rw.Unlock()
+
+	result, err := optimize(ctx, func(done, total int) {
+		q.rw.Lock()
+		job.done, job.total = done, total
+		q.rw.Unlock()
+	})
+
+	q.rw.Lock()
+	defer q.rw.Unlock()
+	switch {
+	case ctx.Err() != nil:
+		job.state = BacktestJobStateCancelled
+	case err != nil:
+		job.state = BacktestJobStateFailed
+		job.err = err.Error()
+	default:
+		job.state = BacktestJobStateDone
+		job.result = result
+	}
+	job.FinishedAt = time.Now().In(timeLocation)
+}
+
+// Cancels a queued job or stops a running one, which then ends cancelled once
+// its backtests are stopped
+func (q *OptimizationJobQueue) Cancel(id string) error {
+	q.rw.Lock()
+	defer q.rw.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return errors.New("optimization job: not found: " + id)
+	}
+	if job.state == BacktestJobStateQueued {
+		job.state = BacktestJobStateCancelled
+		job.FinishedAt = time.Now().In(timeLocation)
+	}
+	job.cancel()
+	return nil
+}
+
+func (q *OptimizationJobQueue) Get(id string) *OptimizationJob {
+	q.rw.Lock()
+	defer q.rw.Unlock()
+	return q.jobs[id]
+}
+
+// Most recent first
+func (q *OptimizationJobQueue) List() []*OptimizationJob {
+	q.rw.Lock()
+	defer q.rw.Unlock()
+	jobs := []*OptimizationJob{}
+	for _, job := range q.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+	})
+	return jobs
+}
+
+// Progress of job, with its sweep or walk-forward once done when withResult
+func (q *OptimizationJobQueue) Status(job *OptimizationJob, withResult bool) *OptimizationJobStatus {
+	q.rw.Lock()
+	defer q.rw.Unlock()
+	status := &OptimizationJobStatus{
+		Id:         job.Id,
+		Kind:       job.Kind,
+		CreatedAt:  job.CreatedAt,
+		FinishedAt: job.FinishedAt,
+		State:      job.state,
+		Done:       job.done,
+		Total:      job.total,
+		Error:      job.err,
+	}
+	if job.total > 0 {
+		status.Progress = froundn(float64(job.done)/float64(job.total), 4)
+	}
+	if job.state == BacktestJobStateDone {
+		status.Progress = 1
+		if withResult {
+			status.Result = job.result
+		}
+	}
+	return status
+}
+
+// Forgets the oldest finished jobs, expects q.rw to be held
+func (q *OptimizationJobQueue) prune() {
+	finished := []*OptimizationJob{}
+	for _, job := range q.jobs {
+		if !job.FinishedAt.IsZero() {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= backtestJobsKept {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].FinishedAt.Before(finished[j].FinishedAt)
+	})
+	for _, job := range finished[:len(finished)-backtestJobsKept] {
+		delete(q.jobs, job.Id)
+	}
+}
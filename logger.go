@@ -21,16 +21,17 @@ type Logger interface {
 
 type FileLogger struct {
 	timeSource  TimeSource
-	baseFolder  string
+	folder      string
 	environment string
 	truncate    bool
 	fileHandles map[string]*os.File
 }
 
-func NewFileLogger(timeSource TimeSource, baseFolder, environment string, truncate bool) *FileLogger {
+// Logs to folder/log.txt, or folder/<date>/log.txt in production
+func NewFileLogger(timeSource TimeSource, folder, environment string, truncate bool) *FileLogger {
 	return &FileLogger{
 		timeSource:  timeSource,
-		baseFolder:  baseFolder,
+		folder:      folder,
 		environment: environment,
 		truncate:    truncate,
 		fileHandles: map[string]*os.File{},
@@ -38,12 +39,8 @@ func NewFileLogger(timeSource TimeSource, baseFolder, environment string, trunca
 }
 
 func (l *FileLogger) Log(level, component, message string, vals ...interface{}) {
-	dateString := l.timeSource.Now().Format("2006-01-02")
 	dateTimeString := l.timeSource.Now().Format("2006-01-02 15:04:05")
-	path := filepath.Join(l.baseFolder, l.environment, dateString, "log.txt")
-	if l.environment != "production" {
-		path = filepath.Join(l.baseFolder, l.environment, "log.txt")
-	}
+	path := runFilePath(l.folder, l.environment, l.timeSource.Now(), "log.txt")
 	fileHandle, err := l.fileHandleFor(path)
 	if err != nil {
 		fmt.Println("file_logger: " + err.Error())
@@ -139,3 +136,20 @@ func (l *ConsoleLogger) LogWarn(component, message string, vals ...interface{})
 func (l *ConsoleLogger) LogError(component, message string, vals ...interface{}) {
 	l.Log("error", component, message, vals...)
 }
+
+// Discards everything, for backtests where thousands of runs would otherwise
+// fight over the same log file
+type NullLogger struct {
+}
+
+func NewNullLogger() *NullLogger {
+	return &NullLogger{}
+}
+
+func (l *NullLogger) LogDebug(component, message string, vals ...interface{}) {}
+
+func (l *NullLogger) LogInfo(component, message string, vals ...interface{}) {}
+
+func (l *NullLogger) LogWarn(component, message string, vals ...interface{}) {}
+
+func (l *NullLogger) LogError(component, message string, vals ...interface{}) {}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -23,6 +24,60 @@ func main() {
 		startServer()
 	}
 
+	if len(os.Args) == 3 && os.Args[1] == "sweep" {
+		loadAllSymbols()
+		spec := &SweepSpec{}
+		if err := readJsonFile(os.Args[2], spec); err != nil {
+			log.Fatalln(err)
+		}
+		sweep, err := runSweep(context.Background(), spec, func(done, total int) {
+			log.Printf("Sweep: %d/%d runs done\n", done, total)
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
+		printSweep(os.Stdout, sweep)
+		log.Printf("Wrote: %s/%s.json\n", sweepsFolder, sweep.Id)
+		return
+	}
+
+	if len(os.Args) == 3 && os.Args[1] == "walk-forward" {
+		loadAllSymbols()
+		spec := &WalkForwardSpec{}
+		if err := readJsonFile(os.Args[2], spec); err != nil {
+			log.Fatalln(err)
+		}
+		wf, err := runWalkForward(context.Background(), spec, func(done, total int) {
+			log.Printf("Walk-forward: %d/%d runs done\n", done, total)
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
+		printWalkForward(os.Stdout, wf)
+		log.Printf("Wrote: %s/%s.json\n", walkForwardsFolder, wf.Id)
+		return
+	}
+
+	if (len(os.Args) == 4 || len(os.Args) == 5) && os.Args[1] == "qt-sim" {
+		loadAllSymbols()
+		day, err := time.ParseInLocation(dateFormat, os.Args[3], timeLocation)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		config := ""
+		if len(os.Args) == 5 {
+			config = os.Args[4]
+		}
+		tm, err := runQTSimulation(os.Args[2], config, day, 25000)
+		if tm != nil {
+			printQTSimulation(os.Stdout, tm)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	if len(os.Args) == 2 && os.Args[1] == "fetch-daily" {
 		allSymbols := loadAllSymbolNames()
 		fetchDailyDetails(allSymbols)
@@ -31,7 +86,13 @@ func main() {
 
 	fmt.Println(`Usage: toreda [command]
 
-  server       Starts trading web server
-  fetch-daily  Downloads daily details for all known symbols
+  server                    Starts trading web server
+  fetch-daily               Downloads daily details for all known symbols
+  sweep <spec.json>         Backtests every combination of strategy params
+  walk-forward <spec.json>  Sweeps on rolling in-sample windows and backtests
+                            the best params on the days that follow
+  qt-sim <strategy> <YYYY-MM-DD> [config]
+                            Runs a strategy for a day like in production,
+                            against a local Questrade API simulator
 `)
 }
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	tradingDaysPerYear    = 252
+	tradingMinutesPerDay  = 390
+	tradingMinutesPerYear = tradingDaysPerYear * tradingMinutesPerDay
+)
+
+// A round-trip, from a flat position back to a flat position in one symbol
+type RunTrade struct {
+	Symbol     string    `json:"symbol"`
+	SymbolId   int       `json:"symbolId"`
+	Side       string    `json:"side"`
+	OpenedAt   time.Time `json:"openedAt"`
+	ClosedAt   time.Time `json:"closedAt"`
+	Quantity   int64     `json:"quantity"`
+	EntryValue float64   `json:"entryValue"`
+	GrossPnL   float64   `json:"grossPnL"`
+	Fees       float64   `json:"fees"`
+	PnL        float64   `json:"pnl"`
+	PnLPercent float64   `json:"pnlPercent"`
+	Executions int       `json:"executions"`
+
+	openQuantity int64
+}
+
+type RunMetrics struct {
+	StartingEquity     float64 `json:"startingEquity"`
+	EndingEquity       float64 `json:"endingEquity"`
+	TotalReturn        float64 `json:"totalReturn"`
+	TotalReturnPercent float64 `json:"totalReturnPercent"`
+
+	TradeCount     int `json:"tradeCount"`
+	WinCount       int `json:"winCount"`
+	LossCount      int `json:"lossCount"`
+	BreakevenCount int `json:"breakevenCount"`
+	// Wins out of the trades won or lost, breakeven ones are left out
+	WinRate      float64 `json:"winRate"`
+	TotalPnL     float64 `json:"totalPnL"`
+	AvgPnL       float64 `json:"avgPnL"`
+	AvgWin       float64 `json:"avgWin"`
+	AvgLoss      float64 `json:"avgLoss"`
+	BestTrade    float64 `json:"bestTrade"`
+	WorstTrade   float64 `json:"worstTrade"`
+	GrossProfit  float64 `json:"grossProfit"`
+	GrossLoss    float64 `json:"grossLoss"`
+	ProfitFactor float64 `json:"profitFactor"`
+	Expectancy   float64 `json:"expectancy"`
+	AvgMinutes   float64 `json:"avgMinutesInTrade"`
+
+	MaxDrawdown         float64   `json:"maxDrawdown"`
+	MaxDrawdownPercent  float64   `json:"maxDrawdownPercent"`
+	MaxDrawdownMinutes  float64   `json:"maxDrawdownMinutes"`
+	MaxDrawdownStart    time.Time `json:"maxDrawdownStart"`
+	MaxDrawdownRecovery time.Time `json:"maxDrawdownRecovery"`
+
+	SharpeMinute  float64 `json:"sharpeMinute"`
+	SortinoMinute float64 `json:"sortinoMinute"`
+	SharpeDaily   float64 `json:"sharpeDaily"`
+	SortinoDaily  float64 `json:"sortinoDaily"`
+
+	ExposurePercent float64 `json:"exposurePercent"`
+
+	Commissions   float64 `json:"commissions"`
+	SecFees       float64 `json:"secFees"`
+	ExecutionFees float64 `json:"executionFees"`
+	TotalFees     float64 `json:"totalFees"`
+
+	Trades []*RunTrade `json:"trades"`
+}
+
+func executionFees(e *BrokerExecution) float64 {
+	return e.Commission + e.SecFee + e.ExecutionFee + e.OrderPlacementCommission
+}
+
+// Groups executions (in chronological order) into round-trip trades, trades
+// still open at the end are left out
+func computeRunTrades(executions []*BrokerExecution) []*RunTrade {
+	trades := []*RunTrade{}
+	openTrades := map[int]*RunTrade{}
+
+	for _, e := range executions {
+		quantity := e.Quantity
+		if OrderAction(e.Side) == OrderActionSell {
+			quantity = -quantity
+		}
+
+		t, ok := openTrades[e.SymbolId]
+		if !ok {
+			side := "Long"
+			if quantity < 0 {
+				side = "Short"
+			}
+			t = &RunTrade{
+				Symbol:   e.Symbol,
+				SymbolId: e.SymbolId,
+				Side:     side,
+				OpenedAt: e.Timestamp,
+			}
+			openTrades[e.SymbolId] = t
+		}
+
+		// Anything past flat (long to short or vice versa) starts a new trade
+		closingQuantity := quantity
+		if t.openQuantity != 0 && sign(t.openQuantity+quantity) == -sign(t.openQuantity) {
+			closingQuantity = -t.openQuantity
+		}
+		price := e.Price
+		if t.openQuantity == 0 || sign(t.openQuantity) == sign(closingQuantity) {
+			t.EntryValue += float64(abs64(closingQuantity)) * price
+		}
+		t.GrossPnL -= float64(closingQuantity) * price
+		t.Fees += executionFees(e)
+		t.Executions++
+		t.openQuantity += closingQuantity
+		t.Quantity = max64(t.Quantity, abs64(t.openQuantity))
+
+		if t.openQuantity == 0 {
+			t.ClosedAt = e.Timestamp
+			t.PnL = t.GrossPnL - t.Fees
+			if t.EntryValue != 0 {
+				t.PnLPercent = t.PnL / t.EntryValue
+			}
+			trades = append(trades, t)
+			delete(openTrades, e.SymbolId)
+
+			if remaining := quantity - closingQuantity; remaining != 0 {
+				side := "Long"
+				if remaining < 0 {
+					side = "Short"
+				}
+				openTrades[e.SymbolId] = &RunTrade{
+					Symbol:       e.Symbol,
+					SymbolId:     e.SymbolId,
+					Side:         side,
+					OpenedAt:     e.Timestamp,
+					Quantity:     abs64(remaining),
+					EntryValue:   float64(abs64(remaining)) * price,
+					GrossPnL:     -float64(remaining) * price,
+					Executions:   1,
+					openQuantity: remaining,
+				}
+			}
+		}
+	}
+
+	return trades
+}
+
+func computeRunMetrics(executions []*BrokerExecution, equity []*EquityPoint) *RunMetrics {
+	return computeTradesMetrics(computeRunTrades(executions), executions, equity)
+}
+
+// Metrics of trades paired up beforehand, executions only count for fees
+func computeTradesMetrics(trades []*RunTrade, executions []*BrokerExecution, equity []*EquityPoint) *RunMetrics {
+	metrics := &RunMetrics{Trades: trades}
+
+	for _, e := range executions {
+		metrics.Commissions += e.Commission + e.OrderPlacementCommission
+		metrics.SecFees += e.SecFee
+		metrics.ExecutionFees += e.ExecutionFee
+	}
+	metrics.TotalFees = metrics.Commissions + metrics.SecFees + metrics.ExecutionFees
+
+	// Trade stats
+	var minutesInTrades float64
+	for i, t := range metrics.Trades {
+		metrics.TotalPnL += t.PnL
+		minutesInTrades += t.ClosedAt.Sub(t.OpenedAt).Minutes()
+		switch {
+		case t.PnL > 0:
+			metrics.WinCount++
+			metrics.GrossProfit += t.PnL
+		case t.PnL < 0:
+			metrics.LossCount++
+			metrics.GrossLoss -= t.PnL
+		default:
+			metrics.BreakevenCount++
+		}
+		if i == 0 || t.PnL > metrics.BestTrade {
+			metrics.BestTrade = t.PnL
+		}
+		if i == 0 || t.PnL < metrics.WorstTrade {
+			metrics.WorstTrade = t.PnL
+		}
+	}
+	metrics.TradeCount = len(metrics.Trades)
+	if metrics.TradeCount > 0 {
+		metrics.AvgPnL = metrics.TotalPnL / float64(metrics.TradeCount)
+		metrics.AvgMinutes = minutesInTrades / float64(metrics.TradeCount)
+	}
+	if decided := metrics.WinCount + metrics.LossCount; decided > 0 {
+		metrics.WinRate = float64(metrics.WinCount) / float64(decided)
+	}
+	if metrics.WinCount > 0 {
+		metrics.AvgWin = metrics.GrossProfit / float64(metrics.WinCount)
+	}
+	if metrics.LossCount > 0 {
+		metrics.AvgLoss = -metrics.GrossLoss / float64(metrics.LossCount)
+	}
+	if metrics.GrossLoss > 0 {
+		metrics.ProfitFactor = metrics.GrossProfit / metrics.GrossLoss
+	}
+	if metrics.TradeCount > 0 {
+		// Breakeven trades add nothing but still count toward every trade
+		trades := float64(metrics.TradeCount)
+		metrics.Expectancy = float64(metrics.WinCount)/trades*metrics.AvgWin +
+			float64(metrics.LossCount)/trades*metrics.AvgLoss
+	}
+
+	if len(equity) == 0 {
+		return metrics
+	}
+
+	// Equity stats
+	metrics.StartingEquity = equity[0].Equity
+	metrics.EndingEquity = equity[len(equity)-1].Equity
+	metrics.TotalReturn = metrics.EndingEquity - metrics.StartingEquity
+	if metrics.StartingEquity != 0 {
+		metrics.TotalReturnPercent = metrics.TotalReturn / metrics.StartingEquity
+	}
+
+	var exposed int
+	for _, p := range equity {
+		if p.MarketValue != 0 {
+			exposed++
+		}
+	}
+	metrics.ExposurePercent = float64(exposed) / float64(len(equity))
+
+	computeDrawdown(metrics, equity)
+
+	minuteReturns := equityReturns(equity)
+	metrics.SharpeMinute = sharpeRatio(minuteReturns, tradingMinutesPerYear)
+	metrics.SortinoMinute = sortinoRatio(minuteReturns, tradingMinutesPerYear)
+
+	dailyReturns := equityReturns(dailyEquity(equity))
+	metrics.SharpeDaily = sharpeRatio(dailyReturns, tradingDaysPerYear)
+	metrics.SortinoDaily = sortinoRatio(dailyReturns, tradingDaysPerYear)
+
+	return metrics
+}
+
+func computeDrawdown(metrics *RunMetrics, equity []*EquityPoint) {
+	peak := equity[0]
+	for _, p := range equity {
+		if p.Equity >= peak.Equity {
+			peak = p
+			continue
+		}
+		drawdown := peak.Equity - p.Equity
+		if drawdown > metrics.MaxDrawdown {
+			metrics.MaxDrawdown = drawdown
+			metrics.MaxDrawdownPercent = drawdown / peak.Equity
+		}
+	}
+
+	// Longest stretch spent under a previous high
+	peak = equity[0]
+	underwater := false
+	for i, p := range equity {
+		if p.Equity < peak.Equity {
+			underwater = true
+			if i < len(equity)-1 {
+				continue
+			}
+		}
+		if minutes := p.Time.Sub(peak.Time).Minutes(); underwater && minutes > metrics.MaxDrawdownMinutes {
+			metrics.MaxDrawdownMinutes = minutes
+			metrics.MaxDrawdownStart = peak.Time
+			metrics.MaxDrawdownRecovery = p.Time
+			if p.Equity < peak.Equity {
+				// Never recovered
+				metrics.MaxDrawdownRecovery = time.Time{}
+			}
+		}
+		if p.Equity >= peak.Equity {
+			peak = p
+			underwater = false
+		}
+	}
+}
+
+// Last equity point of every day
+func dailyEquity(equity []*EquityPoint) []*EquityPoint {
+	days := []*EquityPoint{}
+	for i, p := range equity {
+		if i == len(equity)-1 || p.Time.Format(dateFormat) != equity[i+1].Time.Format(dateFormat) {
+			days = append(days, p)
+		}
+	}
+	return days
+}
+
+func equityReturns(equity []*EquityPoint) []float64 {
+	returns := []float64{}
+	for i := 1; i < len(equity); i++ {
+		if equity[i-1].Equity != 0 {
+			returns = append(returns, equity[i].Equity/equity[i-1].Equity-1)
+		}
+	}
+	return returns
+}
+
+// Annualized, assumes a risk free rate of 0
+func sharpeRatio(returns []float64, periodsPerYear float64) float64 {
+	if len(returns) < 2 {
+		return 0
+	}
+	mean := avg(returns)
+	var variance float64
+	for _, r := range returns {
+		variance += (r - mean) * (r - mean)
+	}
+	stdDev := math.Sqrt(variance / float64(len(returns)-1))
+	if stdDev == 0 {
+		return 0
+	}
+	return mean / stdDev * math.Sqrt(periodsPerYear)
+}
+
+// Like the sharpe ratio but only penalizes downside volatility
+func sortinoRatio(returns []float64, periodsPerYear float64) float64 {
+	if len(returns) < 2 {
+		return 0
+	}
+	var downside float64
+	for _, r := range returns {
+		if r < 0 {
+			downside += r * r
+		}
+	}
+	downsideDev := math.Sqrt(downside / float64(len(returns)))
+	if downsideDev == 0 {
+		return 0
+	}
+	return avg(returns) / downsideDev * math.Sqrt(periodsPerYear)
+}
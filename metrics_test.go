@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var testMetricsStart = time.Date(2020, 1, 3, 10, 0, 0, 0, time.UTC)
+
+// Buy & sell of qty shares, minute minutes into the day
+func testRoundTrip(minute int, qty int64, buyPrice, sellPrice float64) []*BrokerExecution {
+	at := testMetricsStart.Add(time.Duration(minute) * time.Minute)
+	return []*BrokerExecution{
+		{Timestamp: at, SymbolId: testSymbolId, Side: string(OrderActionBuy), Quantity: qty, Price: buyPrice},
+		{Timestamp: at.Add(time.Minute), SymbolId: testSymbolId, Side: string(OrderActionSell), Quantity: qty, Price: sellPrice},
+	}
+}
+
+// One point a minute
+func testEquity(values ...float64) []*EquityPoint {
+	equity := []*EquityPoint{}
+	for i, v := range values {
+		equity = append(equity, &EquityPoint{Time: testMetricsStart.Add(time.Duration(i) * time.Minute), Equity: v})
+	}
+	return equity
+}
+
+func TestComputeRunMetrics(t *testing.T) {
+	var winLossBreakeven []*BrokerExecution
+	winLossBreakeven = append(winLossBreakeven, testRoundTrip(0, 10, 100, 110)...)
+	winLossBreakeven = append(winLossBreakeven, testRoundTrip(2, 10, 100, 95)...)
+	winLossBreakeven = append(winLossBreakeven, testRoundTrip(4, 10, 100, 100)...)
+
+	for _, tt := range []struct {
+		name       string
+		executions []*BrokerExecution
+		equity     []*EquityPoint
+		want       RunMetrics
+	}{
+		{
+			name:       "win, loss & breakeven",
+			executions: winLossBreakeven,
+			want: RunMetrics{
+				TradeCount: 3, WinCount: 1, LossCount: 1, BreakevenCount: 1,
+				WinRate: 0.5, TotalPnL: 50, AvgWin: 100, AvgLoss: -50,
+				GrossProfit: 100, GrossLoss: 50, ProfitFactor: 2, Expectancy: 50.0 / 3,
+			},
+		},
+		{
+			name:       "breakeven only",
+			executions: testRoundTrip(0, 10, 100, 100),
+			want:       RunMetrics{TradeCount: 1, BreakevenCount: 1},
+		},
+		{
+			name:   "drawdown recovered",
+			equity: testEquity(1000, 1100, 990, 1050, 1120),
+			want: RunMetrics{
+				StartingEquity: 1000, EndingEquity: 1120, TotalReturn: 120, TotalReturnPercent: 0.12,
+				MaxDrawdown: 110, MaxDrawdownPercent: 0.1, MaxDrawdownMinutes: 3,
+				MaxDrawdownStart:    testMetricsStart.Add(time.Minute),
+				MaxDrawdownRecovery: testMetricsStart.Add(4 * time.Minute),
+			},
+		},
+		{
+			name:   "drawdown never recovered",
+			equity: testEquity(1000, 900, 950),
+			want: RunMetrics{
+				StartingEquity: 1000, EndingEquity: 950, TotalReturn: -50, TotalReturnPercent: -0.05,
+				MaxDrawdown: 100, MaxDrawdownPercent: 0.1, MaxDrawdownMinutes: 2,
+				MaxDrawdownStart: testMetricsStart,
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := computeRunMetrics(tt.executions, tt.equity)
+			for _, c := range []struct {
+				field     string
+				got, want float64
+			}{
+				{"tradeCount", float64(got.TradeCount), float64(tt.want.TradeCount)},
+				{"winCount", float64(got.WinCount), float64(tt.want.WinCount)},
+				{"lossCount", float64(got.LossCount), float64(tt.want.LossCount)},
+				{"breakevenCount", float64(got.BreakevenCount), float64(tt.want.BreakevenCount)},
+				{"winRate", got.WinRate, tt.want.WinRate},
+				{"totalPnL", got.TotalPnL, tt.want.TotalPnL},
+				{"avgWin", got.AvgWin, tt.want.AvgWin},
+				{"avgLoss", got.AvgLoss, tt.want.AvgLoss},
+				{"grossProfit", got.GrossProfit, tt.want.GrossProfit},
+				{"grossLoss", got.GrossLoss, tt.want.GrossLoss},
+				{"profitFactor", got.ProfitFactor, tt.want.ProfitFactor},
+				{"expectancy", got.Expectancy, tt.want.Expectancy},
+				{"startingEquity", got.StartingEquity, tt.want.StartingEquity},
+				{"endingEquity", got.EndingEquity, tt.want.EndingEquity},
+				{"totalReturn", got.TotalReturn, tt.want.TotalReturn},
+				{"totalReturnPercent", got.TotalReturnPercent, tt.want.TotalReturnPercent},
+				{"maxDrawdown", got.MaxDrawdown, tt.want.MaxDrawdown},
+				{"maxDrawdownPercent", got.MaxDrawdownPercent, tt.want.MaxDrawdownPercent},
+				{"maxDrawdownMinutes", got.MaxDrawdownMinutes, tt.want.MaxDrawdownMinutes},
+			} {
+				if math.Abs(c.got-c.want) > 1e-9 {
+					t.Errorf("%s is %v, want %v", c.field, c.got, c.want)
+				}
+			}
+			if !got.MaxDrawdownStart.Equal(tt.want.MaxDrawdownStart) {
+				t.Errorf("drawdown started %s, want %s", got.MaxDrawdownStart, tt.want.MaxDrawdownStart)
+			}
+			if !got.MaxDrawdownRecovery.Equal(tt.want.MaxDrawdownRecovery) {
+				t.Errorf("drawdown recovered %s, want %s", got.MaxDrawdownRecovery, tt.want.MaxDrawdownRecovery)
+			}
+		})
+	}
+}
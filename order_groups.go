@@ -0,0 +1,366 @@
+package main
+
+import "errors"
+
+// Brokers able to keep the orders of a group from over-filling between two
+// OrderManager updates (the PaperBroker fills stops & limits candle by candle)
+type OCOBroker interface {
+	// Every fill of one of orderIds takes its quantity out of the quantity the
+	// others can still fill, capping or cancelling them
+	LinkOrders(quantity int64, orderIds ...int)
+}
+
+// Exit order of an OrderGroup, resized as the position it exits changes
+type OrderGroupLeg struct {
+	Type  OrderType
+	Price float64
+	// Shares exited by the leg, all of the position when 0
+	Quantity int64
+	// Makes a stop leg trail the best price, Price follows it
+	Trail *Trail
+	best  float64
+	// Orders placed for the leg, all but the last one got replaced
+	orders []*BrokerOrder
+	// Cancelled or rejected outside of the group
+	dropped bool
+}
+
+func (leg *OrderGroupLeg) filled() int64 {
+	var filled int64
+	for _, o := range leg.orders {
+		filled += o.FilledQuantity
+	}
+	return filled
+}
+
+func (leg *OrderGroupLeg) last() *BrokerOrder {
+	if len(leg.orders) == 0 {
+		return nil
+	}
+	return leg.orders[len(leg.orders)-1]
+}
+
+// One-cancels-other exit orders of a position, with the order entering it for
+// brackets. Legs get placed once there are shares to exit, filling one
+// shrinks (or cancels) the others to what's left of the position, and they
+// all get cancelled once the position is exited some other way.
+type OrderGroup struct {
+	Id       int
+	SymbolId int
+	// Side of the position, legs take the other one
+	Action OrderAction
+	Entry  *BrokerOrder
+	// Shares exited by groups without an entry
+	Quantity int64
+	Legs     []*OrderGroupLeg
+	Done     bool
+	// Legs were placed before the last update, positions can be trusted to
+	// include the shares they exit
+	armed bool
+}
+
+type BracketOrder struct {
+	SymbolId int
+	// Buy to go long, Sell to go short
+	Action   OrderAction
+	Quantity int64
+	// Market when empty
+	EntryType       OrderType
+	EntryPrice      float64
+	StopPrice       float64
+	TakeProfitPrice float64
+	// Shares taken profit on, all of them when 0
+	TakeProfitQuantity int64
+	// Trails the stop instead of leaving it at StopPrice
+	Trail *Trail
+}
+
+func (g *OrderGroup) exitAction() OrderAction {
+	if g.Action == OrderActionBuy {
+		return OrderActionSell
+	}
+	return OrderActionBuy
+}
+
+// Places the entry of bo, its stop-loss & take-profit (either can be left
+// at 0) follow as it fills
+func (om *OrderManager) PlaceBracket(bo BracketOrder) (*OrderGroup, error) {
+	if bo.Quantity <= 0 {
+		return nil, errors.New("bracket order: quantity must be positive")
+	}
+	if bo.StopPrice == 0 && bo.TakeProfitPrice == 0 && bo.Trail == nil {
+		return nil, errors.New("bracket order: needs a stop, a trail or a take profit price")
+	}
+	if bo.Trail != nil {
+		if err := bo.Trail.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if bo.EntryType == "" {
+		bo.EntryType = OrderTypeMarket
+	}
+	entry, err := om.broker.CreateOrder(bo.SymbolId, bo.Action, bo.EntryType, bo.EntryPrice, bo.Quantity)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, errors.New("bracket order: entry order wasn't created")
+	}
+
+	g := om.newGroup(bo.SymbolId, bo.Action)
+	g.Entry = entry
+	if bo.StopPrice != 0 || bo.Trail != nil {
+		g.Legs = append(g.Legs, &OrderGroupLeg{Type: OrderTypeStop, Price: bo.StopPrice, Trail: bo.Trail})
+	}
+	if bo.TakeProfitPrice != 0 {
+		g.Legs = append(g.Legs, &OrderGroupLeg{
+			Type: OrderTypeLimit, Price: bo.TakeProfitPrice, Quantity: bo.TakeProfitQuantity,
+		})
+	}
+	return g, om.syncGroup(g)
+}
+
+// Exits quantity shares (negative for a short) of the position in symId with
+// the first of legs to fill, legs get placed as the position reaches quantity
+func (om *OrderManager) PlaceOCO(symId int, quantity int64, legs ...*OrderGroupLeg) (*OrderGroup, error) {
+	if quantity == 0 {
+		return nil, errors.New("oco order: quantity can't be 0")
+	}
+	if len(legs) == 0 {
+		return nil, errors.New("oco order: needs at least one leg")
+	}
+	action := OrderActionBuy
+	if quantity < 0 {
+		action = OrderActionSell
+	}
+	g := om.newGroup(symId, action)
+	g.Quantity = abs64(quantity)
+	g.Legs = legs
+	return g, om.syncGroup(g)
+}
+
+func (om *OrderManager) newGroup(symId int, action OrderAction) *OrderGroup {
+	om.lastGroupId++
+	g := &OrderGroup{
+		Id:       om.lastGroupId,
+		SymbolId: symId,
+		Action:   action,
+	}
+	om.groups = append(om.groups, g)
+	return g
+}
+
+// Cancels the pending orders of g, shares already bought or sold stay as is
+func (om *OrderManager) CancelGroup(g *OrderGroup) error {
+	if g.Done {
+		return nil
+	}
+	g.Done = true
+	if g.Entry != nil && g.Entry.IsPending() {
+		if err := om.broker.CancelOrder(g.Entry.Id); err != nil {
+			return err
+		}
+	}
+	return om.cancelLegs(g)
+}
+
+func (om *OrderManager) cancelLegs(g *OrderGroup) error {
+	for _, leg := range g.Legs {
+		if last := leg.last(); last != nil && last.IsPending() {
+			if err := om.broker.CancelOrder(last.Id); err != nil && !om.orderDone(last) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Whether o filled or got cancelled since orders were last fetched, which
+// makes cancelling or replacing it fail. Orders get fetched again to tell.
+func (om *OrderManager) orderDone(o *BrokerOrder) bool {
+	orders, err := om.broker.Orders()
+	if err != nil {
+		return false
+	}
+	for _, latest := range orders {
+		if latest.Id == o.Id {
+			return !latest.IsPending()
+		}
+	}
+	return false
+}
+
+// Groups not done yet
+func (om *OrderManager) Groups() []*OrderGroup {
+	groups := []*OrderGroup{}
+	for _, g := range om.groups {
+		if !g.Done {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// Brings order groups in line with the orders & positions last fetched from
+// the broker
+func (om *OrderManager) updateGroups() error {
+	groups := []*OrderGroup{}
+	for _, g := range om.groups {
+		if err := om.syncGroup(g); err != nil {
+			return err
+		}
+		for _, leg := range g.Legs {
+			if leg.last() != nil {
+				g.armed = true
+			}
+		}
+		if !g.Done {
+			groups = append(groups, g)
+		}
+	}
+	om.groups = groups
+	return nil
+}
+
+func (om *OrderManager) syncGroup(g *OrderGroup) error {
+	if g.Done {
+		return nil
+	}
+
+	// Broker orders get refetched as new structs every tick
+	orders := map[int]*BrokerOrder{}
+	for _, o := range om.broker.LastOrders() {
+		orders[o.Id] = o
+	}
+	refresh := func(o *BrokerOrder) *BrokerOrder {
+		if latest, ok := orders[o.Id]; ok {
+			return latest
+		}
+		return o
+	}
+	var legsFilled int64
+	for _, leg := range g.Legs {
+		for i, o := range leg.orders {
+			leg.orders[i] = refresh(o)
+		}
+		// Follow orders replaced outside of the group (e.g. MoveAllStops)
+		for last := leg.last(); last != nil && om.replacements[last.Id] != nil; last = leg.last() {
+			last = refresh(om.replacements[last.Id])
+			leg.orders = append(leg.orders, last)
+			if leg.Trail == nil {
+				leg.Price = last.StopPrice
+				if leg.Type == OrderTypeLimit {
+					leg.Price = last.LimitPrice
+				}
+			}
+		}
+		legsFilled += leg.filled()
+	}
+
+	// Shares of the position on the group's side, exited some other way
+	// (e.g. with Ensure) when they go under what the group expects
+	currentPosition := om.CurrentPositionFor(g.SymbolId)
+	position := currentPosition.OpenQuantity
+	if g.Action == OrderActionSell {
+		position = -position
+	}
+	var remaining int64
+	var waiting bool
+	if g.Entry != nil {
+		g.Entry = refresh(g.Entry)
+		remaining = g.Entry.FilledQuantity - legsFilled
+		if g.armed {
+			remaining = min64(remaining, max64(position, 0))
+		}
+		waiting = g.Entry.IsPending()
+	} else {
+		remaining = min64(g.Quantity-legsFilled, max64(position, 0))
+		waiting = !g.armed
+	}
+	if remaining <= 0 && !waiting {
+		g.Done = true
+		return om.cancelLegs(g)
+	}
+
+	placed := false
+	dropped := 0
+	for _, leg := range g.Legs {
+		desired := remaining
+		if leg.Quantity > 0 {
+			desired = min64(desired, leg.Quantity-leg.filled())
+		}
+		if leg.Trail != nil && !leg.dropped {
+			if err := om.trailLeg(g, leg, currentPosition.CurrentPrice); err != nil {
+				return err
+			}
+		}
+		last := leg.last()
+		if last != nil && last.IsPending() {
+			if last.OpenQuantity == desired {
+				continue
+			}
+			// Orders filled or cancelled since they were fetched are refetched,
+			// the group gets synced again with them
+			if desired > 0 {
+				o, err := om.ReplaceOrder(last, leg.Price, desired)
+				if err != nil {
+					if om.orderDone(last) {
+						return om.syncGroup(g)
+					}
+					return err
+				}
+				leg.orders = append(leg.orders, o)
+				continue
+			}
+			if err := om.broker.CancelOrder(last.Id); err != nil {
+				if om.orderDone(last) {
+					return om.syncGroup(g)
+				}
+				return err
+			}
+		} else if leg.dropped || last != nil && last.State != OrderStateExecuted {
+			leg.dropped = true
+			dropped++
+			continue
+		}
+		if desired <= 0 {
+			continue
+		}
+		var o *BrokerOrder
+		var err error
+		if trailingStopBroker, ok := om.broker.(TrailingStopBroker); ok && leg.Trail != nil {
+			o, err = trailingStopBroker.CreateTrailingStop(g.SymbolId, g.exitAction(), *leg.Trail, leg.best, desired)
+		} else if leg.Trail != nil && leg.best == 0 {
+			// No price to trail yet
+			continue
+		} else {
+			o, err = om.broker.CreateOrder(g.SymbolId, g.exitAction(), leg.Type, leg.Price, desired)
+		}
+		if err != nil {
+			return err
+		}
+		if o == nil {
+			return errors.New("order group: leg order wasn't created")
+		}
+		leg.orders = append(leg.orders, o)
+		placed = true
+	}
+	if dropped == len(g.Legs) && !waiting {
+		g.Done = true
+		return nil
+	}
+
+	if ocoBroker, ok := om.broker.(OCOBroker); ok && placed {
+		// Orders being replaced still work until their replacement takes over
+		ids := []int{}
+		for _, leg := range g.Legs {
+			for _, o := range leg.orders {
+				if o.IsPending() {
+					ids = append(ids, o.Id)
+				}
+			}
+		}
+		ocoBroker.LinkOrders(remaining, ids...)
+	}
+	return nil
+}
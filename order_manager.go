@@ -1,11 +1,33 @@
 package main
 
-import "time"
+import (
+	"errors"
+	"math"
+	"sort"
+)
 
 type OrderManager struct {
-	broker  Broker
-	logger  Logger
-	targets map[int]int64
+	broker      Broker
+	logger      Logger
+	targets     map[int]int64
+	plans       map[int]*ensurePlan
+	groups      []*OrderGroup
+	lastGroupId int
+	// Orders replacing others, by the id of the order they replace
+	replacements map[int]*BrokerOrder
+	// Number of Update calls, one per tick
+	ticks int
+}
+
+// Market orders Ensure placed for a symbol. Orders are fetched after
+// positions, so until the tick after the one the orders were all seen done
+// in, positions might not include their fills and the plan is trusted instead.
+// Update drops the plan after that and Ensure goes by positions again.
+type ensurePlan struct {
+	// Position the fills of orders add to
+	base     int64
+	orders   []*BrokerOrder
+	doneTick int
 }
 
 func NewOrderManager(broker Broker, logger Logger) *OrderManager {
@@ -13,33 +35,151 @@ func NewOrderManager(broker Broker, logger Logger) *OrderManager {
 		broker:  broker,
 		logger:  logger,
 		targets: map[int]int64{},
+		plans:   map[int]*ensurePlan{},
+		groups:  []*OrderGroup{},
+
+		replacements: map[int]*BrokerOrder{},
 	}
 }
 
+// Brought up to date with what the broker last reported, once per tick before
+// the strategy runs
+func (om *OrderManager) Update() error {
+	om.ticks++
+	om.updatePlans()
+	return om.updateGroups()
+}
+
+// Marks the plans whose orders are all done as of this tick and drops the ones
+// done on an earlier tick, positions fetched since then include their fills
+func (om *OrderManager) updatePlans() {
+	latest := map[int]*BrokerOrder{}
+	for _, o := range om.broker.LastOrders() {
+		latest[o.Id] = o
+	}
+	for symId, plan := range om.plans {
+		done := true
+		for i, o := range plan.orders {
+			if o, ok := latest[o.Id]; ok {
+				plan.orders[i] = o
+			}
+			if plan.orders[i].IsPending() {
+				done = false
+			}
+		}
+		switch {
+		case len(plan.orders) == 0 || done && plan.doneTick != 0:
+			delete(om.plans, symId)
+		case done:
+			plan.doneTick = om.ticks
+		}
+	}
+}
+
+// Brings the position in symId to qty shares, negative for a short. The
+// position counts the pending market orders, the ones going past qty or the
+// wrong way get cancelled and the rest is topped up, so calling it again
+// with the same qty before its orders fill doesn't trade any more.
 func (om *OrderManager) Ensure(symId int, qty int64) error {
 	// Save target so we know what we want to achieve when orders get cancelled
 	om.targets[symId] = qty
 
-	// TODO looking at positions is not enough to determine the current state of
-	// things, we need to also looks at pending orders
-	positions := om.broker.LastPositions()
+	latest := map[int]*BrokerOrder{}
+	pending := map[int]*BrokerOrder{}
+	for _, o := range om.broker.LastOrders() {
+		latest[o.Id] = o
+		if o.SymbolId == symId && o.Type == OrderTypeMarket && o.IsPending() {
+			pending[o.Id] = o
+		}
+	}
 
-	var positionQty int64
-	for _, p := range positions {
-		if p.SymbolId == symId {
-			positionQty = p.OpenQuantity
+	position := om.CurrentPositionFor(symId).OpenQuantity
+	if plan, ok := om.plans[symId]; ok {
+		// Positions might not include the fills of the plan yet, Update drops
+		// it once they do
+		position = plan.base
+		for i, o := range plan.orders {
+			if o, ok := latest[o.Id]; ok {
+				plan.orders[i] = o
+			}
+			o = plan.orders[i]
+			position += signedQuantity(o, o.FilledQuantity)
+			if o.IsPending() {
+				// Orders placed this tick aren't in LastOrders yet
+				pending[o.Id] = o
+			}
 		}
 	}
 
-	if positionQty > qty {
-		_, err := om.broker.CreateOrder(symId, OrderActionSell, OrderTypeMarket, 0, positionQty-qty)
-		return err
+	var pendingQty int64
+	for _, o := range pending {
+		pendingQty += signedQuantity(o, o.OpenQuantity)
 	}
-	if positionQty < qty {
-		_, err := om.broker.CreateOrder(symId, OrderActionBuy, OrderTypeMarket, 0, qty-positionQty)
-		return err
+	if position+pendingQty == qty {
+		return nil
 	}
-	return nil
+
+	// Oldest pending orders are kept as long as they go toward qty without
+	// going past it, the others get cancelled
+	ids := []int{}
+	for id := range pending {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	kept := []*BrokerOrder{}
+	toGo := qty - position
+	pendingQty = 0
+	for _, id := range ids {
+		o := pending[id]
+		signed := signedQuantity(o, o.OpenQuantity)
+		if sign(signed) == sign(toGo) && abs64(pendingQty+signed) <= abs64(toGo) {
+			kept = append(kept, o)
+			pendingQty += signed
+			continue
+		}
+		if err := om.broker.CancelOrder(o.Id); err != nil {
+			return err
+		}
+	}
+
+	plan := &ensurePlan{base: position, orders: kept}
+	for _, o := range kept {
+		plan.base -= signedQuantity(o, o.FilledQuantity)
+	}
+	om.plans[symId] = plan
+
+	// Going from long to short or back is done in two orders, one closing the
+	// position and one opening the new one, as brokers won't flip in one
+	from := position + pendingQty
+	if from != 0 && qty != 0 && sign(from) != sign(qty) {
+		if err := om.order(plan, symId, from, 0); err != nil {
+			return err
+		}
+		from = 0
+	}
+	return om.order(plan, symId, from, qty)
+}
+
+func signedQuantity(o *BrokerOrder, quantity int64) int64 {
+	if OrderAction(o.Side) == OrderActionSell {
+		return -quantity
+	}
+	return quantity
+}
+
+// Market order of plan moving a position from qty to target shares
+func (om *OrderManager) order(plan *ensurePlan, symId int, qty, target int64) error {
+	var o *BrokerOrder
+	var err error
+	if qty > target {
+		o, err = om.broker.CreateOrder(symId, OrderActionSell, OrderTypeMarket, 0, qty-target)
+	} else if qty < target {
+		o, err = om.broker.CreateOrder(symId, OrderActionBuy, OrderTypeMarket, 0, target-qty)
+	}
+	if o != nil {
+		plan.orders = append(plan.orders, o)
+	}
+	return err
 }
 
 func (om *OrderManager) CancelPendingOrders() error {
@@ -57,7 +197,7 @@ func (om *OrderManager) CancelPendingOrders() error {
 func (om *OrderManager) CancelAllStops(symId int) error {
 	orders := om.broker.LastOrders()
 	for _, o := range orders {
-		if o.SymbolId == symId && o.Type == OrderTypeStop && o.State == "Accepted" {
+		if o.SymbolId == symId && o.Type == OrderTypeStop && o.IsPending() {
 			if err := om.broker.CancelOrder(o.Id); err != nil {
 				return err
 			}
@@ -69,7 +209,7 @@ func (om *OrderManager) CancelAllStops(symId int) error {
 func (om *OrderManager) CancelAllLimits(symId int) error {
 	orders := om.broker.LastOrders()
 	for _, o := range orders {
-		if o.SymbolId == symId && o.Type == OrderTypeLimit && o.State == "Accepted" {
+		if o.SymbolId == symId && o.Type == OrderTypeLimit && o.IsPending() {
 			if err := om.broker.CancelOrder(o.Id); err != nil {
 				return err
 			}
@@ -78,6 +218,52 @@ func (om *OrderManager) CancelAllLimits(symId int) error {
 	return nil
 }
 
+// Replaces o with an order for quantity shares at price, order groups follow
+// their orders to the ones replacing them
+func (om *OrderManager) ReplaceOrder(o *BrokerOrder, price float64, quantity int64) (*BrokerOrder, error) {
+	replacement, err := om.broker.ReplaceOrder(o.Id, price, quantity)
+	if err != nil {
+		return nil, err
+	}
+	if replacement == nil {
+		return nil, errors.New("replace order: replacement order wasn't created")
+	}
+	om.replacements[o.Id] = replacement
+	return replacement, nil
+}
+
+// Moves the pending stop orders of symId to stopPrice
+func (om *OrderManager) MoveAllStops(symId int, stopPrice float64) error {
+	return om.moveAll(symId, OrderTypeStop, stopPrice)
+}
+
+// Moves the pending limit orders of symId to limitPrice
+func (om *OrderManager) MoveAllLimits(symId int, limitPrice float64) error {
+	return om.moveAll(symId, OrderTypeLimit, limitPrice)
+}
+
+func (om *OrderManager) moveAll(symId int, typ OrderType, price float64) error {
+	for _, o := range om.broker.LastOrders() {
+		if o.SymbolId != symId || o.Type != typ || !o.IsPending() || o.State == OrderStateReplacePending {
+			continue
+		}
+		if _, ok := om.replacements[o.Id]; ok {
+			continue
+		}
+		orderPrice := o.StopPrice
+		if typ == OrderTypeLimit {
+			orderPrice = o.LimitPrice
+		}
+		if math.Abs(orderPrice-price) < 0.005 {
+			continue
+		}
+		if _, err := om.ReplaceOrder(o, price, o.OpenQuantity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (om *OrderManager) CurrentPositionFor(symId int) *BrokerPosition {
 	positions := om.broker.LastPositions()
 
@@ -98,8 +284,10 @@ func (om *OrderManager) CurrentPositionFor(symId int) *BrokerPosition {
 	return position
 }
 
+// Copy of the position in symbolId with the open shares of pending buys
+// added, the broker's own position is left alone
 func (om *OrderManager) CurrentPositionForIncludingPending(symbolId int) *BrokerPosition {
-	position := om.CurrentPositionFor(symbolId)
+	position := *om.CurrentPositionFor(symbolId)
 	for _, order := range om.broker.LastOrders() {
 		if order.SymbolId == symbolId &&
 			order.Side == string(OrderActionBuy) &&
@@ -107,18 +295,30 @@ func (om *OrderManager) CurrentPositionForIncludingPending(symbolId int) *Broker
 			position.OpenQuantity += order.OpenQuantity
 		}
 	}
-	return position
+	return &position
 }
 
+// Buys quantity shares with a sell stop protecting them, placed once they're
+// bought
 func (om *OrderManager) Buy(symId int, quantity int64, stop float64) error {
-	_, err := om.broker.CreateOrder(symId, OrderActionBuy, OrderTypeMarket, 0, quantity)
-	if err != nil {
-		return err
-	}
-	// TODO remove
-	// Give QT some time to process the fact we now have a position?
-	time.Sleep(15 * time.Millisecond)
-	_, err = om.broker.CreateOrder(symId, OrderActionSell, OrderTypeStop, stop, quantity)
+	_, err := om.PlaceBracket(BracketOrder{
+		SymbolId:  symId,
+		Action:    OrderActionBuy,
+		Quantity:  quantity,
+		StopPrice: stop,
+	})
+	return err
+}
+
+// Sells short quantity shares with a buy stop protecting them, placed once
+// they're sold
+func (om *OrderManager) Short(symId int, quantity int64, stop float64) error {
+	_, err := om.PlaceBracket(BracketOrder{
+		SymbolId:  symId,
+		Action:    OrderActionSell,
+		Quantity:  quantity,
+		StopPrice: stop,
+	})
 	return err
 }
 
@@ -139,3 +339,22 @@ func (om *OrderManager) SellAll(symId int) error {
 	_, err := om.broker.CreateOrder(symId, OrderActionSell, OrderTypeMarket, 0, position.OpenQuantity)
 	return err
 }
+
+// Buys back a whole short position all while cancelling any stop or limit on
+// them
+func (om *OrderManager) CoverAll(symId int) error {
+	position := om.CurrentPositionFor(symId)
+	if position.OpenQuantity >= 0 {
+		// Nothing to do
+		return nil
+	}
+
+	if err := om.CancelAllStops(symId); err != nil {
+		return err
+	}
+	if err := om.CancelAllLimits(symId); err != nil {
+		return err
+	}
+	_, err := om.broker.CreateOrder(symId, OrderActionBuy, OrderTypeMarket, 0, -position.OpenQuantity)
+	return err
+}
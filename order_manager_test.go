@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Broker whose orders only fill when the test says so and which, like
+// Questrade, only reports positions & orders as of when they were last fetched
+type scriptedBroker struct {
+	orders    []*BrokerOrder
+	positions map[int]int64
+	cancelled []int
+
+	lastOrders    []*BrokerOrder
+	lastPositions []*BrokerPosition
+}
+
+func newScriptedBroker() *scriptedBroker {
+	return &scriptedBroker{positions: map[int]int64{}}
+}
+
+func (b *scriptedBroker) CreateOrder(symId int, action OrderAction, typ OrderType, limitOrStopPrice float64, qty int64) (*BrokerOrder, error) {
+	o := &BrokerOrder{
+		Id:            len(b.orders) + 1,
+		SymbolId:      symId,
+		TotalQuantity: qty,
+		OpenQuantity:  qty,
+		Side:          string(action),
+		Type:          typ,
+		State:         OrderStateAccepted,
+	}
+	b.orders = append(b.orders, o)
+	copied := *o
+	return &copied, nil
+}
+
+func (b *scriptedBroker) CancelOrder(orderId int) error {
+	o := b.order(orderId)
+	if o == nil || !o.IsPending() {
+		return errors.New("cancel order: no pending order with that id")
+	}
+	o.CanceledQuantity = o.OpenQuantity
+	o.OpenQuantity = 0
+	o.State = OrderStateCanceled
+	b.cancelled = append(b.cancelled, orderId)
+	return nil
+}
+
+func (b *scriptedBroker) ReplaceOrder(orderId int, limitOrStopPrice float64, qty int64) (*BrokerOrder, error) {
+	return nil, errors.New("replace order: not supported")
+}
+
+func (b *scriptedBroker) Balance() (*BrokerBalance, error) {
+	return &BrokerBalance{}, nil
+}
+
+func (b *scriptedBroker) Positions() ([]*BrokerPosition, error) {
+	b.lastPositions = []*BrokerPosition{}
+	for symId, qty := range b.positions {
+		if qty != 0 {
+			b.lastPositions = append(b.lastPositions, &BrokerPosition{SymbolId: symId, OpenQuantity: qty})
+		}
+	}
+	return b.lastPositions, nil
+}
+
+func (b *scriptedBroker) Executions() ([]*BrokerExecution, error) {
+	return []*BrokerExecution{}, nil
+}
+
+func (b *scriptedBroker) Orders() ([]*BrokerOrder, error) {
+	b.lastOrders = []*BrokerOrder{}
+	for _, o := range b.orders {
+		copied := *o
+		b.lastOrders = append(b.lastOrders, &copied)
+	}
+	return b.lastOrders, nil
+}
+
+func (b *scriptedBroker) LastBalance() *BrokerBalance {
+	return &BrokerBalance{}
+}
+
+func (b *scriptedBroker) LastPositions() []*BrokerPosition {
+	return b.lastPositions
+}
+
+func (b *scriptedBroker) LastExecutions() []*BrokerExecution {
+	return []*BrokerExecution{}
+}
+
+func (b *scriptedBroker) LastOrders() []*BrokerOrder {
+	return b.lastOrders
+}
+
+func (b *scriptedBroker) order(id int) *BrokerOrder {
+	for _, o := range b.orders {
+		if o.Id == id {
+			return o
+		}
+	}
+	return nil
+}
+
+// Fills qty shares of order id
+func (b *scriptedBroker) fill(id int, qty int64) {
+	o := b.order(id)
+	o.FilledQuantity += qty
+	o.OpenQuantity -= qty
+	o.State = OrderStatePartial
+	if o.OpenQuantity == 0 {
+		o.State = OrderStateExecuted
+	}
+	b.positions[o.SymbolId] += signedQuantity(o, qty)
+}
+
+// Fetches positions then orders and updates om like a trading manager tick,
+// between runs in between the two fetches when not nil
+func (b *scriptedBroker) tick(t *testing.T, om *OrderManager, between func()) {
+	t.Helper()
+	b.Positions()
+	if between != nil {
+		between()
+	}
+	b.Orders()
+	if err := om.Update(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ensure(t *testing.T, om *OrderManager, qty int64) {
+	t.Helper()
+	if err := om.Ensure(testSymbolId, qty); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Checks the orders placed since the first one numbered from, as signed
+// quantities
+func assertOrders(t *testing.T, b *scriptedBroker, from int, want ...int64) {
+	t.Helper()
+	got := []int64{}
+	for _, o := range b.orders[from-1:] {
+		got = append(got, signedQuantity(o, o.TotalQuantity))
+	}
+	if len(got) != len(want) {
+		t.Fatalf("orders from #%d are %v, want %v", from, got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("orders from #%d are %v, want %v", from, got, want)
+		}
+	}
+}
+
+func TestEnsureSameTargetTradesOnce(t *testing.T) {
+	b := newScriptedBroker()
+	om := NewOrderManager(b, NewNullLogger())
+	b.tick(t, om, nil)
+
+	ensure(t, om, 100)
+	ensure(t, om, 100)
+	assertOrders(t, b, 1, 100)
+
+	// Still pending
+	b.tick(t, om, nil)
+	ensure(t, om, 100)
+	// Filled after positions were fetched, they don't show it yet
+	b.tick(t, om, func() { b.fill(1, 100) })
+	ensure(t, om, 100)
+	b.tick(t, om, nil)
+	ensure(t, om, 100)
+	assertOrders(t, b, 1, 100)
+}
+
+func TestEnsurePartialFill(t *testing.T) {
+	b := newScriptedBroker()
+	om := NewOrderManager(b, NewNullLogger())
+	b.tick(t, om, nil)
+
+	ensure(t, om, 100)
+	b.fill(1, 40)
+	b.tick(t, om, nil)
+	ensure(t, om, 100)
+	assertOrders(t, b, 1, 100)
+
+	// The 60 shares left would go past 50
+	ensure(t, om, 50)
+	if len(b.cancelled) != 1 || b.cancelled[0] != 1 {
+		t.Fatalf("cancelled %v, want the partially filled order", b.cancelled)
+	}
+	assertOrders(t, b, 2, 10)
+
+	b.tick(t, om, func() { b.fill(2, 10) })
+	ensure(t, om, 50)
+	b.tick(t, om, nil)
+	ensure(t, om, 50)
+	assertOrders(t, b, 2, 10)
+	if b.positions[testSymbolId] != 50 {
+		t.Errorf("position is %d, want 50", b.positions[testSymbolId])
+	}
+}
+
+func TestEnsureFlipsLongToShort(t *testing.T) {
+	b := newScriptedBroker()
+	b.positions[testSymbolId] = 100
+	om := NewOrderManager(b, NewNullLogger())
+	b.tick(t, om, nil)
+
+	ensure(t, om, -50)
+	ensure(t, om, -50)
+	assertOrders(t, b, 1, -100, -50)
+
+	b.tick(t, om, func() {
+		b.fill(1, 100)
+		b.fill(2, 50)
+	})
+	ensure(t, om, -50)
+	b.tick(t, om, nil)
+	ensure(t, om, -50)
+	assertOrders(t, b, 1, -100, -50)
+	if b.positions[testSymbolId] != -50 {
+		t.Errorf("position is %d, want -50", b.positions[testSymbolId])
+	}
+}
+
+// A position closed by something else than Ensure, like a stop, after the
+// orders of Ensure filled without Ensure being called again
+func TestEnsureAfterExternalClose(t *testing.T) {
+	b := newScriptedBroker()
+	om := NewOrderManager(b, NewNullLogger())
+	b.tick(t, om, nil)
+
+	ensure(t, om, 100)
+	b.tick(t, om, func() { b.fill(1, 100) })
+	b.tick(t, om, nil)
+
+	stop, _ := b.CreateOrder(testSymbolId, OrderActionSell, OrderTypeStop, 95, 100)
+	b.fill(stop.Id, 100)
+	b.tick(t, om, nil)
+
+	ensure(t, om, 100)
+	assertOrders(t, b, 3, 100)
+}
+
+// A market order capped by the volume of candles fills over several ticks,
+// its open shares count toward the position without changing the broker's
+func TestCurrentPositionIncludingPendingLeavesPositionAlone(t *testing.T) {
+	tm, b := newTestPaperBroker(t)
+	// 10 of the 1000000 shares traded every minute
+	b.config.MaxVolumePercent = 0.001
+	om := NewOrderManager(b, NewNullLogger())
+	if _, err := b.CreateOrder(testSymbolId, OrderActionBuy, OrderTypeMarket, 0, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	for tick, filled := range []int64{10, 20} {
+		if tick > 0 {
+			tm.now = tm.now.Add(time.Minute)
+			if err := b.CheckLimitAndStopOrders(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := om.Update(); err != nil {
+			t.Fatal(err)
+		}
+		if got := om.CurrentPositionForIncludingPending(testSymbolId).OpenQuantity; got != 100 {
+			t.Errorf("tick %d: position including pending is %d, want 100", tick+1, got)
+		}
+		if got := om.CurrentPositionFor(testSymbolId).OpenQuantity; got != filled {
+			t.Errorf("tick %d: position is %d, want the %d shares filled", tick+1, got, filled)
+		}
+	}
+}
+
+// A leg filling after orders were fetched can't be cancelled any more, the
+// group finishes with what the broker reports instead of failing the tick
+func TestOrderGroupLegFilledBeforeCancel(t *testing.T) {
+	b := newScriptedBroker()
+	b.positions[testSymbolId] = 100
+	om := NewOrderManager(b, NewNullLogger())
+	b.tick(t, om, nil)
+
+	_, err := om.PlaceOCO(testSymbolId, 100,
+		&OrderGroupLeg{Type: OrderTypeStop, Price: 95},
+		&OrderGroupLeg{Type: OrderTypeLimit, Price: 105},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.tick(t, om, nil)
+
+	// Sold some other way, the stop fills right after orders are fetched
+	b.positions[testSymbolId] = 0
+	b.Positions()
+	b.Orders()
+	b.fill(1, 100)
+	if err := om.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if len(om.Groups()) != 0 {
+		t.Error("group isn't done")
+	}
+	if len(b.cancelled) != 1 || b.cancelled[0] != 2 {
+		t.Errorf("cancelled %v, want the limit leg", b.cancelled)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// State of a BrokerOrder, named like Questrade's. Brokers normalize their own
+// states to these with normalizeOrderState.
+type OrderState string
+
+const (
+	// Sent but not accepted by the exchange yet
+	OrderStatePending  OrderState = "Pending"
+	OrderStateAccepted            = "Accepted"
+	// Filled in part, the rest is still open
+	OrderStatePartial        = "Partial"
+	OrderStateExecuted       = "Executed"
+	OrderStateCancelPending  = "CancelPending"
+	OrderStateCanceled       = "Canceled"
+	OrderStateReplacePending = "ReplacePending"
+	// Replaced by a new order, which carries on with the open quantity
+	OrderStateReplaced = "Replaced"
+	OrderStateRejected = "Rejected"
+	OrderStateFailed   = "Failed"
+	OrderStateExpired  = "Expired"
+)
+
+// States orders can go to from each state, final states have none. Fills can
+// race cancels & replaces, which is why those can still go to Partial or
+// Executed, or back to their state before the cancel or replace got refused.
+var orderStateTransitions = map[OrderState][]OrderState{
+	OrderStatePending: {
+		OrderStateAccepted, OrderStatePartial, OrderStateExecuted, OrderStateCancelPending,
+		OrderStateCanceled, OrderStateRejected, OrderStateFailed, OrderStateExpired,
+	},
+	OrderStateAccepted: {
+		OrderStatePartial, OrderStateExecuted, OrderStateCancelPending, OrderStateCanceled,
+		OrderStateReplacePending, OrderStateReplaced, OrderStateFailed, OrderStateExpired,
+	},
+	OrderStatePartial: {
+		OrderStateExecuted, OrderStateCancelPending, OrderStateCanceled,
+		OrderStateReplacePending, OrderStateReplaced, OrderStateExpired,
+	},
+	OrderStateCancelPending: {
+		OrderStateAccepted, OrderStatePartial, OrderStateExecuted, OrderStateCanceled,
+	},
+	OrderStateReplacePending: {
+		OrderStateAccepted, OrderStatePartial, OrderStateExecuted, OrderStateCanceled, OrderStateReplaced,
+	},
+}
+
+// Maps the states of Questrade orders that don't matter to us to the closest
+// OrderState
+func normalizeOrderState(state OrderState) OrderState {
+	switch state {
+	case "Queued", "PendingRiskReview", "ContingentOrder", "Stopped", "Suspended":
+		return OrderStatePending
+	case "Triggered", "Activated":
+		return OrderStateAccepted
+	case "PartialCanceled":
+		return OrderStateCanceled
+	}
+	return state
+}
+
+// Whether orders in s can still fill
+func (s OrderState) IsPending() bool {
+	switch s {
+	case OrderStatePending, OrderStateAccepted, OrderStatePartial, OrderStateCancelPending, OrderStateReplacePending:
+		return true
+	}
+	return false
+}
+
+func (s OrderState) IsFinal() bool {
+	_, ok := orderStateTransitions[s]
+	return !ok
+}
+
+// Whether orders can go from s to state, new orders (no state yet) can start
+// in any state
+func (s OrderState) CanTransitionTo(state OrderState) bool {
+	if s == "" {
+		return true
+	}
+	for _, to := range orderStateTransitions[s] {
+		if to == state {
+			return true
+		}
+	}
+	return false
+}
+
+// Change of state of an order, with its quantities once in the new state
+type OrderTransition struct {
+	Time           time.Time  `json:"time"`
+	From           OrderState `json:"from"`
+	To             OrderState `json:"to"`
+	FilledQuantity int64      `json:"filledQuantity"`
+	OpenQuantity   int64      `json:"openQuantity"`
+	// Not one of orderStateTransitions, kept anyway as it's what the broker
+	// reported
+	Illegal bool `json:"illegal,omitempty"`
+}
+
+// Brokers reporting every change of state of their orders as it happens,
+// others get their orders tracked every time they're fetched
+type OrderTrackingBroker interface {
+	TrackOrders(tracker *OrderTracker)
+}
+
+// History of the states of every order seen during a run
+type OrderTracker struct {
+	tm        TradingManager
+	logger    Logger
+	histories map[int][]*OrderTransition
+	rw        sync.Mutex
+}
+
+func NewOrderTracker(tradingManager TradingManager, logger Logger) *OrderTracker {
+	return &OrderTracker{
+		tm:        tradingManager,
+		logger:    logger,
+		histories: map[int][]*OrderTransition{},
+	}
+}
+
+// Records a transition when o isn't in the state it was last seen in
+func (t *OrderTracker) Track(o *BrokerOrder) {
+	t.rw.Lock()
+	defer t.rw.Unlock()
+
+	history := t.histories[o.Id]
+	var from OrderState
+	if len(history) > 0 {
+		from = history[len(history)-1].To
+	}
+	if from == o.State && len(history) > 0 {
+		return
+	}
+	transition := &OrderTransition{
+		Time:           t.tm.Now(),
+		From:           from,
+		To:             o.State,
+		FilledQuantity: o.FilledQuantity,
+		OpenQuantity:   o.OpenQuantity,
+		Illegal:        !from.CanTransitionTo(o.State),
+	}
+	if transition.Illegal {
+		t.logger.LogWarn("order_tracker", "illegal_transition,%d,%s,%s", o.Id, from, o.State)
+	}
+	t.histories[o.Id] = append(history, transition)
+}
+
+// Transitions of the order, nil when it was never seen
+func (t *OrderTracker) History(orderId int) []*OrderTransition {
+	t.rw.Lock()
+	defer t.rw.Unlock()
+	history, ok := t.histories[orderId]
+	if !ok {
+		return nil
+	}
+	return append([]*OrderTransition{}, history...)
+}
+
+// Transitions of every order seen, by order id
+func (t *OrderTracker) Histories() map[int][]*OrderTransition {
+	t.rw.Lock()
+	defer t.rw.Unlock()
+	histories := map[int][]*OrderTransition{}
+	for id, history := range t.histories {
+		histories[id] = append([]*OrderTransition{}, history...)
+	}
+	return histories
+}
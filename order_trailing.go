@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+type TrailType string
+
+const (
+	TrailTypeAmount  TrailType = "amount"
+	TrailTypePercent           = "percent"
+	TrailTypeATR               = "atr"
+)
+
+// How far a trailing stop stays from the best price seen since it was placed
+type Trail struct {
+	Type TrailType `json:"type"`
+	// Dollars, percent of the best price, or multiple of ATR
+	Value float64 `json:"value"`
+	// ATR the multiple applies to, computed by the strategy when placing
+	ATR float64 `json:"atr"`
+}
+
+// Brokers simulating trailing stops themselves, on every price they see
+type TrailingStopBroker interface {
+	// Stop order of action (Sell to protect a long) trailing the best price
+	// from best on, the current price when 0
+	CreateTrailingStop(symId int, action OrderAction, trail Trail, best float64, qty int64) (*BrokerOrder, error)
+}
+
+func (t *Trail) validate() error {
+	switch t.Type {
+	case TrailTypeAmount, TrailTypePercent, TrailTypeATR:
+	default:
+		return errors.New("trailing stop: unknown trail type: " + string(t.Type))
+	}
+	if t.Value <= 0 {
+		return errors.New("trailing stop: trail value must be positive")
+	}
+	if t.Type == TrailTypeATR && t.ATR <= 0 {
+		return errors.New("trailing stop: ATR trails need a positive ATR")
+	}
+	if t.Type == TrailTypePercent && t.Value >= 100 {
+		return errors.New("trailing stop: trail percent must be under 100")
+	}
+	return nil
+}
+
+func (t *Trail) distance(best float64) float64 {
+	switch t.Type {
+	case TrailTypePercent:
+		return best * t.Value / 100
+	case TrailTypeATR:
+		return t.Value * t.ATR
+	}
+	return t.Value
+}
+
+// Stop price of a stop of action trailing best: under the highest price for
+// sells, over the lowest one for buys
+func (t *Trail) stopPrice(action OrderAction, best float64) float64 {
+	if action == OrderActionSell {
+		return froundn(best-t.distance(best), 2)
+	}
+	return froundn(best+t.distance(best), 2)
+}
+
+// Whether price is better than best for the stop of action to follow it
+func trailImproves(action OrderAction, best, price float64) bool {
+	if action == OrderActionSell {
+		return price > best
+	}
+	return price < best
+}
+
+// Protects quantity shares (negative for a short) of the position in symId
+// with a stop trailing the best price, placed once the position is there
+func (om *OrderManager) PlaceTrailingStop(symId int, quantity int64, trail Trail) (*OrderGroup, error) {
+	if err := trail.validate(); err != nil {
+		return nil, err
+	}
+	return om.PlaceOCO(symId, quantity, &OrderGroupLeg{Type: OrderTypeStop, Trail: &trail})
+}
+
+// Moves the best price of a trailing leg to price, and on brokers without
+// native trailing stops moves the leg's stop once it can go up (or down for
+// buy stops) by a cent
+func (om *OrderManager) trailLeg(g *OrderGroup, leg *OrderGroupLeg, price float64) error {
+	action := g.exitAction()
+	if price > 0 && (leg.best == 0 || trailImproves(action, leg.best, price)) {
+		leg.best = price
+	}
+	leg.Price = leg.Trail.stopPrice(action, leg.best)
+
+	last := leg.last()
+	if _, ok := om.broker.(TrailingStopBroker); ok || last == nil || !last.IsPending() {
+		return nil
+	}
+	if !trailImproves(action, last.StopPrice, leg.Price) || math.Abs(leg.Price-last.StopPrice) < 0.005 {
+		return nil
+	}
+	o, err := om.ReplaceOrder(last, leg.Price, last.OpenQuantity)
+	if err != nil {
+		return err
+	}
+	leg.orders = append(leg.orders, o)
+	return nil
+}
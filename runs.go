@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	paperRunsFolder      = "data/run/paper/runs"
+	simulationRunsFolder = "data/run/simulation"
+)
+
+type PaperRunSummary struct {
+	Id           string              `json:"id"`
+	CreatedAt    time.Time           `json:"createdAt"`
+	Strategy     string              `json:"strategy"`
+	Params       StrategyParams      `json:"params"`
+	Start        time.Time           `json:"start"`
+	End          time.Time           `json:"end"`
+	StartingCash float64             `json:"startingCash"`
+	Broker       PaperBrokerConfig   `json:"broker"`
+	State        TradingManagerState `json:"state"`
+	TotalReturn  float64             `json:"totalReturn"`
+	TradeCount   int                 `json:"tradeCount"`
+}
+
+type PaperRun struct {
+	PaperRunSummary
+	Orders     []*BrokerOrder     `json:"orders"`
+	Executions []*BrokerExecution `json:"executions"`
+	Equity     []*EquityPoint     `json:"equity"`
+	Metrics    *RunMetrics        `json:"metrics"`
+	// Fees paid to borrow the shares of shorts held overnight
+	BorrowFees float64 `json:"borrowFees"`
+	// Times positions got liquidated for being under maintenance margin
+	MarginCalls int         `json:"marginCalls"`
+	Lots        []*PaperLot `json:"lots"`
+	// Transitions of every order, by order id
+	OrderHistory map[int][]*OrderTransition `json:"orderHistory"`
+}
+
+type PaperRunDiffValue struct {
+	Name  string      `json:"name"`
+	A     interface{} `json:"a"`
+	B     interface{} `json:"b"`
+	Delta float64     `json:"delta"`
+}
+
+type PaperRunDiff struct {
+	A       *PaperRunSummary     `json:"a"`
+	B       *PaperRunSummary     `json:"b"`
+	Params  []*PaperRunDiffValue `json:"params"`
+	Metrics []*PaperRunDiffValue `json:"metrics"`
+}
+
+// Where a trading manager keeps its log & equity files, each paper run or
+// simulation gets its own folder so that many can run at once
+func runFolder(environment TradingManagerEnvironment, runId string) string {
+	switch environment {
+	case TradingManagerEnvironmentPaper:
+		return filepath.Join(paperRunsFolder, runId)
+	case TradingManagerEnvironmentSimulation:
+		return filepath.Join(simulationRunsFolder, runId)
+	}
+	return filepath.Join("data/run", string(environment))
+}
+
+// Production has a folder per day
+func runFilePath(folder, environment string, now time.Time, name string) string {
+	if environment != string(TradingManagerEnvironmentProduction) {
+		return filepath.Join(folder, name)
+	}
+	return filepath.Join(folder, now.Format(dateFormat), name)
+}
+
+func newPaperRunId(now time.Time) string {
+	return fmt.Sprintf("%s-%04d", now.Format("20060102-150405"), rand.Intn(10000))
+}
+
+// Saves the run's results next to the log & equity files the trading manager
+// wrote in paperRunsFolder/<id>/
+func savePaperRun(run *PaperRun) error {
+	folder := runFolder(TradingManagerEnvironmentPaper, run.Id)
+	if err := writeJsonFile(filepath.Join(folder, "run.json"), run); err != nil {
+		return err
+	}
+	return writeJsonFile(filepath.Join(folder, "summary.json"), run.PaperRunSummary)
+}
+
+func loadPaperRun(id string) (*PaperRun, error) {
+	run := &PaperRun{}
+	err := readJsonFile(filepath.Join(paperRunsFolder, filepath.Base(id), "run.json"), run)
+	return run, err
+}
+
+// Most recent first
+func listPaperRuns() ([]*PaperRunSummary, error) {
+	summaries := []*PaperRunSummary{}
+	files, err := ioutil.ReadDir(paperRunsFolder)
+	if os.IsNotExist(err) {
+		return summaries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		summary := &PaperRunSummary{}
+		if err := readJsonFile(filepath.Join(paperRunsFolder, f.Name(), "summary.json"), summary); err != nil {
+			continue
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].CreatedAt.After(summaries[j].CreatedAt)
+	})
+	return summaries, nil
+}
+
+func diffPaperRuns(a, b *PaperRun) (*PaperRunDiff, error) {
+	diff := &PaperRunDiff{A: &a.PaperRunSummary, B: &b.PaperRunSummary}
+
+	paramNames := map[string]bool{}
+	for name := range a.Params {
+		paramNames[name] = true
+	}
+	for name := range b.Params {
+		paramNames[name] = true
+	}
+	diff.Params = diffValues(paramNames, a.Params, b.Params)
+
+	// Compare every numeric metric without having to list them all
+	var aMetrics, bMetrics map[string]interface{}
+	if err := roundTripJson(a.Metrics, &aMetrics); err != nil {
+		return nil, err
+	}
+	if err := roundTripJson(b.Metrics, &bMetrics); err != nil {
+		return nil, err
+	}
+	metricNames := map[string]bool{}
+	for name, value := range aMetrics {
+		if _, ok := value.(float64); ok {
+			metricNames[name] = true
+		}
+	}
+	diff.Metrics = diffValues(metricNames, aMetrics, bMetrics)
+
+	return diff, nil
+}
+
+func diffValues(names map[string]bool, a, b map[string]interface{}) []*PaperRunDiffValue {
+	values := []*PaperRunDiffValue{}
+	for name := range names {
+		value := &PaperRunDiffValue{Name: name, A: a[name], B: b[name]}
+		aFloat, aOk := toFloat(a[name])
+		bFloat, bOk := toFloat(b[name])
+		if aOk && bOk {
+			value.Delta = bFloat - aFloat
+		}
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].Name < values[j].Name
+	})
+	return values
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func roundTripJson(from interface{}, to interface{}) error {
+	bytes, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, to)
+}
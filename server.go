@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,7 +23,8 @@ var (
 	rootHandler          http.Handler
 	indexFileContents    []byte
 	serverPaperTM        *TradingManagerV1
-	serverPaperTMRW      sync.Mutex
+	serverPaperJobs      *BacktestJobQueue
+	serverOptimizations  *OptimizationJobQueue
 	serverStagingTM      *TradingManagerV1
 	serverStagingTMRW    sync.Mutex
 	serverProductionTM   *TradingManagerV1
@@ -38,9 +42,18 @@ func startServer() {
 	}
 	indexFileContents = bytes
 
-	serverPaperTM = NewTradingManagerV1(TradingManagerEnvironmentPaper, "long_ma", "")
-	serverStagingTM = NewTradingManagerV1(TradingManagerEnvironmentStaging, "long_ma", "")
-	serverProductionTM = NewTradingManagerV1(TradingManagerEnvironmentProduction, "long_ma", "")
+	// Never started, shown until a paper job gets submitted
+	if serverPaperTM, err = NewTradingManagerV1(TradingManagerEnvironmentPaper, "long_ma", ""); err != nil {
+		log.Fatalln(err)
+	}
+	serverPaperJobs = NewBacktestJobQueue(0)
+	serverOptimizations = NewOptimizationJobQueue()
+	if serverStagingTM, err = NewTradingManagerV1(TradingManagerEnvironmentStaging, "long_ma", ""); err != nil {
+		log.Fatalln(err)
+	}
+	if serverProductionTM, err = NewTradingManagerV1(TradingManagerEnvironmentProduction, "long_ma", ""); err != nil {
+		log.Fatalln(err)
+	}
 
 	// Handle Ctrl-C and exit cleanly
 	sigs := make(chan os.Signal, 1)
@@ -65,9 +78,24 @@ func startServer() {
 	http.HandleFunc("/data/run/paper", handleDataRun)
 	http.HandleFunc("/data/run/staging", handleDataRun)
 	http.HandleFunc("/data/run/production", handleDataRun)
+	http.HandleFunc("/data/equity/paper", handleDataEquity)
+	http.HandleFunc("/data/equity/staging", handleDataEquity)
+	http.HandleFunc("/data/equity/production", handleDataEquity)
+	http.HandleFunc("/data/runs", handleDataRuns)
+	http.HandleFunc("/data/runs/", handleDataRuns)
 	http.HandleFunc("/data/account", handleDataAccount)
 	http.HandleFunc("/data/logs", handleDataLogs)
+	http.HandleFunc("/data/strategies", handleDataStrategies)
+	http.HandleFunc("/data/jobs", handleDataJobs)
+	http.HandleFunc("/data/jobs/", handleDataJobs)
+	http.HandleFunc("/data/orders/", handleDataOrders)
+	http.HandleFunc("/data/optimizations", handleDataOptimizations)
+	http.HandleFunc("/data/optimizations/", handleDataOptimizations)
 	http.HandleFunc("/actions/run/paper", handleActionsRunPaper)
+	http.HandleFunc("/actions/cancel/job", handleActionsCancelJob)
+	http.HandleFunc("/actions/cancel/optimization", handleActionsCancelOptimization)
+	http.HandleFunc("/actions/sweep", handleActionsSweep)
+	http.HandleFunc("/actions/walk-forward", handleActionsWalkForward)
 	http.HandleFunc("/actions/start/production", handleActionsStartProduction)
 	http.HandleFunc("/actions/stop/production", handleActionsStopProduction)
 
@@ -164,7 +192,15 @@ func handleDataRun(w http.ResponseWriter, r *http.Request) {
 	var tradingManager *TradingManagerV1
 	switch r.URL.Path[len("/data/run/"):] {
 	case "paper":
+		job, err := paperJob(r)
+		if err != nil {
+			renderError(w, err.Error())
+			return
+		}
 		tradingManager = serverPaperTM
+		if job != nil {
+			tradingManager = job.tm
+		}
 	case "staging":
 		tradingManager = serverStagingTM
 	case "production":
@@ -172,17 +208,118 @@ func handleDataRun(w http.ResponseWriter, r *http.Request) {
 	default:
 		panic("unreachable")
 	}
+	var apiBudgets []*QTApiBudget
+	if tradingManager.environment != TradingManagerEnvironmentPaper {
+		apiBudgets = qtApiRateLimiter.Budgets()
+	}
 	renderJson(w, H{
 		"time":       tradingManager.Now(),
 		"state":      tradingManager.State(),
+		"runId":      tradingManager.runId,
 		"strategy":   tradingManager.strategyName,
+		"params":     tradingManager.strategyParams,
 		"balance":    tradingManager.broker.LastBalance(),
 		"positions":  tradingManager.broker.LastPositions(),
 		"orders":     tradingManager.broker.LastOrders(),
 		"executions": tradingManager.broker.LastExecutions(),
+		"metrics":    tradingManager.Metrics(),
+		"apiBudgets": apiBudgets,
 	})
 }
 
+// The job asked for with ?job=<id>, or the last one submitted (nil when there
+// hasn't been any yet)
+func paperJob(r *http.Request) (*BacktestJob, error) {
+	id := r.URL.Query().Get("job")
+	if id == "" {
+		return serverPaperJobs.Latest(), nil
+	}
+	job := serverPaperJobs.Get(id)
+	if job == nil {
+		return nil, errors.New("unknown job: " + id)
+	}
+	return job, nil
+}
+
+func handleDataEquity(w http.ResponseWriter, r *http.Request) {
+	var tradingManager *TradingManagerV1
+	switch r.URL.Path[len("/data/equity/"):] {
+	case "paper":
+		job, err := paperJob(r)
+		if err != nil {
+			renderError(w, err.Error())
+			return
+		}
+		tradingManager = serverPaperTM
+		if job != nil {
+			tradingManager = job.tm
+		}
+	case "staging":
+		tradingManager = serverStagingTM
+	case "production":
+		tradingManager = serverProductionTM
+	default:
+		panic("unreachable")
+	}
+
+	points := tradingManager.Equity()
+	if day := r.URL.Query().Get("day"); day != "" {
+		dayPoints := []*EquityPoint{}
+		for _, p := range points {
+			if p.Time.Format(dateFormat) == day {
+				dayPoints = append(dayPoints, p)
+			}
+		}
+		points = dayPoints
+	}
+	if maxPoints := r.URL.Query().Get("points"); maxPoints != "" {
+		n, err := strconv.Atoi(maxPoints)
+		if err != nil {
+			renderError(w, err.Error())
+			return
+		}
+		points = downsampleEquity(points, n)
+	}
+	renderJson(w, points)
+}
+
+func handleDataRuns(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/data/runs"), "/")
+	switch id {
+	case "":
+		runs, err := listPaperRuns()
+		if err != nil {
+			renderError(w, err.Error())
+			return
+		}
+		renderJson(w, runs)
+	case "compare":
+		a, err := loadPaperRun(r.URL.Query().Get("a"))
+		if err != nil {
+			renderError(w, err.Error())
+			return
+		}
+		b, err := loadPaperRun(r.URL.Query().Get("b"))
+		if err != nil {
+			renderError(w, err.Error())
+			return
+		}
+		diff, err := diffPaperRuns(a, b)
+		if err != nil {
+			renderError(w, err.Error())
+			return
+		}
+		renderJson(w, diff)
+	default:
+		run, err := loadPaperRun(id)
+		if err != nil {
+			renderError(w, err.Error())
+			return
+		}
+		renderJson(w, run)
+	}
+}
+
 func handleDataAccount(w http.ResponseWriter, r *http.Request) {
 	accountId := r.URL.Query().Get("accountId")
 	broker := NewQTBroker(nil, NewConsoleLogger(), accountId)
@@ -220,7 +357,14 @@ func handleDataLogs(w http.ResponseWriter, r *http.Request) {
 	environment := TradingManagerEnvironment(r.URL.Query().Get("environment"))
 
 	if environment == TradingManagerEnvironmentPaper {
-		file, err = os.Open("data/run/paper/log.txt")
+		var job *BacktestJob
+		if job, err = paperJob(r); err == nil {
+			if job == nil {
+				renderError(w, "No paper job submitted yet")
+				return
+			}
+			file, err = os.Open(filepath.Join(runFolder(environment, job.Id), "log.txt"))
+		}
 	} else if environment == TradingManagerEnvironmentStaging {
 		file, err = os.Open("data/run/staging/log.txt")
 	} else if environment == TradingManagerEnvironmentProduction {
@@ -242,10 +386,95 @@ func handleDataLogs(w http.ResponseWriter, r *http.Request) {
 	w.Write(bytes)
 }
 
-func handleActionsRunPaper(w http.ResponseWriter, r *http.Request) {
-	serverPaperTMRW.Lock()
-	defer serverPaperTMRW.Unlock()
+func handleDataStrategies(w http.ResponseWriter, r *http.Request) {
+	renderJson(w, allStrategyDefinitions())
+}
+
+func handleDataJobs(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/data/jobs"), "/")
+	if id == "" {
+		statuses := []*BacktestJobStatus{}
+		for _, job := range serverPaperJobs.List() {
+			statuses = append(statuses, serverPaperJobs.Status(job))
+		}
+		renderJson(w, statuses)
+		return
+	}
+	job := serverPaperJobs.Get(id)
+	if job == nil {
+		renderError(w, "unknown job: "+id)
+		return
+	}
+	renderJson(w, serverPaperJobs.Status(job))
+}
 
+// Sweeps & walk-forwards running in the background, /data/optimizations/<id>
+// includes the result once done
+func handleDataOptimizations(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/data/optimizations"), "/")
+	if id == "" {
+		statuses := []*OptimizationJobStatus{}
+		for _, job := range serverOptimizations.List() {
+			statuses = append(statuses, serverOptimizations.Status(job, false))
+		}
+		renderJson(w, statuses)
+		return
+	}
+	job := serverOptimizations.Get(id)
+	if job == nil {
+		renderError(w, "unknown optimization: "+id)
+		return
+	}
+	renderJson(w, serverOptimizations.Status(job, true))
+}
+
+// Transitions of an order of the run of ?environment= (paper by default, the
+// paper job asked for with ?job=), on /data/orders/<id>/history
+func handleDataOrders(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/data/orders/"), "/")
+	if len(parts) != 2 || parts[1] != "history" {
+		handleNotFound(w, r)
+		return
+	}
+	orderId, err := strconv.Atoi(parts[0])
+	if err != nil {
+		renderError(w, "invalid order id: "+parts[0])
+		return
+	}
+
+	var tradingManager *TradingManagerV1
+	environment := TradingManagerEnvironment(r.URL.Query().Get("environment"))
+	switch environment {
+	case "", TradingManagerEnvironmentPaper:
+		job, err := paperJob(r)
+		if err != nil {
+			renderError(w, err.Error())
+			return
+		}
+		tradingManager = serverPaperTM
+		if job != nil {
+			tradingManager = job.tm
+		}
+	case TradingManagerEnvironmentStaging:
+		tradingManager = serverStagingTM
+	case TradingManagerEnvironmentProduction:
+		tradingManager = serverProductionTM
+	default:
+		renderError(w, "Unknown environment: "+string(environment))
+		return
+	}
+
+	history := tradingManager.OrderHistory(orderId)
+	if history == nil {
+		renderError(w, "unknown order: "+parts[0])
+		return
+	}
+	renderJson(w, history)
+}
+
+// Queues a paper run and returns right away, progress can be followed on
+// /data/jobs/<jobId>
+func handleActionsRunPaper(w http.ResponseWriter, r *http.Request) {
 	var values = map[string]string{}
 	err := json.NewDecoder(r.Body).Decode(&values)
 	if err != nil {
@@ -269,21 +498,95 @@ func handleActionsRunPaper(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	serverPaperTM = NewTradingManagerV1(TradingManagerEnvironmentPaper, values["strategy"], "")
-	serverPaperTM.broker.(*PaperBroker).cash = cash
-	serverPaperTM.start = start
-	serverPaperTM.end = end
+	brokerConfig := PaperBrokerConfig{
+		FillPath:   FillPath(values["fillPath"]),
+		Slippage:   PaperModelConfig{Name: values["slippage"]},
+		Commission: PaperModelConfig{Name: values["commission"]},
+		Margin:     PaperMarginConfig{Account: PaperAccountType(values["account"])},
+	}
+	if values["maxVolumePercent"] != "" {
+		if brokerConfig.MaxVolumePercent, err = strconv.ParseFloat(values["maxVolumePercent"], 64); err != nil {
+			renderError(w, err.Error())
+			return
+		}
+	}
+	job, err := serverPaperJobs.Submit(values["strategy"], values["config"], start, end, cash, brokerConfig)
+	if err != nil {
+		renderError(w, err.Error())
+		return
+	}
+
+	renderJson(w, H{"jobId": job.Id, "runId": job.Id})
+}
+
+func handleActionsCancelJob(w http.ResponseWriter, r *http.Request) {
+	var values = map[string]string{}
+	err := json.NewDecoder(r.Body).Decode(&values)
+	if err != nil {
+		renderError(w, err.Error())
+		return
+	}
+
+	if err := serverPaperJobs.Cancel(values["id"]); err != nil {
+		renderError(w, err.Error())
+		return
+	}
+
+	renderJson(w, H{})
+}
 
-	if err := serverPaperTM.Start(); err != nil {
+func handleActionsSweep(w http.ResponseWriter, r *http.Request) {
+	spec := &SweepSpec{}
+	if err := json.NewDecoder(r.Body).Decode(spec); err != nil {
 		renderError(w, err.Error())
 		return
 	}
 
-	serverPaperTM.WaitForState(TradingManagerStateDone, TradingManagerStateFailed)
+	if err := spec.validate(); err != nil {
+		renderError(w, err.Error())
+		return
+	}
+
+	job := serverOptimizations.Submit("sweep", func(ctx context.Context, onProgress func(done, total int)) (interface{}, error) {
+		return runSweep(ctx, spec, onProgress)
+	})
+	renderJson(w, H{"jobId": job.Id})
+}
+
+func handleActionsCancelOptimization(w http.ResponseWriter, r *http.Request) {
+	var values = map[string]string{}
+	err := json.NewDecoder(r.Body).Decode(&values)
+	if err != nil {
+		renderError(w, err.Error())
+		return
+	}
+
+	if err := serverOptimizations.Cancel(values["id"]); err != nil {
+		renderError(w, err.Error())
+		return
+	}
 
 	renderJson(w, H{})
 }
 
+func handleActionsWalkForward(w http.ResponseWriter, r *http.Request) {
+	spec := &WalkForwardSpec{}
+	if err := json.NewDecoder(r.Body).Decode(spec); err != nil {
+		renderError(w, err.Error())
+		return
+	}
+
+	if err := spec.validate(); err != nil {
+		renderError(w, err.Error())
+		return
+	}
+
+	job := serverOptimizations.Submit("walk-forward", func(ctx context.Context, onProgress func(done, total int)) (interface{}, error) {
+		return runWalkForward(ctx, spec, onProgress)
+	})
+	renderJson(w, H{"jobId": job.Id})
+}
+
 func handleActionsStartProduction(w http.ResponseWriter, r *http.Request) {
 	serverProductionTMRW.Lock()
 	defer serverProductionTMRW.Unlock()
@@ -298,7 +601,12 @@ func handleActionsStartProduction(w http.ResponseWriter, r *http.Request) {
 	// Reset if failed
 	if serverProductionTM.State() == TradingManagerStateFailed ||
 		serverProductionTM.State() == TradingManagerStateStopped {
-		serverProductionTM = NewTradingManagerV1(TradingManagerEnvironmentProduction, values["strategy"], "")
+		tm, err := NewTradingManagerV1(TradingManagerEnvironmentProduction, values["strategy"], values["config"])
+		if err != nil {
+			renderError(w, err.Error())
+			return
+		}
+		serverProductionTM = tm
 	}
 
 	if err := serverProductionTM.Start(); err != nil {
@@ -61,12 +61,25 @@ var state = {
     ['staging', 'Staging'],
     ['production', 'Production'],
   ],
-  strategyOptions: [
-    ['rsi', 'RSI'],
-    ['long_ma', 'MA Crossover'],
-    ['bar_color', 'Bar Color Follow'],
-    ['follow_nasdaq', 'Nasdaq Follow'],
-    ['gapngo', 'Gap-N-Go'],
+  strategyOptions: [],
+  fillPathOptions: [
+    ['pessimistic', 'Fills: pessimistic'],
+    ['ohlc', 'Fills: OHLC'],
+    ['olhc', 'Fills: OLHC'],
+    ['close', 'Fills: close only'],
+  ],
+  slippageOptions: [
+    ['fixed_bps', 'Slippage: 2.5 bps'],
+    ['spread', 'Slippage: half spread'],
+    ['volume', 'Slippage: volume'],
+  ],
+  commissionOptions: [
+    ['per_share', 'Fees: 1c/share'],
+    ['questrade', 'Fees: Questrade'],
+  ],
+  accountTypeOptions: [
+    ['margin', 'Margin account'],
+    ['cash', 'Cash account'],
   ],
   accountsOptions: [
     ['26924694', 'Algo'],
@@ -85,15 +98,30 @@ var state = {
   runTest: {
     strategy: 'long_ma',
     cash: '1000',
+    fillPath: 'pessimistic',
+    slippage: 'fixed_bps',
+    commission: 'per_share',
+    maxVolumePercent: '',
+    account: 'margin',
     start: '2017-02-01',
     end: '2017-07-31',
   },
+  runTestParams: {},
+  runTestJob: null,
+  runsCompare: {
+    a: null,
+    b: null,
+  },
   api: {
+    strategies: {status: 'request', data: null, error: null},
     details: {status: 'request', data: null, error: null},
     dayData: {status: 'request', data: null, error: null},
     account: {status: 'request', data: null, error: null},
     logs: {status: 'request', data: null, error: null},
     runTest: {status: 'request', data: null, error: null},
+    runTestJobs: {status: 'request', data: null, error: null},
+    runs: {status: 'request', data: null, error: null},
+    runsCompare: {status: 'request', data: null, error: null},
     runProduction: {status: 'request', data: null, error: null},
   },
 };
@@ -117,6 +145,7 @@ var Input = {
     return m('input' + (vnode.attrs.class || ''), {
       type: 'text',
       value: currentValue,
+      placeholder: vnode.attrs.placeholder,
       onchange: function(e) { stateNode[0][stateNode[1]] = e.target.value; },
     });
   },
@@ -139,6 +168,108 @@ var Select = {
 };
 // }}}
 
+// {{{ StrategyParamsForm
+var StrategyParamsForm = {
+  view: function(vnode) {
+    var strategy = vnode.attrs.strategy;
+    var values = vnode.attrs.values;
+    var schema = strategyParams(strategy);
+    if (schema.length === 0) {
+      return null;
+    }
+
+    if (!values[strategy]) {
+      values[strategy] = {};
+      schema.forEach(function (p) {
+        values[strategy][p.name] = Array.isArray(p.default) ? p.default.join(',') : String(p.default);
+      });
+    }
+
+    return m('div.bg-near-white.flex.flex-wrap.pa2.bb.b--silver', schema.map(function (p) {
+      return m('label.f6.mr3.mb1', {title: p.description}, [
+        m('.dark-gray.mb1', p.name),
+        m(Input, {
+          class: '.hk-input.w4',
+          stateNode: [values[strategy], p.name],
+        }),
+      ]);
+    }));
+  },
+};
+
+function strategyParams(strategy) {
+  var definition = (state.api.strategies.data || []).filter(propEq('name', strategy))[0];
+  return definition ? definition.params : [];
+}
+
+function strategyConfig(strategy, values) {
+  var schema = strategyParams(strategy);
+  var config = {};
+  schema.forEach(function (p) {
+    var value = (values[strategy] || {})[p.name];
+    if (value === undefined || value === '') {
+      return;
+    }
+    if (p.type === 'int_list') {
+      config[p.name] = value.split(',').map(function (v) { return parseFloat(v); });
+    } else {
+      config[p.name] = parseFloat(value);
+    }
+  });
+  return JSON.stringify(config);
+}
+// }}}
+
+// {{{ EquityChart
+var EquityChart = {
+  oninit: function(vnode) {
+    this.points = null;
+    this.fetch(vnode);
+  },
+  onupdate: function(vnode) {
+    if (vnode.attrs.refreshKey !== this.refreshKey) {
+      this.fetch(vnode);
+    }
+  },
+  fetch: function(vnode) {
+    this.refreshKey = vnode.attrs.refreshKey;
+    var url = '/data/equity/' + vnode.attrs.environment + '?points=500';
+    if (vnode.attrs.day) {
+      url += '&day=' + vnode.attrs.day;
+    }
+    if (vnode.attrs.job) {
+      url += '&job=' + vnode.attrs.job;
+    }
+    m.request({method: 'GET', url: url}).then(function(result) {
+      this.points = result;
+    }.bind(this)).catch(function(err) {
+      console.error(err);
+    });
+  },
+  view: function(vnode) {
+    if (!this.points || this.points.length === 0) {
+      return m('.f6.gray.pa2', 'No equity data.');
+    }
+    var equity = map(prop('equity'), this.points);
+    var marketValue = map(prop('marketValue'), this.points);
+    var low = Math.floor(min(equity.concat(marketValue)));
+    var high = Math.ceil(max(equity.concat(marketValue)));
+    return m('div', [
+      m('.f6.dark-gray.mt2', 'Equity (blue) & market value (orange)'),
+      m('img', {
+        src: [
+          'http://chartd.co/a.svg?hl=1&w=' + (vnode.attrs.width || 1022) + '&h=200',
+          '&d0=', encodeChartDataset(equity, low, high),
+          '&d1=', encodeChartDataset(marketValue, low, high),
+          '&ymin=', low,
+          '&ymax=', high,
+        ].join('')
+      }),
+    ]);
+  },
+};
+// }}}
+
 // {{{ DayChart
 var DayChart = {
   oninit: function() {
@@ -357,7 +488,15 @@ var PageChart = {
 
     if (state.api.dayData.status === 'success') {
       var candles = state.api.dayData.data;
-      chartEl = m(DayChart, {candles: candles});
+      chartEl = m('div', [
+        m(DayChart, {candles: candles}),
+        m('.ph2', m(EquityChart, {
+          environment: 'paper',
+          day: state.day,
+          refreshKey: state.day,
+          width: 1560,
+        })),
+      ]);
     }
 
     return m('div', [
@@ -405,7 +544,6 @@ var RunStatistics = {
     }
   },
   view: function(vnode) {
-    var cash = vnode.attrs.cash;
     var data = vnode.attrs.data;
 
     var statsHeadClass = '.dtc.pv2.f5.bb.b--light-gray.pl2.dark-gray.b';
@@ -413,7 +551,8 @@ var RunStatistics = {
     var headClass = '.dtc.pv2.f5.bb.b--light-gray.dark-gray.b';
     var cellClass = '.dtc.pv2.f5.bb.b--light-gray';
 
-    var trades = computeTrades(data.executions);
+    var metrics = data.metrics;
+    var trades = metrics.trades;
 
     var topStatsBoxesEl = m('.flex.flex-row', [
       m('.bg-lightest-silver.shadow-outer-1.br2.flex-auto.w-50.tc.mr2', [
@@ -449,7 +588,7 @@ var RunStatistics = {
           m(cellClass+'.tr', p.currentPrice.toFixed(2)),
           m(cellClass+'.tr', p.currentMarketValue.toFixed(2)),
           m(cellClass+'.tr', filter(propEq('symbol', p.symbol), trades).length),
-          m(cellClass+'.tr', sum(map(prop('profit'), filter(propEq('symbol', p.symbol), trades))).toFixed(2)),
+          m(cellClass+'.tr', sum(map(prop('pnl'), filter(propEq('symbol', p.symbol), trades))).toFixed(2)),
         ]);
       }),
     ]);
@@ -489,57 +628,59 @@ var RunStatistics = {
       m('.dt-row', [
         m(headClass, {onclick: this.sort.bind(this, 'symbol')}, 'Sym.'),
         m(headClass, {onclick: this.sort.bind(this, 'openedAt')}, 'Opened'),
-        m(headClass, {onclick: this.sort.bind(this, 'closeAt')}, 'Closed'),
+        m(headClass, {onclick: this.sort.bind(this, 'closedAt')}, 'Closed'),
         m(headClass+'.tr', {onclick: this.sort.bind(this, 'quantity')}, 'Total Qty.'),
-        m(headClass+'.tr', {onclick: this.sort.bind(this, 'profit')}, 'P/L $'),
-        m(headClass+'.tr', {onclick: this.sort.bind(this, 'profitPercent')}, 'P/L %'),
+        m(headClass+'.tr', {onclick: this.sort.bind(this, 'pnl')}, 'P/L $'),
+        m(headClass+'.tr', {onclick: this.sort.bind(this, 'pnlPercent')}, 'P/L %'),
         m(headClass+'.tr', {onclick: this.sort.bind(this, 'fees')}, 'Fees'),
-        m(headClass+'.tr', {onclick: this.sort.bind(this, 'executionsCount')}, 'Exec. #'),
+        m(headClass+'.tr', {onclick: this.sort.bind(this, 'executions')}, 'Exec. #'),
       ]),
       sortedTrades.length === 0 ? m('.dt-row', m('.dtc.f5.pv2', 'No trades.')) : null,
       sortedTrades.map(function (t) {
-        var color = t.profit > 0 ? '.dark-green' : '.red';
+        var color = t.pnl > 0 ? '.dark-green' : '.red';
         return m('.dt-row', [
           m(cellClass, t.symbol),
           m(cellClass, formatDateTime(t.openedAt)),
           m(cellClass, formatDateTime(t.closedAt)),
           m(cellClass+'.tr', t.quantity),
-          m(cellClass+'.tr'+color, t.profit.toFixed(2)),
-          m(cellClass+'.tr'+color, formatPercent(t.profitPercent)),
+          m(cellClass+'.tr'+color, t.pnl.toFixed(2)),
+          m(cellClass+'.tr'+color, formatPercent(t.pnlPercent)),
           m(cellClass+'.tr', t.fees.toFixed(2)),
-          m(cellClass+'.tr', t.executions.length),
+          m(cellClass+'.tr', t.executions),
         ]);
       }),
     ]);
 
-    var tradesStats = computeTradesStats(cash, data, trades);
+    var profitAmounts = trades.reduce(function (amounts, t) {
+      return amounts.concat([(amounts[amounts.length-1] || 0) + t.pnl]);
+    }, []);
     var stats = [
-      ['Duration', tradesStats.duration],
-      ['Starting $', tradesStats.startingCash.toFixed(2)],
-      ['Value $', tradesStats.cash.toFixed(2)],
-      ['Total Return $', tradesStats.totalReturn.toFixed(2), true],
-      ['Total Fees $', tradesStats.totalFees.toFixed(2)],
-      ['Total Return %', formatPercent(tradesStats.totalReturnPercent), true],
-      ['CAGR', formatPercent(tradesStats.cagr)],
-      ['Sharpe Ratio', tradesStats.sharpe.toFixed(2)],
-      ['Sortino Ratio', tradesStats.sortino.toFixed(2)],
-      ['Avg Drawdown %', formatPercent(tradesStats.avgDrawdownPercent)],
-      ['Max Drawdown %', formatPercent(tradesStats.maxDrawdownPercent)],
-      ['Trade Win %', formatPercent(tradesStats.tradeWinPercent)],
-      ['Average Trade %', formatPercent(tradesStats.avgTradePercent), true],
-      ['Average Win %', formatPercent(tradesStats.avgWinPercent), true],
-      ['Average Loss %', formatPercent(tradesStats.avgLossPercent), true],
-      ['Best Trade %', formatPercent(tradesStats.bestTradePercent), true],
-      ['Worst Trade %', formatPercent(tradesStats.worstTradePercent), true],
-      ['Worst Trade Date', 'TBD'],
-      ['Avg. Time In Trade', (tradesStats.avgTimeInTrade/(1000*60)).toFixed(1)+'m'],
-      ['Trade Count', tradesStats.tradeCount],
-      ['Winning Months %', '-'],
-      ['Average Month %', '-'],
-      ['Average Winning Month %', '-'],
-      ['Average Loosing Month %', '-'],
-      ['Best Month %', '-'],
-      ['Worst Month %', '-'],
+      ['Starting $', metrics.startingEquity.toFixed(2)],
+      ['Value $', metrics.endingEquity.toFixed(2)],
+      ['Total Return $', metrics.totalReturn.toFixed(2), true],
+      ['Total Return %', formatPercent(metrics.totalReturnPercent), true],
+      ['Total Fees $', metrics.totalFees.toFixed(2)],
+      ['Commissions $', metrics.commissions.toFixed(2)],
+      ['SEC Fees $', metrics.secFees.toFixed(2)],
+      ['Sharpe (1m)', metrics.sharpeMinute.toFixed(2)],
+      ['Sortino (1m)', metrics.sortinoMinute.toFixed(2)],
+      ['Sharpe (1d)', metrics.sharpeDaily.toFixed(2)],
+      ['Sortino (1d)', metrics.sortinoDaily.toFixed(2)],
+      ['Max Drawdown $', metrics.maxDrawdown.toFixed(2)],
+      ['Max Drawdown %', formatPercent(metrics.maxDrawdownPercent)],
+      ['Max Drawdown Time', metrics.maxDrawdownMinutes.toFixed(0)+'m'],
+      ['Exposure %', formatPercent(metrics.exposurePercent)],
+      ['Trade Count', metrics.tradeCount],
+      ['Trade Win %', formatPercent(metrics.winRate)],
+      ['Total P/L $', metrics.totalPnL.toFixed(2), true],
+      ['Average Trade $', metrics.avgPnL.toFixed(2), true],
+      ['Average Win $', metrics.avgWin.toFixed(2), true],
+      ['Average Loss $', metrics.avgLoss.toFixed(2), true],
+      ['Best Trade $', metrics.bestTrade.toFixed(2), true],
+      ['Worst Trade $', metrics.worstTrade.toFixed(2), true],
+      ['Profit Factor', metrics.profitFactor.toFixed(2)],
+      ['Expectancy $', metrics.expectancy.toFixed(2), true],
+      ['Avg. Time In Trade', metrics.avgMinutesInTrade.toFixed(1)+'m'],
     ];
 
     return m('.flex', [
@@ -549,11 +690,16 @@ var RunStatistics = {
         m('img.mt3', {
           src: [
             'http://chartd.co/a.svg?hl=1&w=1022&h=250',
-            '&d0=', encodeChartDataset(tradesStats.profitAmounts),
-            '&ymin=', Math.floor(min(tradesStats.profitAmounts)),
-            '&ymax=', Math.ceil(max(tradesStats.profitAmounts)),
+            '&d0=', encodeChartDataset(profitAmounts),
+            '&ymin=', Math.floor(min(profitAmounts)),
+            '&ymax=', Math.ceil(max(profitAmounts)),
           ].join('')
         }),
+        m(EquityChart, {
+          environment: vnode.attrs.environment,
+          job: vnode.attrs.job,
+          refreshKey: data.time,
+        }),
         m('h3.fw3.mt3.mb0', 'Positions'),
         positionsTableEl,
         m('h3.fw3.mt3.mb0', 'Open Orders'),
@@ -580,34 +726,84 @@ var RunStatistics = {
 var PageRunPaper = {
   oninit: function(vnode) {
     this.refresh();
+    this.refreshLoop();
   },
   refresh: function() {
-    simpleRequest(state.api.runTest, '/data/run/paper');
+    var url = '/data/run/paper';
+    if (state.runTestJob) {
+      url += '?job=' + state.runTestJob;
+    }
+    simpleRequest(state.api.runTest, url);
+    simpleRequest(state.api.runTestJobs, '/data/jobs');
   },
   refreshLoop: function() {
     this.intervalHandle = setInterval(function() {
-      this.refresh();
+      var jobs = state.api.runTestJobs.data || [];
+      var active = jobs.filter(function(j) {
+        return j.state === 'queued' || j.state === 'running';
+      });
+      // Keep refreshing once more after the last job finished
+      if (active.length > 0 || this.hadActiveJobs) {
+        this.refresh();
+      }
+      this.hadActiveJobs = active.length > 0;
     }.bind(this), 1000);
   },
   run: function() {
-    this.refreshLoop();
     m.request({
       method: 'POST',
       url: '/actions/run/paper',
-      data: state.runTest,
-    }).catch(function (err) {
-      console.error(err);
-    }).then(function() {
-      clearInterval(this.intervalHandle);
-      this.intervalHandle = null;
+      data: Object.assign({}, state.runTest, {
+        config: strategyConfig(state.runTest.strategy, state.runTestParams),
+      }),
+    }).then(function(result) {
+      state.runTestJob = result.jobId;
+      this.hadActiveJobs = true;
       this.refresh();
-    }.bind(this));
+    }.bind(this)).catch(function (err) {
+      console.error(err);
+    });
+  },
+  cancel: function(id) {
+    m.request({
+      method: 'POST',
+      url: '/actions/cancel/job',
+      data: {id: id},
+    }).then(this.refresh.bind(this)).catch(function (err) {
+      console.error(err);
+    });
+  },
+  show: function(id) {
+    state.runTestJob = id;
+    this.refresh();
   },
   onremove: function(vnode) {
     if (this.intervalHandle) {
       clearInterval(this.intervalHandle);
     }
   },
+  jobsView: function() {
+    var jobs = state.api.runTestJobs.data || [];
+    if (jobs.length === 0) {
+      return null;
+    }
+    var cellClass = '.dtc.pv1.f6.bb.b--light-gray.ph2';
+    return m('.dt.w-100.bb.b--silver', jobs.map(function (j) {
+      var selected = j.id === (state.runTestJob || jobs[0].id);
+      var active = j.state === 'queued' || j.state === 'running';
+      return m('.dt-row' + (selected ? '.bg-lightest-blue' : ''), [
+        m(cellClass, m('a.link.blue.pointer', {onclick: this.show.bind(this, j.id)}, j.id)),
+        m(cellClass, j.strategy),
+        m(cellClass, formatDate(j.start) + ' - ' + formatDate(j.end)),
+        m(cellClass, j.state === 'running' ? formatDateTime(j.now) : ''),
+        m(cellClass + '.tr', formatPercent(j.progress)),
+        m(cellClass + '.tr', m('.hk-badge' + backgroundForStatus(j.state), j.state)),
+        m(cellClass + '.tr', active ? m('button.hk-button--danger.f6', {
+          onclick: this.cancel.bind(this, j.id),
+        }, 'Cancel') : null),
+      ]);
+    }.bind(this)));
+  },
   view: function() {
     var data = state.api.runTest.data;
     var cash = parseFloat(state.runTest.cash);
@@ -635,6 +831,31 @@ var PageRunPaper = {
           class: '.hk-input.w5.mr2',
           stateNode: [state.runTest, 'cash'],
         }),
+        m(Select, {
+          class: '.hk-input.mr2',
+          stateNode: [state.runTest, 'fillPath'],
+          options: state.fillPathOptions,
+        }),
+        m(Select, {
+          class: '.hk-input.mr2',
+          stateNode: [state.runTest, 'slippage'],
+          options: state.slippageOptions,
+        }),
+        m(Select, {
+          class: '.hk-input.mr2',
+          stateNode: [state.runTest, 'commission'],
+          options: state.commissionOptions,
+        }),
+        m(Input, {
+          class: '.hk-input.w4.mr2',
+          placeholder: 'Max % of volume',
+          stateNode: [state.runTest, 'maxVolumePercent'],
+        }),
+        m(Select, {
+          class: '.hk-input.mr2',
+          stateNode: [state.runTest, 'account'],
+          options: state.accountTypeOptions,
+        }),
         m(Input, {
           class: '.hk-input.w5.mr2',
           stateNode: [state.runTest, 'start'],
@@ -651,7 +872,104 @@ var PageRunPaper = {
         }, 'Refresh'),
         m('.hk-badge.absolute.right-1'+statusClass, status),
       ]),
-      m(RunStatistics, {data: data, cash: cash}),
+      m(StrategyParamsForm, {
+        strategy: state.runTest.strategy,
+        values: state.runTestParams,
+      }),
+      this.jobsView(),
+      m(RunStatistics, {data: data, cash: cash, environment: 'paper', job: state.runTestJob}),
+    ]);
+  },
+};
+// }}}
+
+// {{{ PageRuns
+var PageRuns = {
+  oninit: function() {
+    simpleRequest(state.api.runs, '/data/runs');
+  },
+  select: function(side, id) {
+    state.runsCompare[side] = id;
+    if (state.runsCompare.a && state.runsCompare.b) {
+      simpleRequest(
+        state.api.runsCompare,
+        '/data/runs/compare?a=' + state.runsCompare.a + '&b=' + state.runsCompare.b
+      );
+    }
+  },
+  view: function() {
+    var headClass = '.dtc.pv2.f5.bb.b--light-gray.dark-gray.b';
+    var cellClass = '.dtc.pv2.f5.bb.b--light-gray';
+    var runs = state.api.runs.data;
+
+    if (!runs) {
+      return m('.tc.pa4', state.api.runs.status === 'failure' ? 'Error loading runs.' : 'Loading...');
+    }
+
+    var runsTableEl = m('.dt.w-100', [
+      m('.dt-row', [
+        m(headClass, 'Compare'),
+        m(headClass, 'Id'),
+        m(headClass, 'Strategy'),
+        m(headClass, 'Range'),
+        m(headClass, 'State'),
+        m(headClass+'.tr', 'Starting $'),
+        m(headClass+'.tr', 'Return $'),
+        m(headClass+'.tr', 'Trades'),
+      ]),
+      runs.length === 0 ? m('.dt-row', m('.dtc.f5.pv2', 'No runs.')) : null,
+      runs.map(function (r) {
+        var color = r.totalReturn > 0 ? '.dark-green' : '.red';
+        return m('.dt-row', [
+          m(cellClass, ['a', 'b'].map(function (side) {
+            var selected = state.runsCompare[side] === r.id;
+            return m('button.mr1' + (selected ? '.hk-button--primary' : '.hk-button--secondary'), {
+              onclick: this.select.bind(this, side, r.id),
+            }, side.toUpperCase());
+          }.bind(this))),
+          m(cellClass, r.id),
+          m(cellClass, r.strategy),
+          m(cellClass, r.start.slice(0, 10) + ' - ' + r.end.slice(0, 10)),
+          m(cellClass, r.state),
+          m(cellClass+'.tr', r.startingCash.toFixed(2)),
+          m(cellClass+'.tr'+color, r.totalReturn.toFixed(2)),
+          m(cellClass+'.tr', r.tradeCount),
+        ]);
+      }.bind(this)),
+    ]);
+
+    var compare = state.api.runsCompare.data;
+    var compareEl = null;
+    if (state.runsCompare.a && state.runsCompare.b && compare) {
+      var diffRows = function (values) {
+        return values.map(function (v) {
+          var changed = JSON.stringify(v.a) !== JSON.stringify(v.b);
+          return m('.dt-row' + (changed ? '.b' : ''), [
+            m(cellClass, v.name),
+            m(cellClass+'.tr', JSON.stringify(v.a)),
+            m(cellClass+'.tr', JSON.stringify(v.b)),
+            m(cellClass+'.tr' + (v.delta > 0 ? '.dark-green' : v.delta < 0 ? '.red' : ''), v.delta ? v.delta.toFixed(4) : ''),
+          ]);
+        });
+      };
+      var diffHead = m('.dt-row', [
+        m(headClass, 'Name'),
+        m(headClass+'.tr', 'A: ' + compare.a.id + ' (' + compare.a.strategy + ')'),
+        m(headClass+'.tr', 'B: ' + compare.b.id + ' (' + compare.b.strategy + ')'),
+        m(headClass+'.tr', 'B - A'),
+      ]);
+      compareEl = m('div', [
+        m('h3.fw3.mt3.mb0', 'Params'),
+        m('.dt.w-100', [diffHead].concat(diffRows(compare.params))),
+        m('h3.fw3.mt3.mb0', 'Metrics'),
+        m('.dt.w-100', [diffHead].concat(diffRows(compare.metrics))),
+      ]);
+    }
+
+    return m('.pa2', [
+      m('h3.fw3.mt0.mb0', 'Past Paper Runs'),
+      runsTableEl,
+      compareEl,
     ]);
   },
 };
@@ -736,9 +1054,12 @@ var PageRunProduction = {
         m('button.hk-button--secondary.mr2', {
           onclick: this.refresh.bind(this),
         }, 'Refresh'),
+        (data.apiBudgets || []).map(function(budget) {
+          return m('.f6.gray.mr2', budget.category + ' API calls left: ' + budget.remaining + '/' + budget.perHour);
+        }),
         m('.hk-badge.absolute.right-1'+statusClass, status),
       ]),
-      m(RunStatistics, {data: data, cash: cash}),
+      m(RunStatistics, {data: data, cash: cash, environment: 'production'}),
     ]);
   },
 };
@@ -914,6 +1235,13 @@ var PageLogs = {
 // {{{ App
 var App = {
   oninit: function() {
+    if (!state.api.strategies.data) {
+      simpleRequest(state.api.strategies, '/data/strategies').then(function() {
+        state.strategyOptions = (state.api.strategies.data || []).map(function (s) {
+          return [s.name, s.label];
+        });
+      });
+    }
     if (!state.api.details.data) {
       return simpleRequest(state.api.details, '/data/details');
     }
@@ -927,6 +1255,7 @@ var App = {
 
     var pages = [
       {key: 'run-paper', name: 'Run Paper', component: PageRunPaper},
+      {key: 'runs', name: 'Past Runs', component: PageRuns},
       {key: 'run-staging', name: 'Run Staging', component: PageRunStaging},
       {key: 'run-production', name: 'Run Poduction', component: PageRunProduction},
       {key: 'chart', name: 'Chart', component: PageChart},
@@ -965,114 +1294,6 @@ var App = {
 m.mount(document.getElementById('appRoot'), App);
 
 // {{{ helpers
-function computeTrades(executions) {
-  var trades = [];
-  var openTrades = {};
-  for (var i in executions) {
-    var execution = executions[i];
-    if (execution.symbol in openTrades) {
-      // Append execution to current open trade
-      var t = openTrades[execution.symbol];
-      t.executions.push(execution);
-      if (execution.side === "Buy") {
-        t.quantity += execution.quantity;
-        t.highestQuanity = Math.max(t.highestQuanity, t.quantity);
-      } else {
-        t.quantity -= execution.quantity;
-      }
-
-      // Close trade if qty is back down to 0
-      if (t.quantity === 0) {
-        t.closedAt = new Date(execution.timestamp);
-        t.quantity = t.highestQuanity;
-        t.value = t.highestQuanity * avg(map(prop('price'), t.executions));
-        t.profitBeforeFees = t.executions.reduce(function (t, e) {
-          return t + (e.quantity * e.price * (e.side === "Buy" ? -1 : 1));
-        }, 0);
-        t.fees = sum(map(prop('commission'), t.executions)) +
-          sum(map(prop('secFee'), t.executions)) +
-          sum(map(prop('orderPlacementCommission'), t.executions)) +
-          sum(map(prop('executionFee'), t.executions));
-        t.profit = t.profitBeforeFees - t.fees;
-        t.profitPercent = t.profit / t.value;
-        t.executionsCount = t.executions.length;
-        trades.push(t);
-        delete openTrades[execution.symbol];
-      }
-    } else {
-      // Start a new trade
-      openTrades[execution.symbol] = {
-        symbol: execution.symbol,
-        openedAt: new Date(execution.timestamp),
-        quantity: execution.quantity,
-        highestQuanity: execution.quantity,
-        executions: [execution],
-      };
-    }
-  }
-  return trades;
-}
-
-function computeTradesStats(startingCash, data, trades) {
-  var stats = {};
-
-  var firstTradeDate = min(map(prop('openedAt'), trades));
-  var lastTradeDate = max(map(prop('closedAt'), trades));
-  if (trades.length === 0) {
-    firstTradeDate = new Date();
-    lastTradeDate = new Date();
-  }
-  var delta = lastTradeDate.getTime() - firstTradeDate.getTime();
-
-  var profit = 0;
-  var profitHigh = 0 - Number.MAX_SAFE_INTEGER;
-  var profitAmounts = [];
-  var drawdowns = [];
-  var wins = [];
-  var winsPercents = [];
-  var losses = [];
-  var lossesPercents = [];
-  var timesInTrade = [];
-  for (var i in trades) {
-    var trade = trades[i];
-    profit += trade.profit;
-    profitHigh = Math.max(profitHigh, profit);
-    profitAmounts.push(profit);
-    timesInTrade.push(trade.closedAt.getTime() - trade.openedAt.getTime());
-    drawdowns.push(1 - (profit / profitHigh));
-    if (trade.profit >= 0) {
-      wins.push(trade.profit);
-      winsPercents.push(trade.profitPercent);
-    } else {
-      losses.push(trade.profit);
-      lossesPercents.push(trade.profitPercent);
-    }
-  }
-
-  stats.profitAmounts = profitAmounts;
-  stats.duration = formatDateDuration(firstTradeDate, lastTradeDate);
-  stats.startingCash = startingCash;
-  stats.cash = data.balance.cash + data.balance.marketValue;
-  stats.totalReturn = stats.cash - stats.startingCash;
-  stats.totalFees = sum(map(prop('fees'), trades));
-  stats.totalReturnPercent = (stats.cash / startingCash) - 1;
-  stats.cagr = (stats.totalReturnPercent / (delta / (3600000 * 24))) * 365;
-  stats.sharpe = 0; // (mean return % - risk free %) / return std dev
-  stats.sortino = 0; // (mean return % - risk free %) / downside returns std dev
-  stats.avgDrawdownPercent = avg(drawdowns);
-  stats.maxDrawdownPercent = max(drawdowns);
-  stats.tradeWinPercent = wins.length / trades.length;
-  stats.avgTradePercent = avg(winsPercents.concat(lossesPercents));
-  stats.avgWinPercent = avg(winsPercents);
-  stats.avgLossPercent = avg(lossesPercents);
-  stats.bestTradePercent = max(winsPercents.concat(lossesPercents));
-  stats.worstTradePercent = min(winsPercents.concat(lossesPercents));
-  stats.avgTimeInTrade = avg(timesInTrade);
-  stats.tradeCount = trades.length;
-
-  return stats;
-}
-
 function simpleRequest(stateNode, url) {
   stateNode.status = 'request';
   return m.request({
@@ -1096,12 +1317,14 @@ function backgroundForStatus(status) {
       break;
     case 'stopping':
     case 'stopped':
+    case 'cancelled':
       statusClass = '.bg-orange';
       break;
     case 'running':
       statusClass = '.bg-green';
       break;
     case 'starting':
+    case 'queued':
     case 'done':
       statusClass = '.bg-blue';
       break;
@@ -1127,6 +1350,10 @@ function formatLargeNum(num) {
   }
 }
 
+function formatDate(dateString) {
+  return formatDateTime(dateString).split(' ')[0];
+}
+
 function formatDateTime(dateString) {
   var d = new Date(dateString);
   var date = [
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"sort"
 	"time"
 )
 
@@ -8,6 +10,63 @@ type Strategy interface {
 	Run(time.Time, Datasource, Broker, *OrderManager) error
 }
 
+type StrategyFactory func(params StrategyParams) (Strategy, error)
+
+type StrategyDefinition struct {
+	Name        string           `json:"name"`
+	Label       string           `json:"label"`
+	Description string           `json:"description"`
+	Params      []*StrategyParam `json:"params"`
+	Factory     StrategyFactory  `json:"-"`
+}
+
+var strategyRegistry = map[string]*StrategyDefinition{}
+
+// Called from each strategy file's init() so that the trading manager, the
+// server and the web UI all know about it
+func registerStrategy(definition *StrategyDefinition) {
+	if _, ok := strategyRegistry[definition.Name]; ok {
+		panic("strategy registered twice: " + definition.Name)
+	}
+	strategyRegistry[definition.Name] = definition
+}
+
+func findStrategyDefinition(name string) (*StrategyDefinition, error) {
+	definition, ok := strategyRegistry[name]
+	if !ok {
+		return nil, errors.New("Unknown strategy: " + name)
+	}
+	return definition, nil
+}
+
+func allStrategyDefinitions() []*StrategyDefinition {
+	definitions := []*StrategyDefinition{}
+	for _, d := range strategyRegistry {
+		definitions = append(definitions, d)
+	}
+	sort.Slice(definitions, func(i, j int) bool {
+		return definitions[i].Label < definitions[j].Label
+	})
+	return definitions
+}
+
+// Parses & validates the config against the strategy's params then builds it
+func newStrategy(name, config string) (Strategy, StrategyParams, error) {
+	definition, err := findStrategyDefinition(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	params, err := parseStrategyParams(definition.Params, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	strategy, err := definition.Factory(params)
+	if err != nil {
+		return nil, nil, err
+	}
+	return strategy, params, nil
+}
+
 func candleForRange(candles []*SymbolCandle, start, end time.Time) *SymbolCandle {
 	candle := &SymbolCandle{}
 	var lastCandle *SymbolCandle
@@ -45,77 +104,22 @@ func candlesRange(candles []*SymbolCandle, start, end time.Time) []*SymbolCandle
 	return filteredCandles
 }
 
-func avgClose(candles []*SymbolCandle) float64 {
-	var sum float64
-	for _, c := range candles {
-		sum += c.Close
-	}
-	return sum / float64(len(candles))
-}
-
-func wmaValue(candles []*SymbolCandle) float64 {
-	var denominator = float64((len(candles) * (len(candles) + 1)) / 2)
-	var total float64
-	for i, c := range candles {
-		total += c.Close * (float64(i+1) / denominator)
-	}
-	return total
-}
-
-func fwmaValue(values []float64) float64 {
-	var denominator = float64((len(values) * (len(values) + 1)) / 2)
-	var total float64
-	for i, v := range values {
-		total += v * (float64(i+1) / denominator)
-	}
-	return total
-}
-
-func avg(prices []float64) float64 {
-	var sum float64
-	for _, p := range prices {
-		sum += p
-	}
-	return sum / float64(len(prices))
-}
-
-func rsi(candles []*SymbolCandle) float64 {
-	gains := []float64{}
-	losses := []float64{}
-	for i := 1; i < len(candles); i++ {
-		curr := candles[i].Close
-		last := candles[i-1].Close
-		if curr > last {
-			gains = append(gains, curr-last)
-		} else if last > curr {
-			losses = append(losses, last-curr)
-		}
-	}
-	return 100 - (100 / (1 + (avg(gains) / avg(losses))))
+// Whether day trades can be made at now: from 10am until 10 minutes before
+// market close
+func dayTradeHours(now time.Time) bool {
+	return now.Hour() >= 10 && !(now.Hour() >= 15 && now.Minute() >= 50) && now.Hour() < 16
 }
 
 // Returns true (& ensure all traded symbols are sold) when before 10am or
 // close to market close
 func dayTradePrecheck(om *OrderManager, now time.Time, symbolsTraded []int) (bool, error) {
-	// Wait till 10 am to start
-	if now.Hour() < 10 {
-		for _, s := range symbolsTraded {
-			if err := om.Ensure(s, 0); err != nil {
-				return false, err
-			}
-		}
-		return false, nil
+	if dayTradeHours(now) {
+		return true, nil
 	}
-
-	// End of Day, exit all positions
-	if (now.Hour() >= 15 && now.Minute() >= 50) || now.Hour() >= 16 {
-		for _, s := range symbolsTraded {
-			if err := om.Ensure(s, 0); err != nil {
-				return false, err
-			}
+	for _, s := range symbolsTraded {
+		if err := om.Ensure(s, 0); err != nil {
+			return false, err
 		}
-		return false, nil
 	}
-
-	return true, nil
+	return false, nil
 }
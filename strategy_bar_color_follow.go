@@ -4,17 +4,47 @@ import (
 	"time"
 )
 
-type BarColorFollowStrategy struct{}
+func init() {
+	registerStrategy(&StrategyDefinition{
+		Name:        "bar_color",
+		Label:       "Bar Color Follow",
+		Description: "Buys after 2 strong green 1m bars, sells after 2 red ones",
+		Params:      barColorFollowStrategyParams,
+		Factory: func(params StrategyParams) (Strategy, error) {
+			return NewBarColorFollowStrategy(params), nil
+		},
+	})
+}
+
+var barColorFollowStrategyParams = []*StrategyParam{
+	{Name: "symbolId", Type: StrategyParamTypeInt, Default: 32959, Description: "Symbol traded (TQQQ)"},
+	{Name: "quantity", Type: StrategyParamTypeInt, Default: 100, Min: 1, Max: 100000, Description: "Shares bought on entry"},
+	{Name: "stopDistance", Type: StrategyParamTypeFloat, Default: 0.2, Min: 0, Max: 100, Description: "Stop distance from entry ($)"},
+	{Name: "minMove", Type: StrategyParamTypeFloat, Default: 0.25, Min: 0, Max: 100, Description: "Minimum move over the last 2 green bars ($)"},
+	{Name: "minVolume", Type: StrategyParamTypeInt, Default: 800, Min: 0, Max: 100000000, Description: "Minimum volume of the previous bar"},
+}
 
-func NewBarColorFollowStrategy() *BarColorFollowStrategy {
-	return &BarColorFollowStrategy{}
+type BarColorFollowStrategy struct {
+	symId        int
+	quantity     int64
+	stopDistance float64
+	minMove      float64
+	minVolume    int64
+}
+
+func NewBarColorFollowStrategy(params StrategyParams) *BarColorFollowStrategy {
+	return &BarColorFollowStrategy{
+		symId:        params.Int("symbolId"),
+		quantity:     int64(params.Int("quantity")),
+		stopDistance: params.Float("stopDistance"),
+		minMove:      params.Float("minMove"),
+		minVolume:    int64(params.Int("minVolume")),
+	}
 }
 
 func (s *BarColorFollowStrategy) Run(now time.Time, ds Datasource, b Broker, om *OrderManager) error {
-	var longSymId = 32959
-	//var shortSymId = 16271758
-	var longTargetQty int64 = 100
-	//var shortTargetQty int64 = 300
+	var longSymId = s.symId
+	var longTargetQty = s.quantity
 
 	if canTrade, err := dayTradePrecheck(om, now, []int{longSymId}); err != nil {
 		return err
@@ -52,13 +82,13 @@ func (s *BarColorFollowStrategy) Run(now time.Time, ds Datasource, b Broker, om
 	} else {
 		if currentCandle.Green() && previousCandle.Green() &&
 			currentCandle.Volume > previousCandle.Volume &&
-			currentCandle.Close-previousCandle.Open > 0.25 &&
-			previousCandle.Volume > 800 {
+			currentCandle.Close-previousCandle.Open > s.minMove &&
+			previousCandle.Volume > s.minVolume {
 			if err := om.Ensure(longSymId, longTargetQty); err != nil {
 				return err
 			}
 			if _, err := b.CreateOrder(
-				longSymId, OrderActionSell, OrderTypeStop, currentCandle.Close-0.2, longTargetQty,
+				longSymId, OrderActionSell, OrderTypeStop, currentCandle.Close-s.stopDistance, longTargetQty,
 			); err != nil {
 				return err
 			}
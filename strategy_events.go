@@ -0,0 +1,160 @@
+package main
+
+import "time"
+
+type StrategyContext struct {
+	Now          time.Time
+	Datasource   Datasource
+	Broker       Broker
+	OrderManager *OrderManager
+}
+
+type CandleSubscription struct {
+	SymbolId int
+	Interval CandleInterval
+}
+
+// Optional richer interface a Strategy can implement to get called back by
+// the trading manager instead of having to poll & diff broker state in Run.
+// Run is still called every tick.
+type EventStrategy interface {
+	Strategy
+	Subscriptions() []CandleSubscription
+	OnStart(ctx *StrategyContext) error
+	OnCandleClose(ctx *StrategyContext, sub CandleSubscription, candle *SymbolCandle) error
+	OnFill(ctx *StrategyContext, execution *BrokerExecution) error
+	OnOrderRejected(ctx *StrategyContext, order *BrokerOrder) error
+	OnDayEnd(ctx *StrategyContext, day string) error
+}
+
+// Embed to only implement the callbacks a strategy cares about
+type EventStrategyBase struct{}
+
+func (s *EventStrategyBase) Run(time.Time, Datasource, Broker, *OrderManager) error {
+	return nil
+}
+
+func (s *EventStrategyBase) Subscriptions() []CandleSubscription {
+	return []CandleSubscription{}
+}
+
+func (s *EventStrategyBase) OnStart(ctx *StrategyContext) error {
+	return nil
+}
+
+func (s *EventStrategyBase) OnCandleClose(ctx *StrategyContext, sub CandleSubscription, candle *SymbolCandle) error {
+	return nil
+}
+
+func (s *EventStrategyBase) OnFill(ctx *StrategyContext, execution *BrokerExecution) error {
+	return nil
+}
+
+func (s *EventStrategyBase) OnOrderRejected(ctx *StrategyContext, order *BrokerOrder) error {
+	return nil
+}
+
+func (s *EventStrategyBase) OnDayEnd(ctx *StrategyContext, day string) error {
+	return nil
+}
+
+// Keeps track of what was already dispatched to an EventStrategy so that
+// each candle, fill & rejection is only seen once
+type strategyEventDispatcher struct {
+	strategy           EventStrategy
+	started            bool
+	lastCandleStarts   map[CandleSubscription]time.Time
+	seenExecutions     map[int]bool
+	seenRejectedOrders map[int]bool
+	endedDays          map[string]bool
+}
+
+func newStrategyEventDispatcher(strategy EventStrategy) *strategyEventDispatcher {
+	return &strategyEventDispatcher{
+		strategy:           strategy,
+		lastCandleStarts:   map[CandleSubscription]time.Time{},
+		seenExecutions:     map[int]bool{},
+		seenRejectedOrders: map[int]bool{},
+		endedDays:          map[string]bool{},
+	}
+}
+
+func (d *strategyEventDispatcher) start(ctx *StrategyContext) error {
+	// Fills & rejections that happened before we started aren't ours
+	for _, e := range ctx.Broker.LastExecutions() {
+		d.seenExecutions[e.Id] = true
+	}
+	for _, o := range ctx.Broker.LastOrders() {
+		if isRejectedOrder(o) {
+			d.seenRejectedOrders[o.Id] = true
+		}
+	}
+	d.started = true
+	return d.strategy.OnStart(ctx)
+}
+
+func (d *strategyEventDispatcher) dispatchBrokerEvents(ctx *StrategyContext) error {
+	for _, e := range ctx.Broker.LastExecutions() {
+		if d.seenExecutions[e.Id] {
+			continue
+		}
+		d.seenExecutions[e.Id] = true
+		if err := d.strategy.OnFill(ctx, e); err != nil {
+			return err
+		}
+	}
+	for _, o := range ctx.Broker.LastOrders() {
+		if !isRejectedOrder(o) || d.seenRejectedOrders[o.Id] {
+			continue
+		}
+		d.seenRejectedOrders[o.Id] = true
+		if err := d.strategy.OnOrderRejected(ctx, o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *strategyEventDispatcher) dispatchCandles(ctx *StrategyContext) error {
+	y, m, day := ctx.Now.Date()
+	startOfDay := time.Date(y, m, day, 0, 0, 0, 0, ctx.Now.Location())
+
+	for _, sub := range d.strategy.Subscriptions() {
+		// Datasources serve candles a day at a time
+		start := startOfDay
+		if last, ok := d.lastCandleStarts[sub]; ok && last.After(start) {
+			start = last
+		}
+		candles, err := ctx.Datasource.Candles(sub.SymbolId, start, ctx.Now, sub.Interval)
+		if err != nil {
+			return err
+		}
+		for _, c := range candles {
+			if !c.Start.After(d.lastCandleStarts[sub]) {
+				continue
+			}
+			// Only closed candles, the last one is usually still forming
+			if c.Start.Add(sub.Interval.Duration()).After(ctx.Now) {
+				break
+			}
+			d.lastCandleStarts[sub] = c.Start
+			if err := d.strategy.OnCandleClose(ctx, sub, c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *strategyEventDispatcher) dispatchDayEnd(ctx *StrategyContext) error {
+	day := ctx.Now.Format(dateFormat)
+	if ctx.Now.Hour() < 16 || d.endedDays[day] {
+		return nil
+	}
+	d.endedDays[day] = true
+	return d.strategy.OnDayEnd(ctx, day)
+}
+
+func isRejectedOrder(o *BrokerOrder) bool {
+	return o.State == OrderStateRejected || o.State == OrderStateFailed
+}
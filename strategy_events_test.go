@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+type recordingStrategy struct {
+	EventStrategyBase
+	fills    []*BrokerExecution
+	rejected []*BrokerOrder
+}
+
+func (s *recordingStrategy) OnFill(ctx *StrategyContext, execution *BrokerExecution) error {
+	s.fills = append(s.fills, execution)
+	return nil
+}
+
+func (s *recordingStrategy) OnOrderRejected(ctx *StrategyContext, order *BrokerOrder) error {
+	s.rejected = append(s.rejected, order)
+	return nil
+}
+
+func TestDispatcherReportsFillsAndPaperRejectionsOnce(t *testing.T) {
+	tm, b := newTestPaperBroker(t)
+	b.cash = 1000
+	strategy := &recordingStrategy{}
+	dispatcher := newStrategyEventDispatcher(strategy)
+	ctx := &StrategyContext{
+		Now: tm.now, Datasource: tm.datasource, Broker: b, OrderManager: NewOrderManager(b, NewNullLogger()),
+	}
+	if err := dispatcher.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.CreateOrder(testSymbolId, OrderActionBuy, OrderTypeMarket, 0, 5); err != nil {
+		t.Fatal(err)
+	}
+	// Needs $5000 of equity
+	_, err := b.CreateOrder(testSymbolId, OrderActionBuy, OrderTypeMarket, 0, 100)
+	rejection, ok := err.(*OrderRejectedError)
+	if !ok || !isOrderRejected(err) {
+		t.Fatalf("got error %v, want an OrderRejectedError", err)
+	}
+	if rejection.Order == nil || rejection.Order.State != OrderStateRejected {
+		t.Fatalf("rejected order is %+v, want it in the Rejected state", rejection.Order)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := dispatcher.dispatchBrokerEvents(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(strategy.fills) != 1 || strategy.fills[0].Quantity != 5 {
+		t.Errorf("got %d fills, want the 5 shares bought once", len(strategy.fills))
+	}
+	if len(strategy.rejected) != 1 || strategy.rejected[0].Id != rejection.Order.Id {
+		t.Errorf("got %d rejections, want the rejected order once", len(strategy.rejected))
+	}
+}
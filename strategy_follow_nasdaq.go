@@ -2,21 +2,43 @@ package main
 
 import "time"
 
+func init() {
+	registerStrategy(&StrategyDefinition{
+		Name:        "follow_nasdaq",
+		Label:       "Nasdaq Follow",
+		Description: "Buys at 10am with a tight stop and holds till the close",
+		Params:      followNasdaqStrategyParams,
+		Factory: func(params StrategyParams) (Strategy, error) {
+			return NewFollowNasdaqStrategy(params), nil
+		},
+	})
+}
+
+var followNasdaqStrategyParams = []*StrategyParam{
+	{Name: "symbolId", Type: StrategyParamTypeInt, Default: 32959, Description: "Symbol traded (TQQQ)"},
+	{Name: "quantity", Type: StrategyParamTypeInt, Default: 100, Min: 1, Max: 100000, Description: "Shares bought at 10am"},
+	{Name: "maxDayLossPercent", Type: StrategyParamTypeFloat, Default: 0.0015, Min: 0, Max: 0.5, Description: "Stop distance (% of entry price)"},
+}
+
 type FollowNasdaqStrategy struct {
+	symId             int
+	quantity          int64
 	dayEntry          map[string]bool
 	maxDayLossPercent float64
 }
 
-func NewFollowNasdaqStrategy() *FollowNasdaqStrategy {
+func NewFollowNasdaqStrategy(params StrategyParams) *FollowNasdaqStrategy {
 	return &FollowNasdaqStrategy{
+		symId:             params.Int("symbolId"),
+		quantity:          int64(params.Int("quantity")),
 		dayEntry:          map[string]bool{},
-		maxDayLossPercent: 0.0015,
+		maxDayLossPercent: params.Float("maxDayLossPercent"),
 	}
 }
 
 func (s *FollowNasdaqStrategy) Run(now time.Time, ds Datasource, b Broker, om *OrderManager) error {
-	var symId int = 32959
-	var qty int64 = 100
+	var symId = s.symId
+	var qty = s.quantity
 
 	if now.Hour() < 10 {
 		return nil
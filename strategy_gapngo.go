@@ -5,20 +5,37 @@ import (
 	"time"
 )
 
-type GapNGoStrategy struct {
-	symbolIds  []int
-	cash       float64
-	daysTraded map[string]float64
+func init() {
+	registerStrategy(&StrategyDefinition{
+		Name:        "gapngo",
+		Label:       "Gap-N-Go",
+		Description: "Buys a breakout of the 9:30 to 10am range",
+		Params:      gapNGoStrategyParams,
+		Factory: func(params StrategyParams) (Strategy, error) {
+			return NewGapNGoStrategy(params), nil
+		},
+	})
+}
+
+var gapNGoStrategyParams = []*StrategyParam{
+	{Name: "symbolIds", Type: StrategyParamTypeIntList, Default: []int{32959}, Description: "Symbols traded (TQQQ)"},
+	{Name: "cash", Type: StrategyParamTypeFloat, Default: 10000.0, Min: 1, Max: 1000000, Description: "Cash split between all symbols"},
+	{Name: "stopRetracement", Type: StrategyParamTypeFloat, Default: 0.75, Min: 0, Max: 1, Description: "Stop placement within the opening range (0 = low, 1 = high)"},
 }
 
-func NewGapNGoStrategy() *GapNGoStrategy {
-	var tqqq = 32959
-	//var sqqq = 16271758
+type GapNGoStrategy struct {
+	symbolIds       []int
+	cash            float64
+	stopRetracement float64
+	daysTraded      map[string]float64
+}
 
+func NewGapNGoStrategy(params StrategyParams) *GapNGoStrategy {
 	return &GapNGoStrategy{
-		symbolIds:  []int{tqqq},
-		cash:       10000,
-		daysTraded: map[string]float64{},
+		symbolIds:       params.Ints("symbolIds"),
+		cash:            params.Float("cash"),
+		stopRetracement: params.Float("stopRetracement"),
+		daysTraded:      map[string]float64{},
 	}
 }
 
@@ -73,7 +90,7 @@ func (s *GapNGoStrategy) Run(now time.Time, ds Datasource, b Broker, om *OrderMa
 		openLow, openHigh := closeLowHigh(openCandles)
 
 		if lastPrice > openHigh {
-			stopPrice := openLow + ((openHigh - openLow) * 0.75)
+			stopPrice := openLow + ((openHigh - openLow) * s.stopRetracement)
 			fmt.Println(startOfDay.Format(dateTimeFormat), lastPrice, openLow, openHigh, stopPrice)
 			if err := om.Buy(symbolId, targetQty, stopPrice); err != nil {
 				return err
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"time"
 )
 
@@ -32,34 +33,78 @@ import (
 // var xiv = 15121     // volatility
 // var yinn = 16126    // china
 // var edc = 13285015  // emerging markets
+// var drn = 16124     // real estate
+// var soxl = 16114    // semiconductor
+// var spy = 34987     // S&P 1x
+// var tqqq = 32959    // nasdaq 100
+// var ubio = 11831068 // biotech
+// var drip = 14888420 // oil & gas services s&p bear
+// var dwt = 15968521  // crude oil bear
+// var labu = 13285018 // biotech
 
-type LongMAStrategy struct {
-	symbolIds    []int
-	fastMASize   int
-	slowMASize   int
-	startingCash float64
-	closes       map[string][]float64
-	lastMinute   int
+func init() {
+	registerStrategy(&StrategyDefinition{
+		Name:        "long_ma",
+		Label:       "MA Crossover",
+		Description: "Buys when the fast 5m WMA crosses over the slow WMA, sells when it crosses back",
+		Params:      longMAStrategyParams,
+		Factory: func(params StrategyParams) (Strategy, error) {
+			s, err := NewLongMAStrategy(params)
+			if err != nil {
+				return nil, err
+			}
+			return s, nil
+		},
+	})
 }
 
-func NewLongMAStrategy() *LongMAStrategy {
-	// var drn = 16124     // real estate
-	// var soxl = 16114    // semiconductor
-	// var spy = 34987     // S&P 1x
-	// var tqqq = 32959    // nasdaq 100
-	// var ubio = 11831068 // biotech
-	var drip = 14888420 // oil & gas services s&p bear
-	var dwt = 15968521  // crude oil bear
-	var labu = 13285018 // biotech
+var longMAStrategyParams = []*StrategyParam{
+	{Name: "symbolIds", Type: StrategyParamTypeIntList, Default: []int{13285018, 14888420, 15968521}, Description: "Symbols traded (LABU, DRIP, DWT)"},
+	{Name: "fastMASize", Type: StrategyParamTypeInt, Default: 8, Min: 1, Max: 100, Description: "Fast WMA size in 5m bars"},
+	{Name: "slowMASize", Type: StrategyParamTypeInt, Default: 21, Min: 2, Max: 36, Description: "Slow WMA size in 5m bars"},
+	{Name: "startingCash", Type: StrategyParamTypeFloat, Default: 1000.0, Min: 1, Max: 1000000, Description: "Cash split between all symbols"},
+	{Name: "entryCrossover", Type: StrategyParamTypeFloat, Default: 0.005, Min: 0, Max: 0.1, Description: "MA spread (% of price) over which we buy"},
+	{Name: "exitCrossover", Type: StrategyParamTypeFloat, Default: 0.001, Min: -0.1, Max: 0.1, Description: "MA spread (% of price) under which we sell"},
+	{Name: "stopPercent", Type: StrategyParamTypeFloat, Default: 0.0025, Min: 0, Max: 0.2, Description: "Stop distance (% of entry price)"},
+	{Name: "minStop", Type: StrategyParamTypeFloat, Default: 0.02, Min: 0, Max: 10, Description: "Minimum stop distance ($)"},
+	{Name: "breakevenTrigger", Type: StrategyParamTypeFloat, Default: 0.0035, Min: 0, Max: 0.2, Description: "Gain (%) after which the stop moves to breakeven"},
+	{Name: "trailPercent", Type: StrategyParamTypeFloat, Default: 0.0, Min: 0, Max: 20, Description: "Stop trailing this % under the high, instead of the fixed stop moved to breakeven (0)"},
+}
 
-	return &LongMAStrategy{
-		symbolIds:    []int{labu, drip, dwt},
-		fastMASize:   8,
-		slowMASize:   21,
-		startingCash: 1000,
-		closes:       map[string][]float64{},
-		lastMinute:   -1,
+type LongMAStrategy struct {
+	symbolIds        []int
+	fastMASize       int
+	slowMASize       int
+	startingCash     float64
+	entryCrossover   float64
+	exitCrossover    float64
+	stopPercent      float64
+	minStop          float64
+	breakevenTrigger float64
+	trailPercent     float64
+	closes           map[string][]float64
+	lastMinute       int
+}
+
+func NewLongMAStrategy(params StrategyParams) (*LongMAStrategy, error) {
+	s := &LongMAStrategy{
+		symbolIds:        params.Ints("symbolIds"),
+		fastMASize:       params.Int("fastMASize"),
+		slowMASize:       params.Int("slowMASize"),
+		startingCash:     params.Float("startingCash"),
+		entryCrossover:   params.Float("entryCrossover"),
+		exitCrossover:    params.Float("exitCrossover"),
+		stopPercent:      params.Float("stopPercent"),
+		minStop:          params.Float("minStop"),
+		breakevenTrigger: params.Float("breakevenTrigger"),
+		trailPercent:     params.Float("trailPercent"),
+		closes:           map[string][]float64{},
+		lastMinute:       -1,
+	}
+	if s.fastMASize >= s.slowMASize {
+		return nil, errors.New("strategy config: fastMASize must be smaller than slowMASize")
 	}
+	return s, nil
 }
 
 func (s *LongMAStrategy) Run(now time.Time, ds Datasource, b Broker, om *OrderManager) error {
@@ -80,18 +125,11 @@ func (s *LongMAStrategy) Run(now time.Time, ds Datasource, b Broker, om *OrderMa
 
 	for _, symbolId := range s.symbolIds {
 		position := om.CurrentPositionForIncludingPending(symbolId)
-		if position.OpenQuantity > 0 {
-			quantity := position.OpenQuantity
+		if position.OpenQuantity > 0 && s.trailPercent == 0 {
 			entryPrice := position.CurrentPrice
 			currentPrice := position.AverageEntryPrice
-			if currentPrice/entryPrice > 1.0035 {
-				if err := om.CancelAllStops(symbolId); err != nil {
-					return err
-				}
-				if _, err := om.broker.CreateOrder(
-					symbolId, OrderActionSell, OrderTypeStop,
-					position.AverageEntryPrice+0.03, quantity,
-				); err != nil {
+			if currentPrice/entryPrice > 1+s.breakevenTrigger {
+				if err := om.MoveAllStops(symbolId, position.AverageEntryPrice+0.03); err != nil {
 					return err
 				}
 			}
@@ -109,11 +147,11 @@ func (s *LongMAStrategy) Run(now time.Time, ds Datasource, b Broker, om *OrderMa
 		positionSize := s.startingCash / float64(len(s.symbolIds))
 		lastPrice := candles[len(candles)-1].Close
 
-		currentCandleFastMA := wmaValue(candles[s.slowMASize-s.fastMASize:])
-		currentCandleSlowMA := wmaValue(candles)
+		currentCandleFastMA := indicatorValue(NewWMA(s.fastMASize), candles)
+		currentCandleSlowMA := indicatorValue(NewWMA(s.slowMASize), candles)
 		crossoverSize := (currentCandleFastMA - currentCandleSlowMA) / lastPrice
 
-		if crossoverSize > 0.005 {
+		if crossoverSize > s.entryCrossover {
 			position := om.CurrentPositionForIncludingPending(symbolId)
 			if position.OpenQuantity == 0 {
 				quote, err := ds.Quote(symbolId)
@@ -122,14 +160,23 @@ func (s *LongMAStrategy) Run(now time.Time, ds Datasource, b Broker, om *OrderMa
 				}
 				lastPrice = quote.AskPrice
 				targetQty := int64(positionSize / lastPrice)
-				stopSpread := fmax(lastPrice*0.0025, 0.02) // minimum 0.02$ stop
+				stopSpread := fmax(lastPrice*s.stopPercent, s.minStop)
 				stopPrice := lastPrice - stopSpread
-				if err := om.Buy(symbolId, targetQty, stopPrice); err != nil {
+				if s.trailPercent > 0 {
+					if _, err := om.PlaceBracket(BracketOrder{
+						SymbolId: symbolId,
+						Action:   OrderActionBuy,
+						Quantity: targetQty,
+						Trail:    &Trail{Type: TrailTypePercent, Value: s.trailPercent},
+					}); err != nil {
+						return err
+					}
+				} else if err := om.Buy(symbolId, targetQty, stopPrice); err != nil {
 					return err
 				}
 			}
 		}
-		if crossoverSize < 0.001 {
+		if crossoverSize < s.exitCrossover {
 			if err := om.SellAll(symbolId); err != nil {
 				return err
 			}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+type StrategyParamType string
+
+const (
+	StrategyParamTypeInt     StrategyParamType = "int"
+	StrategyParamTypeFloat                     = "float"
+	StrategyParamTypeIntList                   = "int_list"
+)
+
+// Describes a single tunable value of a strategy. Min & Max are only enforced
+// when Max > Min, for int_list they apply to every element of the list.
+type StrategyParam struct {
+	Name        string            `json:"name"`
+	Type        StrategyParamType `json:"type"`
+	Default     interface{}       `json:"default"`
+	Min         float64           `json:"min"`
+	Max         float64           `json:"max"`
+	Description string            `json:"description"`
+}
+
+// Parsed & validated strategy config, values are int, float64 or []int
+// depending on the param type
+type StrategyParams map[string]interface{}
+
+func (p StrategyParams) Int(name string) int {
+	return p[name].(int)
+}
+
+func (p StrategyParams) Float(name string) float64 {
+	return p[name].(float64)
+}
+
+func (p StrategyParams) Ints(name string) []int {
+	return p[name].([]int)
+}
+
+// Parses a JSON object config string against a strategy's param schema, any
+// param missing from the config gets it's default value. An empty config
+// string means all defaults.
+func parseStrategyParams(schema []*StrategyParam, config string) (StrategyParams, error) {
+	var values = map[string]interface{}{}
+	if strings.TrimSpace(config) != "" {
+		if err := json.Unmarshal([]byte(config), &values); err != nil {
+			return nil, errors.New("strategy config: " + err.Error())
+		}
+	}
+
+	params := StrategyParams{}
+	for _, param := range schema {
+		raw, ok := values[param.Name]
+		if !ok || raw == nil {
+			raw = param.Default
+		}
+		value, err := param.parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("strategy config: %s: %s", param.Name, err.Error())
+		}
+		params[param.Name] = value
+		delete(values, param.Name)
+	}
+
+	for name := range values {
+		return nil, fmt.Errorf("strategy config: unknown param: %s", name)
+	}
+	return params, nil
+}
+
+func (param *StrategyParam) parse(raw interface{}) (interface{}, error) {
+	switch param.Type {
+	case StrategyParamTypeInt:
+		f, err := param.parseNumber(raw)
+		if err != nil {
+			return nil, err
+		}
+		if f != math.Trunc(f) {
+			return nil, fmt.Errorf("expected an integer, got %v", f)
+		}
+		return int(f), nil
+	case StrategyParamTypeFloat:
+		return param.parseNumber(raw)
+	case StrategyParamTypeIntList:
+		var rawValues []interface{}
+		switch v := raw.(type) {
+		case []int:
+			for _, i := range v {
+				rawValues = append(rawValues, i)
+			}
+		case []interface{}:
+			rawValues = v
+		default:
+			return nil, fmt.Errorf("expected a list, got %v", raw)
+		}
+		if len(rawValues) == 0 {
+			return nil, errors.New("expected at least one value")
+		}
+		ints := []int{}
+		for _, rawValue := range rawValues {
+			f, err := param.parseNumber(rawValue)
+			if err != nil {
+				return nil, err
+			}
+			if f != math.Trunc(f) {
+				return nil, fmt.Errorf("expected an integer, got %v", f)
+			}
+			ints = append(ints, int(f))
+		}
+		return ints, nil
+	default:
+		return nil, errors.New("unknown param type: " + string(param.Type))
+	}
+}
+
+func (param *StrategyParam) parseNumber(raw interface{}) (float64, error) {
+	var f float64
+	switch v := raw.(type) {
+	case int:
+		f = float64(v)
+	case int64:
+		f = float64(v)
+	case float64:
+		f = v
+	default:
+		return 0, fmt.Errorf("expected a number, got %v", raw)
+	}
+	if param.Max > param.Min && (f < param.Min || f > param.Max) {
+		return 0, fmt.Errorf("%v is out of range [%v, %v]", f, param.Min, param.Max)
+	}
+	return f, nil
+}
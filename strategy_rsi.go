@@ -2,103 +2,151 @@ package main
 
 import "time"
 
+func init() {
+	registerStrategy(&StrategyDefinition{
+		Name:        "rsi",
+		Label:       "RSI",
+		Description: "Trades TQQQ/SQQQ (or shorts the long symbol) based on the intraday 1m RSI",
+		Params:      rsiStrategyParams,
+		Factory: func(params StrategyParams) (Strategy, error) {
+			return NewRsiStrategy(params), nil
+		},
+	})
+}
+
+var rsiStrategyParams = []*StrategyParam{
+	{Name: "longSymbolId", Type: StrategyParamTypeInt, Default: 32959, Description: "Symbol bought when RSI is high (TQQQ)"},
+	{Name: "shortSymbolId", Type: StrategyParamTypeInt, Default: 16271758, Description: "Symbol bought when RSI is low (SQQQ)"},
+	{Name: "longQuantity", Type: StrategyParamTypeInt, Default: 100, Min: 1, Max: 100000, Description: "Shares bought of the long symbol"},
+	{Name: "shortQuantity", Type: StrategyParamTypeInt, Default: 300, Min: 1, Max: 100000, Description: "Shares bought of the short symbol (or sold short)"},
+	{Name: "shortSelling", Type: StrategyParamTypeInt, Default: 0, Min: 0, Max: 1, Description: "1 sells the long symbol short (e.g. QQQ) instead of buying the short symbol"},
+	{Name: "rsiSize", Type: StrategyParamTypeInt, Default: 15, Min: 2, Max: 200, Description: "RSI size in 1m bars"},
+	{Name: "longThreshold", Type: StrategyParamTypeFloat, Default: 60.0, Min: 0, Max: 100, Description: "RSI over which we go long"},
+	{Name: "shortThreshold", Type: StrategyParamTypeFloat, Default: 40.0, Min: 0, Max: 100, Description: "RSI under which we go short"},
+	{Name: "stopDistance", Type: StrategyParamTypeFloat, Default: 1.0, Min: 0, Max: 100, Description: "Stop distance from entry ($)"},
+	{Name: "limitDistance", Type: StrategyParamTypeFloat, Default: 1.0, Min: 0, Max: 100, Description: "Take profit distance from entry ($)"},
+}
+
+// Follows the RSI of the long symbol's 1m candles of the day, updated as they
+// close
 type RsiStrategy struct {
-	lastStopOrder *BrokerOrder
+	EventStrategyBase
+	longSymId      int
+	shortSymId     int
+	longTargetQty  int64
+	shortTargetQty int64
+	shortSelling   bool
+	rsiSize        int
+	longThreshold  float64
+	shortThreshold float64
+	stopDistance   float64
+	limitDistance  float64
+	// RSI of the day's long symbol candles, and the day it's for
+	rsi    *RSI
+	rsiDay string
+	// Close of the last candle of each symbol
+	lastCloses map[int]float64
+	// Stop & take profit of the position in each symbol
+	exits map[int]*OrderGroup
 }
 
-func NewRsiStrategy() *RsiStrategy {
-	return &RsiStrategy{}
+func NewRsiStrategy(params StrategyParams) *RsiStrategy {
+	return &RsiStrategy{
+		longSymId:      params.Int("longSymbolId"),
+		shortSymId:     params.Int("shortSymbolId"),
+		longTargetQty:  int64(params.Int("longQuantity")),
+		shortTargetQty: int64(params.Int("shortQuantity")),
+		shortSelling:   params.Int("shortSelling") == 1,
+		rsiSize:        params.Int("rsiSize"),
+		longThreshold:  params.Float("longThreshold"),
+		shortThreshold: params.Float("shortThreshold"),
+		stopDistance:   params.Float("stopDistance"),
+		limitDistance:  params.Float("limitDistance"),
+		lastCloses:     map[int]float64{},
+		exits:          map[int]*OrderGroup{},
+	}
 }
 
+// Exits everything outside of trading hours, trades are made as candles close
 func (s *RsiStrategy) Run(now time.Time, ds Datasource, b Broker, om *OrderManager) error {
-	var longSymId = 32959
-	var shortSymId = 16271758
-	var longTargetQty int64 = 100  // TQQQ runs at around 100$ a share so ~ 10k
-	var shortTargetQty int64 = 300 // SQQQ runs at around 33$ a share so ~ 10k
-	var rsiSize = 15
-
-	if canTrade, err := dayTradePrecheck(om, now, []int{longSymId, shortSymId}); err != nil {
+	if canTrade, err := dayTradePrecheck(om, now, []int{s.longSymId, s.shortSymId}); err != nil || canTrade {
 		return err
-	} else if !canTrade {
-		// Make sure to cancel our stop if outside trading hours
-		if err := om.CancelAllStops(longSymId); err != nil {
-			return err
-		}
-		if err := om.CancelAllLimits(longSymId); err != nil {
+	}
+	// Make sure to cancel our stop if outside trading hours
+	for _, symId := range []int{s.longSymId, s.shortSymId} {
+		if err := s.cancelExits(om, symId); err != nil {
 			return err
 		}
-		if err := om.CancelAllStops(shortSymId); err != nil {
+		if err := om.CancelAllStops(symId); err != nil {
 			return err
 		}
-		if err := om.CancelAllLimits(shortSymId); err != nil {
+		if err := om.CancelAllLimits(symId); err != nil {
 			return err
 		}
-		return nil
 	}
+	return nil
+}
 
-	positions := b.LastPositions()
-	for _, p := range positions {
-		if p.OpenQuantity == 0 {
-			// Ensure all limits are cancelled if OpenQuantity drops to 0
-			if err := om.CancelAllLimits(p.SymbolId); err != nil {
-				return err
-			}
-		} else if s.lastStopOrder != nil && p.OpenQuantity < s.lastStopOrder.TotalQuantity {
-			// Ensure all stops are adjusted when limits are reached
-			if err := om.CancelAllStops(p.SymbolId); err != nil {
-				return err
-			}
-			if o, err := b.CreateOrder(
-				s.lastStopOrder.SymbolId, OrderActionSell, OrderTypeStop,
-				s.lastStopOrder.StopPrice, p.OpenQuantity,
-			); err != nil {
-				return err
-			} else {
-				s.lastStopOrder = o
-			}
-		}
+// The short symbol first, so that its last close is known when the long
+// symbol's candle of the same minute moves the RSI
+func (s *RsiStrategy) Subscriptions() []CandleSubscription {
+	return []CandleSubscription{
+		{SymbolId: s.shortSymId, Interval: CandleIntervalOneMinute},
+		{SymbolId: s.longSymId, Interval: CandleIntervalOneMinute},
 	}
+}
 
-	startOfDay := now.Add(-12 * time.Hour).Round(24 * time.Hour).Add((9.5 * 60) * time.Minute)
-	candles, err := ds.Candles(longSymId, startOfDay, now, CandleIntervalOneMinute)
-	if err != nil {
-		return err
+func (s *RsiStrategy) OnCandleClose(ctx *StrategyContext, sub CandleSubscription, candle *SymbolCandle) error {
+	// Only regular hours candles count
+	if h, m, _ := candle.Start.In(ctx.Now.Location()).Clock(); h*60+m < 9*60+30 {
+		return nil
 	}
-	shortCandles, err := ds.Candles(shortSymId, startOfDay, now, CandleIntervalOneMinute)
-	if err != nil {
-		return err
+	s.lastCloses[sub.SymbolId] = candle.Close
+	if sub.SymbolId != s.longSymId {
+		return nil
 	}
-
-	lastIndex := len(candles) - 1
-
-	// Missing bars for RSI
-	if lastIndex <= rsiSize {
+	if day := candle.Start.Format(dateFormat); day != s.rsiDay {
+		s.rsi, s.rsiDay = NewRSI(s.rsiSize), day
+	}
+	s.rsi.Update(candle)
+	if !s.rsi.Ready() || !dayTradeHours(ctx.Now) {
 		return nil
 	}
 
-	currentCandleRSI := rsi(candles[lastIndex-rsiSize : lastIndex])
-
+	om := ctx.OrderManager
+	rsi := s.rsi.Value()
 	// Go long when oversold
-	if currentCandleRSI > 60 {
-		stopPrice := candles[len(candles)-1].Close - 1
-		limitPrice := candles[len(candles)-1].Close + 1
-		if err := s.buy(b, om, longSymId, longTargetQty, stopPrice, limitPrice); err != nil {
+	if rsi > s.longThreshold {
+		stopPrice := candle.Close - s.stopDistance
+		limitPrice := candle.Close + s.limitDistance
+		if err := s.enter(om, s.longSymId, s.longTargetQty, stopPrice, limitPrice); err != nil {
 			return err
 		}
 
-		if err := s.sell(om, shortSymId); err != nil {
+		if err := s.exit(om, s.shortSymId); err != nil {
 			return err
 		}
 	}
 	// Go short when overbought
-	if currentCandleRSI < 40 {
-		if err := s.sell(om, longSymId); err != nil {
+	if rsi < s.shortThreshold && s.shortSelling {
+		// Protected by a buy stop above & a buy limit below
+		stopPrice := candle.Close + s.stopDistance
+		limitPrice := candle.Close - s.limitDistance
+		if err := s.enter(om, s.longSymId, -s.shortTargetQty, stopPrice, limitPrice); err != nil {
+			return err
+		}
+	} else if rsi < s.shortThreshold {
+		if err := s.exit(om, s.longSymId); err != nil {
 			return err
 		}
 
-		stopPrice := shortCandles[len(shortCandles)-1].Close - 1
-		limitPrice := shortCandles[len(shortCandles)-1].Close + 1
-		if err := s.buy(b, om, shortSymId, shortTargetQty, stopPrice, limitPrice); err != nil {
+		shortClose, ok := s.lastCloses[s.shortSymId]
+		if !ok {
+			return nil
+		}
+		stopPrice := shortClose - s.stopDistance
+		limitPrice := shortClose + s.limitDistance
+		if err := s.enter(om, s.shortSymId, s.shortTargetQty, stopPrice, limitPrice); err != nil {
 			return err
 		}
 	}
@@ -106,43 +154,50 @@ func (s *RsiStrategy) Run(now time.Time, ds Datasource, b Broker, om *OrderManag
 	return nil
 }
 
-func (s *RsiStrategy) buy(
-	b Broker, om *OrderManager, symId int, qty int64,
-	stopPrice float64, limitPrice float64,
-) error {
-	if err := om.Ensure(symId, qty); err != nil {
-		return err
-	}
-	if err := om.CancelAllStops(symId); err != nil {
-		return err
+// A rejected entry leaves the position as it was, its exits stay. Without a
+// position there's nothing for them to protect.
+func (s *RsiStrategy) OnOrderRejected(ctx *StrategyContext, order *BrokerOrder) error {
+	for _, p := range ctx.Broker.LastPositions() {
+		if p.SymbolId == order.SymbolId && p.OpenQuantity != 0 {
+			return nil
+		}
 	}
-	if err := om.CancelAllLimits(symId); err != nil {
+	return s.cancelExits(ctx.OrderManager, order.SymbolId)
+}
+
+// Gets qty shares of symId, sold short when negative, with a stop & a limit
+// on half of them closing the position. The stop shrinks to what's left once
+// the limit fills.
+func (s *RsiStrategy) enter(om *OrderManager, symId int, qty int64, stopPrice float64, limitPrice float64) error {
+	if err := om.Ensure(symId, qty); err != nil {
 		return err
 	}
-	if o, err := b.CreateOrder(
-		symId, OrderActionSell, OrderTypeStop, stopPrice, qty,
-	); err != nil {
+	if err := s.cancelExits(om, symId); err != nil {
 		return err
-	} else {
-		s.lastStopOrder = o
 	}
-	if _, err := b.CreateOrder(
-		symId, OrderActionSell, OrderTypeLimit, limitPrice, qty/2,
-	); err != nil {
+	exits, err := om.PlaceOCO(
+		symId, qty,
+		&OrderGroupLeg{Type: OrderTypeStop, Price: stopPrice},
+		&OrderGroupLeg{Type: OrderTypeLimit, Price: limitPrice, Quantity: abs64(qty) / 2},
+	)
+	if err != nil {
 		return err
 	}
+	s.exits[symId] = exits
 	return nil
 }
 
-func (s *RsiStrategy) sell(om *OrderManager, symId int) error {
+func (s *RsiStrategy) exit(om *OrderManager, symId int) error {
 	if err := om.Ensure(symId, 0); err != nil {
 		return err
 	}
-	if err := om.CancelAllStops(symId); err != nil {
-		return err
-	}
-	if err := om.CancelAllLimits(symId); err != nil {
-		return err
+	return s.cancelExits(om, symId)
+}
+
+func (s *RsiStrategy) cancelExits(om *OrderManager, symId int) error {
+	if exits, ok := s.exits[symId]; ok {
+		delete(s.exits, symId)
+		return om.CancelGroup(exits)
 	}
 	return nil
 }
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const sweepsFolder = "data/sweeps"
+
+// Values a param takes during a sweep, either an explicit list of values
+// ([5, 8, 12]) or a range ({"from": 5, "to": 12, "step": 1})
+type SweepRange struct {
+	Values []float64
+}
+
+func (r *SweepRange) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &r.Values); err == nil {
+		return nil
+	}
+	var value float64
+	if err := json.Unmarshal(data, &value); err == nil {
+		r.Values = []float64{value}
+		return nil
+	}
+	var fromTo struct {
+		From float64 `json:"from"`
+		To   float64 `json:"to"`
+		Step float64 `json:"step"`
+	}
+	if err := json.Unmarshal(data, &fromTo); err != nil {
+		return errors.New("sweep range: expected a number, a list or {from, to, step}")
+	}
+	if fromTo.Step <= 0 {
+		return errors.New("sweep range: step must be positive")
+	}
+	// Stepping with an index avoids accumulating float errors
+	for i := 0; fromTo.From+float64(i)*fromTo.Step <= fromTo.To+fromTo.Step/1000; i++ {
+		r.Values = append(r.Values, froundn(fromTo.From+float64(i)*fromTo.Step, 8))
+	}
+	return nil
+}
+
+func (r SweepRange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.Values)
+}
+
+type SweepSpec struct {
+	Strategy string                 `json:"strategy"`
+	Start    string                 `json:"start"`
+	End      string                 `json:"end"`
+	Cash     float64                `json:"cash"`
+	Params   map[string]*SweepRange `json:"params"`
+	// Params kept the same for every run, can be an int list
+	Fixed   map[string]interface{} `json:"fixed"`
+	Metric  string                 `json:"metric"`
+	Workers int                    `json:"workers"`
+	Broker  PaperBrokerConfig      `json:"broker"`
+}
+
+type SweepResult struct {
+	Rank    int                    `json:"rank"`
+	Params  map[string]interface{} `json:"params"`
+	Score   float64                `json:"score"`
+	Metrics *RunMetrics            `json:"metrics"`
+	Error   string                 `json:"error,omitempty"`
+}
+
+type Sweep struct {
+	Id        string         `json:"id"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Spec      *SweepSpec     `json:"spec"`
+	Results   []*SweepResult `json:"results"`
+}
+
+// Metrics where smaller is better, everything else is ranked descending
+var sweepAscendingMetrics = map[string]bool{
+	"maxDrawdown":        true,
+	"maxDrawdownPercent": true,
+	"maxDrawdownMinutes": true,
+	"totalFees":          true,
+	"commissions":        true,
+	"secFees":            true,
+}
+
+func (spec *SweepSpec) validate() error {
+	if _, err := findStrategyDefinition(spec.Strategy); err != nil {
+		return err
+	}
+	if spec.Metric == "" {
+		spec.Metric = "totalReturn"
+	}
+	if _, err := metricValue(&RunMetrics{}, spec.Metric); err != nil {
+		return err
+	}
+	if spec.Cash <= 0 {
+		return errors.New("sweep: cash must be positive")
+	}
+	if spec.Workers <= 0 {
+		spec.Workers = runtime.NumCPU()
+	}
+	if err := spec.Broker.validate(); err != nil {
+		return err
+	}
+	if _, _, err := spec.dateRange(); err != nil {
+		return err
+	}
+	if len(spec.Params) == 0 {
+		return errors.New("sweep: no params to sweep")
+	}
+	for name, r := range spec.Params {
+		if r == nil || len(r.Values) == 0 {
+			return errors.New("sweep: no values for param " + name)
+		}
+	}
+	return nil
+}
+
+// Same hours as paper runs started from the web UI
+func (spec *SweepSpec) dateRange() (time.Time, time.Time, error) {
+	start, err := time.ParseInLocation("2006-01-02 15:04", spec.Start+" 09:00", timeLocation)
+	if err != nil {
+		return start, start, err
+	}
+	end, err := time.ParseInLocation("2006-01-02 15:04", spec.End+" 16:30", timeLocation)
+	if err != nil {
+		return start, end, err
+	}
+	if !end.After(start) {
+		return start, end, errors.New("sweep: end must be after start")
+	}
+	return start, end, nil
+}
+
+// Cartesian product of all param values, merged with the fixed params
+func (spec *SweepSpec) combinations() []map[string]interface{} {
+	names := []string{}
+	for name := range spec.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	combinations := []map[string]interface{}{{}}
+	for _, name := range names {
+		next := []map[string]interface{}{}
+		for _, c := range combinations {
+			for _, v := range spec.Params[name].Values {
+				combination := map[string]interface{}{name: v}
+				for k, existing := range c {
+					combination[k] = existing
+				}
+				next = append(next, combination)
+			}
+		}
+		combinations = next
+	}
+	for _, c := range combinations {
+		for k, v := range spec.Fixed {
+			c[k] = v
+		}
+	}
+	return combinations
+}
+
+func metricValue(metrics *RunMetrics, name string) (float64, error) {
+	var values map[string]interface{}
+	if err := roundTripJson(metrics, &values); err != nil {
+		return 0, err
+	}
+	value, ok := values[name].(float64)
+	if !ok {
+		return 0, errors.New("unknown metric: " + name)
+	}
+	return value, nil
+}
+
+// Runs one backtest per param combination, workers at a time, ranks them by
+// the spec's metric and saves the sweep. onProgress, if not nil, gets called
+// after each run. Cancelling ctx stops the runs and fails the sweep.
+func runSweep(ctx context.Context, spec *SweepSpec, onProgress func(done, total int)) (*Sweep, error) {
+	results, err := runSweepBacktests(ctx, spec, onProgress)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().In(timeLocation)
+	sweep := &Sweep{
+		Id:        newPaperRunId(now),
+		CreatedAt: now,
+		Spec:      spec,
+		Results:   results,
+	}
+	return sweep, writeJsonFile(fmt.Sprintf("%s/%s.json", sweepsFolder, sweep.Id), sweep)
+}
+
+func runSweepBacktests(ctx context.Context, spec *SweepSpec, onProgress func(done, total int)) ([]*SweepResult, error) {
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+	start, end, _ := spec.dateRange()
+
+	combinations := spec.combinations()
+	results := make([]*SweepResult, len(combinations))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var progressRW sync.Mutex
+	done := 0
+
+	for w := 0; w < spec.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = runSweepBacktest(ctx, spec, combinations[i], start, end)
+				if onProgress != nil {
+					progressRW.Lock()
+					done++
+					onProgress(done, len(combinations))
+					progressRW.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range combinations {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	rankSweepResults(results, spec.Metric)
+	return results, nil
+}
+
+func runSweepBacktest(
+	ctx context.Context, spec *SweepSpec, params map[string]interface{}, start, end time.Time,
+) *SweepResult {
+	result := &SweepResult{Params: params}
+	tm, err := runBacktest(ctx, spec.Strategy, params, start, end, spec.Cash, spec.Broker)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	metrics := tm.Metrics()
+	if result.Score, err = metricValue(metrics, spec.Metric); err != nil {
+		result.Error = err.Error()
+	}
+	// Trades are by far the biggest part and are not needed to compare runs
+	metrics.Trades = nil
+	result.Metrics = metrics
+	return result
+}
+
+// Runs a quiet paper backtest to completion, or stops it when ctx is
+// cancelled
+func runBacktest(
+	ctx context.Context, strategy string, params map[string]interface{}, start, end time.Time, cash float64,
+	brokerConfig PaperBrokerConfig,
+) (*TradingManagerV1, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	config, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	tm, err := NewBacktestTradingManager(strategy, string(config), start, end, cash, brokerConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := tm.Start(); err != nil {
+		return nil, err
+	}
+	over := make(chan bool)
+	defer close(over)
+	go func() {
+		select {
+		case <-ctx.Done():
+			tm.requestStop()
+		case <-over:
+		}
+	}()
+	tm.WaitForState(TradingManagerStateDone, TradingManagerStateFailed, TradingManagerStateStopped)
+	if tm.State() != TradingManagerStateDone {
+		return nil, errors.New("backtest ended in state " + string(tm.State()))
+	}
+	return tm, nil
+}
+
+// Best first, failed runs last
+func rankSweepResults(results []*SweepResult, metric string) {
+	ascending := sweepAscendingMetrics[metric]
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Error != "" || b.Error != "" {
+			return a.Error == "" && b.Error != ""
+		}
+		if ascending {
+			return a.Score < b.Score
+		}
+		return a.Score > b.Score
+	})
+	for i, r := range results {
+		r.Rank = i + 1
+	}
+}
+
+func printSweep(w io.Writer, sweep *Sweep) {
+	names := []string{}
+	for name := range sweep.Spec.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "rank\t%s\t%s\treturn\ttrades\twin %%\tmax dd %%\t\n", strings.Join(names, "\t"), sweep.Spec.Metric)
+	for _, r := range sweep.Results {
+		values := []string{}
+		for _, name := range names {
+			values = append(values, fmt.Sprintf("%v", r.Params[name]))
+		}
+		if r.Error != "" {
+			fmt.Fprintf(tw, "%d\t%s\terror: %s\t\t\t\t\t\n", r.Rank, strings.Join(values, "\t"), r.Error)
+			continue
+		}
+		fmt.Fprintf(
+			tw, "%d\t%s\t%.4f\t%.2f\t%d\t%.1f\t%.2f\t\n",
+			r.Rank, strings.Join(values, "\t"), r.Score, r.Metrics.TotalReturn,
+			r.Metrics.TradeCount, r.Metrics.WinRate*100, r.Metrics.MaxDrawdownPercent*100,
+		)
+	}
+	tw.Flush()
+}
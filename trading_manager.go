@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -12,6 +13,9 @@ const (
 	TradingManagerEnvironmentPaper      TradingManagerEnvironment = "paper"
 	TradingManagerEnvironmentStaging                              = "staging"
 	TradingManagerEnvironmentProduction                           = "production"
+	// Where runs against a QTSimulator keep their files, they trade like in
+	// production otherwise
+	TradingManagerEnvironmentSimulation = "simulation"
 )
 
 type TradingManagerState string
@@ -26,6 +30,9 @@ const (
 	TradingManagerStateStopped                      = "stopped"
 )
 
+// Ticks in a row transient Questrade errors can skip before the run fails
+const maxSkippedTicks = 5
+
 type TradingManager interface {
 	Now() time.Time
 	State() TradingManagerState
@@ -38,29 +45,46 @@ type TradingManager interface {
 }
 
 type TradingManagerV1 struct {
-	environment  TradingManagerEnvironment
-	state        TradingManagerState
-	now          time.Time
-	start        time.Time
-	end          time.Time
-	strategyName string
-	logger       Logger
-	strategy     Strategy
-	broker       Broker
-	datasource   Datasource
-	orderManager *OrderManager
+	environment TradingManagerEnvironment
+	// Read by the server & jobs while the loop goroutine moves it along
+	state          TradingManagerState
+	stateM         sync.Mutex
+	now            time.Time
+	start          time.Time
+	end            time.Time
+	strategyName   string
+	strategyParams StrategyParams
+	logger         Logger
+	strategy       Strategy
+	events         *strategyEventDispatcher
+	broker         Broker
+	datasource     Datasource
+	orderManager   *OrderManager
+	orderTracker   *OrderTracker
+	equity         []*EquityPoint
+	equityRecorder *EquityRecorder
+	runId          string
+	startingCash   float64
+	backtest       bool
+	// Ticks skipped in a row because of transient errors
+	skippedTicks int
+	// Questrade simulator the run trades against, its clock follows the run's
+	simulator *QTSimulator
 }
 
 func NewTradingManagerV1(
 	environment TradingManagerEnvironment, strategyName, strategyConfig string,
-) *TradingManagerV1 {
+) (*TradingManagerV1, error) {
 	tm := &TradingManagerV1{
 		environment: environment,
 		state:       TradingManagerStateStarting,
 		now:         time.Now().In(timeLocation),
+		runId:       newPaperRunId(time.Now().In(timeLocation)),
 	}
 	truncateLogFiles := environment != TradingManagerEnvironmentProduction
-	tm.logger = NewFileLogger(tm, "data/run/", string(environment), truncateLogFiles)
+	folder := runFolder(environment, tm.runId)
+	tm.logger = NewFileLogger(tm, folder, string(environment), truncateLogFiles)
+	tm.equityRecorder = NewEquityRecorder(tm, folder, string(environment), truncateLogFiles)
 
 	if environment == TradingManagerEnvironmentPaper {
 		tm.datasource = NewPaperDatasource(tm, tm.logger)
@@ -74,9 +98,76 @@ func NewTradingManagerV1(
 	}
 
 	tm.orderManager = NewOrderManager(tm.broker, tm.logger)
-	tm.loadStrategy(strategyName, strategyConfig)
+	tm.trackOrders()
+	if err := tm.loadStrategy(strategyName, strategyConfig); err != nil {
+		return nil, err
+	}
+
+	return tm, nil
+}
+
+// Paper trading manager that doesn't write any log, equity or run files so
+// that many can run at once (sweeps, walk-forward analysis)
+func NewBacktestTradingManager(
+	strategyName, strategyConfig string, start, end time.Time, cash float64, brokerConfig PaperBrokerConfig,
+) (*TradingManagerV1, error) {
+	tm := &TradingManagerV1{
+		environment: TradingManagerEnvironmentPaper,
+		state:       TradingManagerStateStarting,
+		now:         start,
+		start:       start,
+		end:         end,
+		backtest:    true,
+	}
+	tm.logger = NewNullLogger()
+	tm.datasource = NewPaperDatasource(tm, tm.logger)
+	paperBroker := NewPaperBroker(tm, tm.logger)
+	paperBroker.cash = cash
+	if err := paperBroker.Configure(brokerConfig); err != nil {
+		return nil, err
+	}
+	tm.broker = paperBroker
+
+	tm.orderManager = NewOrderManager(tm.broker, tm.logger)
+	tm.trackOrders()
+	if err := tm.loadStrategy(strategyName, strategyConfig); err != nil {
+		return nil, err
+	}
+
+	return tm, nil
+}
+
+// Production trading manager trading through QTApi, QTBroker & QTDatasource
+// against a QTSimulator from start to end, its equity goes in its own folder
+// rather than production's
+func NewQTSimulationTradingManager(
+	simulator *QTSimulator, strategyName, strategyConfig string, start, end time.Time, logger Logger,
+) (*TradingManagerV1, error) {
+	tm := &TradingManagerV1{
+		environment: TradingManagerEnvironmentProduction,
+		state:       TradingManagerStateStarting,
+		now:         start,
+		start:       start,
+		end:         end,
+		logger:      logger,
+		runId:       newPaperRunId(time.Now().In(timeLocation)),
+		simulator:   simulator,
+	}
+	tm.equityRecorder = NewEquityRecorder(
+		tm, runFolder(TradingManagerEnvironmentSimulation, tm.runId), TradingManagerEnvironmentSimulation, true,
+	)
+	tm.datasource = simulator.NewDatasource(tm.logger)
+	// Without a trading manager the broker doesn't save what it fetches over
+	// the production run's files
+	tm.broker = simulator.NewBroker(nil, tm.logger)
+
+	tm.orderManager = NewOrderManager(tm.broker, tm.logger)
+	tm.trackOrders()
+	if err := tm.loadStrategy(strategyName, strategyConfig); err != nil {
+		return nil, err
+	}
 
-	return tm
+	return tm, nil
 }
 
 func (tm *TradingManagerV1) Now() time.Time {
@@ -84,9 +175,17 @@ func (tm *TradingManagerV1) Now() time.Time {
 }
 
 func (tm *TradingManagerV1) State() TradingManagerState {
+	tm.stateM.Lock()
+	defer tm.stateM.Unlock()
 	return tm.state
 }
 
+func (tm *TradingManagerV1) setState(state TradingManagerState) {
+	tm.stateM.Lock()
+	defer tm.stateM.Unlock()
+	tm.state = state
+}
+
 func (tm *TradingManagerV1) Environment() TradingManagerEnvironment {
 	return tm.environment
 }
@@ -99,28 +198,43 @@ func (tm *TradingManagerV1) Datasource() Datasource {
 	return tm.datasource
 }
 
-func (tm *TradingManagerV1) loadStrategy(strategyName, strategyConfig string) {
-	switch strategyName {
-	case "rsi":
-		tm.strategy = NewRsiStrategy()
-	case "long_ma":
-		tm.strategy = NewLongMAStrategy()
-	case "bar_color":
-		tm.strategy = NewBarColorFollowStrategy()
-	case "follow_nasdaq":
-		tm.strategy = NewFollowNasdaqStrategy()
-	case "gapngo":
-		tm.strategy = NewGapNGoStrategy()
-	default:
-		panic("Unknown strategy: " + strategyName)
+func (tm *TradingManagerV1) Equity() []*EquityPoint {
+	return tm.equity
+}
+
+func (tm *TradingManagerV1) Metrics() *RunMetrics {
+	return computeRunMetrics(tm.broker.LastExecutions(), tm.equity)
+}
+
+func (tm *TradingManagerV1) OrderHistory(orderId int) []*OrderTransition {
+	return tm.orderTracker.History(orderId)
+}
+
+func (tm *TradingManagerV1) trackOrders() {
+	tm.orderTracker = NewOrderTracker(tm, tm.logger)
+	if trackingBroker, ok := tm.broker.(OrderTrackingBroker); ok {
+		trackingBroker.TrackOrders(tm.orderTracker)
+	}
+}
+
+func (tm *TradingManagerV1) loadStrategy(strategyName, strategyConfig string) error {
+	strategy, params, err := newStrategy(strategyName, strategyConfig)
+	if err != nil {
+		return err
+	}
+	tm.strategy = strategy
+	if eventStrategy, ok := strategy.(EventStrategy); ok {
+		tm.events = newStrategyEventDispatcher(eventStrategy)
 	}
 	tm.strategyName = strategyName
+	tm.strategyParams = params
+	return nil
 }
 
 func (tm *TradingManagerV1) WaitForState(states ...TradingManagerState) {
 	for {
 		for _, s := range states {
-			if tm.state == s {
+			if tm.State() == s {
 				return
 			}
 		}
@@ -130,40 +244,63 @@ func (tm *TradingManagerV1) WaitForState(states ...TradingManagerState) {
 
 func (tm *TradingManagerV1) tick() {
 	if _, err := tm.broker.Positions(); err != nil {
-		tm.logger.LogError("trading_manager", "broker positions: %s", err.Error())
-		tm.state = TradingManagerStateFailing
+		tm.tickFailed("broker positions", err)
 		return
 	}
 	if _, err := tm.broker.Executions(); err != nil {
-		tm.logger.LogError("trading_manager", "broker executions: %s", err.Error())
-		tm.state = TradingManagerStateFailing
+		tm.tickFailed("broker executions", err)
+		return
+	}
+	if orders, err := tm.broker.Orders(); err != nil {
+		tm.tickFailed("broker orders", err)
+		return
+	} else {
+		for _, o := range orders {
+			tm.orderTracker.Track(o)
+		}
+	}
+	if balance, err := tm.broker.Balance(); err != nil {
+		tm.tickFailed("broker balance", err)
 		return
+	} else {
+		point := newEquityPoint(tm.now, balance, tm.broker.LastPositions())
+		tm.equity = append(tm.equity, point)
+		if tm.equityRecorder != nil {
+			if err := tm.equityRecorder.Record(point); err != nil {
+				tm.logger.LogWarn("trading_manager", "equity recorder: %s", err.Error())
+			}
+		}
 	}
-	if _, err := tm.broker.Orders(); err != nil {
-		tm.logger.LogError("trading_manager", "broker orders: %s", err.Error())
-		tm.state = TradingManagerStateFailing
+	if err := tm.orderManager.Update(); err != nil {
+		tm.tickFailed("order manager", err)
 		return
 	}
-	if _, err := tm.broker.Balance(); err != nil {
-		tm.logger.LogError("trading_manager", "broker balance: %s", err.Error())
-		tm.state = TradingManagerStateFailing
+	if err := tm.dispatchStrategyEvents(); err != nil {
+		tm.tickFailed("strategy events", err)
 		return
 	}
 	if err := tm.strategy.Run(tm.now, tm.datasource, tm.broker, tm.orderManager); err != nil {
-		tm.logger.LogError("trading_manager", "strategy: %s", err.Error())
-		tm.state = TradingManagerStateFailing
+		tm.tickFailed("strategy", err)
 		return
 	}
 
 	// Handle Limit and Stop orders done with the PaperBroker
 	if tm.environment != TradingManagerEnvironmentProduction {
 		if err := tm.broker.(*PaperBroker).CheckLimitAndStopOrders(); err != nil {
-			tm.logger.LogError("trading_manager", "broker limit/stops: %s", err.Error())
-			tm.state = TradingManagerStateFailing
+			tm.tickFailed("broker limit/stops", err)
+			return
+		}
+	}
+
+	if tm.events != nil {
+		if err := tm.events.dispatchDayEnd(tm.strategyContext()); err != nil {
+			tm.tickFailed("strategy day end", err)
 			return
 		}
 	}
 
+	tm.skippedTicks = 0
+
 	// Handle Circuit Breakers
 	if tm.environment == TradingManagerEnvironmentProduction {
 		balance := tm.broker.LastBalance()
@@ -171,16 +308,61 @@ func (tm *TradingManagerV1) tick() {
 			if 1-((balance.Cash+balance.MarketValue)/balance.StartOfDayCash) > 0.5 {
 				// Wowza, we're down 10%. Let's stop right now.
 				tm.logger.LogError("trading_manager", "circuit_breaker: we're down >5% ABORTING")
-				tm.state = TradingManagerStateFailing
+				tm.setState(TradingManagerStateFailing)
 			}
 		}
 	}
 }
 
+// Fails the run because of err, unless it's an order rejection or a transient
+// Questrade error (network, server errors, rate limits) and less than
+// maxSkippedTicks ticks in a row got skipped already: a flaky fetch or an
+// order too big for the account shouldn't liquidate everything
+func (tm *TradingManagerV1) tickFailed(what string, err error) {
+	if isOrderRejected(err) {
+		// Event strategies get the order in OnOrderRejected next tick
+		tm.logger.LogWarn("trading_manager", "%s: %s, skipping tick", what, err.Error())
+		return
+	}
+	if isQTApiError(err, QTApiErrorTransient, QTApiErrorRateLimited) && tm.skippedTicks < maxSkippedTicks {
+		tm.skippedTicks++
+		tm.logger.LogWarn("trading_manager", "%s: %s, skipping tick (%d in a row)", what, err.Error(), tm.skippedTicks)
+		return
+	}
+	tm.logger.LogError("trading_manager", "%s: %s", what, err.Error())
+	tm.setState(TradingManagerStateFailing)
+}
+
+func (tm *TradingManagerV1) strategyContext() *StrategyContext {
+	return &StrategyContext{
+		Now:          tm.now,
+		Datasource:   tm.datasource,
+		Broker:       tm.broker,
+		OrderManager: tm.orderManager,
+	}
+}
+
+// Calls EventStrategy hooks for anything that happened since the last tick
+func (tm *TradingManagerV1) dispatchStrategyEvents() error {
+	if tm.events == nil {
+		return nil
+	}
+	ctx := tm.strategyContext()
+	if !tm.events.started {
+		if err := tm.events.start(ctx); err != nil {
+			return err
+		}
+	}
+	if err := tm.events.dispatchBrokerEvents(ctx); err != nil {
+		return err
+	}
+	return tm.events.dispatchCandles(ctx)
+}
+
 func (tm *TradingManagerV1) loopCore() bool {
-	switch tm.state {
+	switch tm.State() {
 	case TradingManagerStateStarting:
-		tm.state = TradingManagerStateRunning
+		tm.setState(TradingManagerStateRunning)
 		tm.logger.LogInfo("trading_manager", "done starting")
 	case TradingManagerStateRunning:
 		// We don't play weekends
@@ -200,14 +382,14 @@ func (tm *TradingManagerV1) loopCore() bool {
 		tm.logger.LogInfo("trading_manager", "start stopping")
 		tm.abort()
 		tm.logger.LogInfo("trading_manager", "done stopping")
-		tm.state = TradingManagerStateStopped
+		tm.setState(TradingManagerStateStopped)
 	case TradingManagerStateStopped:
 		return true
 	case TradingManagerStateFailing:
 		tm.logger.LogInfo("trading_manager", "start failing")
 		tm.abort()
 		tm.logger.LogInfo("trading_manager", "done failing")
-		tm.state = TradingManagerStateFailed
+		tm.setState(TradingManagerStateFailed)
 	case TradingManagerStateFailed:
 		return true
 	default:
@@ -224,7 +406,53 @@ func (tm *TradingManagerV1) loopPaper() {
 		}
 		tm.now = tm.now.Add(1 * time.Minute)
 	}
-	tm.state = TradingManagerStateDone
+	finalState := tm.finalState()
+	if !tm.backtest {
+		tm.saveRun(finalState)
+	}
+	tm.setState(finalState)
+}
+
+// State a run ends in once its loop is over, a run failing or stopping on its
+// last tick gets aborted first
+func (tm *TradingManagerV1) finalState() TradingManagerState {
+	if state := tm.State(); state == TradingManagerStateFailing || state == TradingManagerStateStopping {
+		tm.loopCore()
+	}
+	if state := tm.State(); state == TradingManagerStateFailed || state == TradingManagerStateStopped {
+		return state
+	}
+	return TradingManagerStateDone
+}
+
+func (tm *TradingManagerV1) saveRun(state TradingManagerState) {
+	metrics := tm.Metrics()
+	run := &PaperRun{
+		PaperRunSummary: PaperRunSummary{
+			Id:           tm.runId,
+			CreatedAt:    time.Now().In(timeLocation),
+			Strategy:     tm.strategyName,
+			Params:       tm.strategyParams,
+			Start:        tm.start,
+			End:          tm.end,
+			StartingCash: tm.startingCash,
+			Broker:       tm.broker.(*PaperBroker).config,
+			State:        state,
+			TotalReturn:  metrics.TotalReturn,
+			TradeCount:   metrics.TradeCount,
+		},
+		Orders:       tm.broker.LastOrders(),
+		Executions:   tm.broker.LastExecutions(),
+		Equity:       downsampleEquity(tm.equity, 2000),
+		BorrowFees:   tm.broker.(*PaperBroker).borrowFees,
+		MarginCalls:  tm.broker.(*PaperBroker).marginCalls,
+		Lots:         tm.broker.(*PaperBroker).lots,
+		OrderHistory: tm.orderTracker.Histories(),
+		Metrics:      metrics,
+	}
+	if err := savePaperRun(run); err != nil {
+		tm.logger.LogError("trading_manager", "saving run %s: %s", tm.runId, err.Error())
+	}
 }
 
 func (tm *TradingManagerV1) loopStaging() {
@@ -236,7 +464,24 @@ func (tm *TradingManagerV1) loopStaging() {
 		tm.now = tm.now.Add(1 * time.Minute)
 		time.Sleep(300 * time.Millisecond) // Run 4h30m in ~2m15s
 	}
-	tm.state = TradingManagerStateDone
+	tm.setState(tm.finalState())
+}
+
+// Like loopPaper, limit & stop orders get filled by the simulator as its
+// clock moves
+func (tm *TradingManagerV1) loopSimulation() {
+	tm.now = tm.start.Truncate(time.Minute).Add(-1 * time.Second)
+	for tm.now.Before(tm.end) {
+		if err := tm.simulator.SetNow(tm.now); err != nil {
+			tm.logger.LogError("trading_manager", "simulator: %s", err.Error())
+			tm.setState(TradingManagerStateFailing)
+		}
+		if stop := tm.loopCore(); stop {
+			break
+		}
+		tm.now = tm.now.Add(1 * time.Minute)
+	}
+	tm.setState(tm.finalState())
 }
 
 func (tm *TradingManagerV1) loopProduction() {
@@ -249,8 +494,8 @@ func (tm *TradingManagerV1) loopProduction() {
 			}
 			paniced = true
 			tm.logger.LogError("trading_manager", "paniced ABORTING")
-			if tm.state != TradingManagerStateFailed {
-				tm.state = TradingManagerStateFailing
+			if tm.State() != TradingManagerStateFailed {
+				tm.setState(TradingManagerStateFailing)
 			}
 			tm.WaitForState(TradingManagerStateFailed)
 			os.Exit(1)
@@ -272,16 +517,28 @@ func (tm *TradingManagerV1) loop() {
 	case TradingManagerEnvironmentStaging:
 		tm.loopStaging()
 	case TradingManagerEnvironmentProduction:
-		tm.loopProduction()
+		if tm.simulator != nil {
+			tm.loopSimulation()
+		} else {
+			tm.loopProduction()
+		}
 	default:
 		panic("unknown trading manager environment")
 	}
+	if tm.equityRecorder != nil {
+		if err := tm.equityRecorder.Close(); err != nil {
+			tm.logger.LogWarn("trading_manager", "equity recorder: %s", err.Error())
+		}
+	}
 }
 
 func (tm *TradingManagerV1) Start() error {
 	if tm.State() != TradingManagerStateStarting {
 		return errors.New("can't start when state is: " + string(tm.State()))
 	}
+	if balance := tm.broker.LastBalance(); balance != nil {
+		tm.startingCash = balance.Cash
+	}
 	go tm.loop()
 	return nil
 }
@@ -320,17 +577,24 @@ func (tm *TradingManagerV1) abort() {
 		}
 
 		for _, p := range positions {
-			// TODO handle liquidating short positions with buy-to-cover's
 			if p.OpenQuantity > 0 {
 				_, err = tm.broker.CreateOrder(p.SymbolId, OrderActionSell, OrderTypeMarket, 0, p.OpenQuantity)
 				if err != nil {
 					tm.logger.LogError("trading_manager", "aborting: error creating sell order: %s", err.Error())
 					encounteredError = true
 				}
+			} else if p.OpenQuantity < 0 {
+				// Buy-to-cover shorts
+				_, err = tm.broker.CreateOrder(p.SymbolId, OrderActionBuy, OrderTypeMarket, 0, -p.OpenQuantity)
+				if err != nil {
+					tm.logger.LogError("trading_manager", "aborting: error creating buy-to-cover order: %s", err.Error())
+					encounteredError = true
+				}
 			}
 		}
 
-		if encounteredError {
+		// Simulations just end up failed, there's no real position left behind
+		if encounteredError && tm.simulator == nil {
 			// Ok let's die now so that server uptime alert's trigger
 			// As we encountered an error we probably missed a cancel/sell order
 			os.Exit(1)
@@ -338,14 +602,25 @@ func (tm *TradingManagerV1) abort() {
 	}
 }
 
+// Stops the run and waits for it to be over, it can still end done when its
+// loop was already finishing
 func (tm *TradingManagerV1) Stop() {
-	if tm.state == TradingManagerStateStarting ||
-		tm.state == TradingManagerStateDone ||
-		tm.state == TradingManagerStateStopped ||
-		tm.state == TradingManagerStateFailed {
-		return
+	if tm.requestStop() {
+		tm.WaitForState(TradingManagerStateDone, TradingManagerStateFailed, TradingManagerStateStopped)
 	}
+}
 
-	tm.state = TradingManagerStateStopping
-	tm.WaitForState(TradingManagerStateFailed, TradingManagerStateStopped)
+// Asks the loop to stop the run without waiting for it, false when there's
+// nothing to stop
+func (tm *TradingManagerV1) requestStop() bool {
+	tm.stateM.Lock()
+	defer tm.stateM.Unlock()
+	switch tm.state {
+	case TradingManagerStateStarting, TradingManagerStateDone, TradingManagerStateStopped, TradingManagerStateFailed:
+		return false
+	case TradingManagerStateRunning:
+		// A failing run already gets aborted
+		tm.state = TradingManagerStateStopping
+	}
+	return true
 }
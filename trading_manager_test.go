@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestBacktest(t *testing.T) *TradingManagerV1 {
+	t.Helper()
+	day := writeTestCandleFiles(t)
+	tm, err := NewBacktestTradingManager(
+		"long_ma", `{"symbolIds":[1]}`, day.Add(9*time.Hour), day.Add(16*time.Hour), 25000, PaperBrokerConfig{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}
+
+// A stop asked for while the loop was finishing still ends the run stopped
+func TestFinalStateHonoursPendingStop(t *testing.T) {
+	tm := newTestBacktest(t)
+	tm.setState(TradingManagerStateRunning)
+	if !tm.requestStop() {
+		t.Fatal("running run can't be stopped")
+	}
+	if state := tm.finalState(); state != TradingManagerStateStopped {
+		t.Errorf("run ends %s, want stopped", state)
+	}
+}
+
+func TestStopReturnsOnceRunIsOver(t *testing.T) {
+	tm := newTestBacktest(t)
+	if err := tm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	tm.WaitForState(TradingManagerStateDone, TradingManagerStateFailed, TradingManagerStateStopped)
+
+	stopped := make(chan bool)
+	go func() {
+		tm.Stop()
+		stopped <- true
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Stop still waiting on a run that ended %s", tm.State())
+	}
+}
@@ -19,6 +19,37 @@ func min(a, b int) int {
 	return b
 }
 
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func abs64(a int64) int64 {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+func sign(a int64) int64 {
+	if a < 0 {
+		return -1
+	}
+	if a > 0 {
+		return 1
+	}
+	return 0
+}
+
 func fmin(a, b float64) float64 {
 	if a < b {
 		return a
@@ -33,6 +64,14 @@ func fmax(a, b float64) float64 {
 	return b
 }
 
+func avg(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
 func intArrayToString(ints []int) string {
 	strs := make([]string, len(ints))
 	for i, value := range ints {
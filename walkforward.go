@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const walkForwardsFolder = "data/walk-forwards"
+
+// A sweep over a rolling window: every window optimizes the params on
+// InSampleDays trading days then runs the best ones on the OutOfSampleDays
+// that follow. The next window starts StepDays later (OutOfSampleDays by
+// default so that out-of-sample windows don't overlap).
+type WalkForwardSpec struct {
+	SweepSpec
+	InSampleDays    int `json:"inSampleDays"`
+	OutOfSampleDays int `json:"outOfSampleDays"`
+	StepDays        int `json:"stepDays"`
+}
+
+type WalkForwardWindow struct {
+	InSampleStart      string                 `json:"inSampleStart"`
+	InSampleEnd        string                 `json:"inSampleEnd"`
+	OutOfSampleStart   string                 `json:"outOfSampleStart"`
+	OutOfSampleEnd     string                 `json:"outOfSampleEnd"`
+	Params             map[string]interface{} `json:"params"`
+	InSampleScore      float64                `json:"inSampleScore"`
+	OutOfSampleScore   float64                `json:"outOfSampleScore"`
+	InSampleMetrics    *RunMetrics            `json:"inSampleMetrics"`
+	OutOfSampleMetrics *RunMetrics            `json:"outOfSampleMetrics"`
+	Error              string                 `json:"error,omitempty"`
+}
+
+type WalkForward struct {
+	Id        string               `json:"id"`
+	CreatedAt time.Time            `json:"createdAt"`
+	Spec      *WalkForwardSpec     `json:"spec"`
+	Windows   []*WalkForwardWindow `json:"windows"`
+	// Out-of-sample windows back to back, each starting with the equity the
+	// previous one ended with
+	Equity  []*EquityPoint `json:"equity"`
+	Metrics *RunMetrics    `json:"metrics"`
+	// Out-of-sample return per day over in-sample return per day, well under
+	// 1 means the params were fitted to noise
+	Efficiency float64 `json:"efficiency"`
+}
+
+func (spec *WalkForwardSpec) validate() error {
+	if err := spec.SweepSpec.validate(); err != nil {
+		return err
+	}
+	if spec.InSampleDays <= 0 || spec.OutOfSampleDays <= 0 {
+		return errors.New("walk-forward: inSampleDays and outOfSampleDays must be positive")
+	}
+	if spec.StepDays <= 0 {
+		spec.StepDays = spec.OutOfSampleDays
+	}
+	if len(spec.windows()) == 0 {
+		return errors.New("walk-forward: not enough days between start and end for one window")
+	}
+	return nil
+}
+
+// Weekdays from start to end, holidays are left in and simply have no candles
+func (spec *WalkForwardSpec) tradingDays() []string {
+	days := []string{}
+	start, end, err := spec.dateRange()
+	if err != nil {
+		return days
+	}
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		if day.Weekday() != time.Saturday && day.Weekday() != time.Sunday {
+			days = append(days, day.Format(dateFormat))
+		}
+	}
+	return days
+}
+
+func (spec *WalkForwardSpec) windows() []*WalkForwardWindow {
+	days := spec.tradingDays()
+	windows := []*WalkForwardWindow{}
+	for i := 0; i+spec.InSampleDays < len(days); i += spec.StepDays {
+		outOfSampleEnd := i + spec.InSampleDays + spec.OutOfSampleDays - 1
+		if outOfSampleEnd >= len(days) {
+			outOfSampleEnd = len(days) - 1
+		}
+		windows = append(windows, &WalkForwardWindow{
+			InSampleStart:    days[i],
+			InSampleEnd:      days[i+spec.InSampleDays-1],
+			OutOfSampleStart: days[i+spec.InSampleDays],
+			OutOfSampleEnd:   days[outOfSampleEnd],
+		})
+	}
+	return windows
+}
+
+// Runs every window in order and saves the result. onProgress, if not nil,
+// gets called after each in-sample and out-of-sample run. Cancelling ctx stops
+// the runs and fails the walk-forward.
+func runWalkForward(ctx context.Context, spec *WalkForwardSpec, onProgress func(done, total int)) (*WalkForward, error) {
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().In(timeLocation)
+	wf := &WalkForward{
+		Id:        newPaperRunId(now),
+		CreatedAt: now,
+		Spec:      spec,
+		Windows:   spec.windows(),
+		Equity:    []*EquityPoint{},
+	}
+
+	// Every window sweeps all combinations then runs the best one
+	runs := len(spec.combinations()) + 1
+	total := len(wf.Windows) * runs
+	progress := func(done int) {
+		if onProgress != nil {
+			onProgress(done, total)
+		}
+	}
+
+	// Order ids restart with every window's broker, executions are paired up
+	// into trades within their window
+	trades := []*RunTrade{}
+	executions := []*BrokerExecution{}
+	cash := spec.Cash
+	for i, window := range wf.Windows {
+		tm, err := runWalkForwardWindow(ctx, spec, window, cash, func(done, _ int) {
+			progress(i*runs + done)
+		})
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if err != nil {
+			window.Error = err.Error()
+		} else {
+			// Positions still open at the end of a window are valued at the
+			// last price, the next window starts back in cash
+			equity := tm.Equity()
+			if len(equity) > 0 {
+				cash = equity[len(equity)-1].Equity
+			}
+			wf.Equity = append(wf.Equity, equity...)
+			windowExecutions := tm.Broker().LastExecutions()
+			trades = append(trades, computeRunTrades(windowExecutions)...)
+			executions = append(executions, windowExecutions...)
+		}
+		progress((i + 1) * runs)
+	}
+
+	wf.Metrics = computeTradesMetrics(trades, executions, wf.Equity)
+	wf.Efficiency = walkForwardEfficiency(spec, wf.Windows)
+	wf.Equity = downsampleEquity(wf.Equity, 2000)
+
+	return wf, writeJsonFile(fmt.Sprintf("%s/%s.json", walkForwardsFolder, wf.Id), wf)
+}
+
+// Optimizes on the in-sample days then backtests the best params on the
+// out-of-sample days, returning the out-of-sample trading manager. onProgress
+// gets called after each in-sample run.
+func runWalkForwardWindow(
+	ctx context.Context, spec *WalkForwardSpec, window *WalkForwardWindow, cash float64,
+	onProgress func(done, total int),
+) (*TradingManagerV1, error) {
+	inSample := spec.SweepSpec
+	inSample.Start = window.InSampleStart
+	inSample.End = window.InSampleEnd
+	results, err := runSweepBacktests(ctx, &inSample, onProgress)
+	if err != nil {
+		return nil, err
+	}
+	best := results[0]
+	if best.Error != "" {
+		return nil, errors.New("no successful in-sample run: " + best.Error)
+	}
+	window.Params = best.Params
+	window.InSampleScore = best.Score
+	window.InSampleMetrics = best.Metrics
+
+	outOfSample := spec.SweepSpec
+	outOfSample.Start = window.OutOfSampleStart
+	outOfSample.End = window.OutOfSampleEnd
+	start, end, err := outOfSample.dateRange()
+	if err != nil {
+		return nil, err
+	}
+	tm, err := runBacktest(ctx, spec.Strategy, best.Params, start, end, cash, spec.Broker)
+	if err != nil {
+		return nil, err
+	}
+	metrics := tm.Metrics()
+	if window.OutOfSampleScore, err = metricValue(metrics, spec.Metric); err != nil {
+		return nil, err
+	}
+	metrics.Trades = nil
+	window.OutOfSampleMetrics = metrics
+	return tm, nil
+}
+
+func walkForwardEfficiency(spec *WalkForwardSpec, windows []*WalkForwardWindow) float64 {
+	var inSample, outOfSample float64
+	var count int
+	for _, w := range windows {
+		if w.Error != "" {
+			continue
+		}
+		inSample += w.InSampleMetrics.TotalReturnPercent / float64(spec.InSampleDays)
+		outOfSample += w.OutOfSampleMetrics.TotalReturnPercent / float64(spec.OutOfSampleDays)
+		count++
+	}
+	if count == 0 || inSample == 0 {
+		return 0
+	}
+	return outOfSample / inSample
+}
+
+func printWalkForward(w io.Writer, wf *WalkForward) {
+	names := []string{}
+	for name := range wf.Spec.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "in sample\tout of sample\t%s\tis %s\toos %s\toos return\t\n",
+		strings.Join(names, "\t"), wf.Spec.Metric, wf.Spec.Metric)
+	for _, window := range wf.Windows {
+		days := fmt.Sprintf("%s %s\t%s %s", window.InSampleStart, window.InSampleEnd,
+			window.OutOfSampleStart, window.OutOfSampleEnd)
+		if window.Error != "" {
+			fmt.Fprintf(tw, "%s\terror: %s\t\n", days, window.Error)
+			continue
+		}
+		values := []string{}
+		for _, name := range names {
+			values = append(values, fmt.Sprintf("%v", window.Params[name]))
+		}
+		fmt.Fprintf(
+			tw, "%s\t%s\t%.4f\t%.4f\t%.2f\t\n",
+			days, strings.Join(values, "\t"), window.InSampleScore, window.OutOfSampleScore,
+			window.OutOfSampleMetrics.TotalReturn,
+		)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(
+		w, "\nOut of sample: return %.2f (%.2f%%), %d trades, win %.1f%%, max dd %.2f%%, efficiency %.2f\n",
+		wf.Metrics.TotalReturn, wf.Metrics.TotalReturnPercent*100, wf.Metrics.TradeCount,
+		wf.Metrics.WinRate*100, wf.Metrics.MaxDrawdownPercent*100, wf.Efficiency,
+	)
+}